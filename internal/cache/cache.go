@@ -0,0 +1,185 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/adamkobi/xt/internal/config"
+	"github.com/adamkobi/xt/internal/instance"
+)
+
+const fileSuffix = ".json"
+
+//Key identifies the instances returned by a single provider query
+type Key struct {
+	Profile       string            `json:"profile"`
+	Provider      string            `json:"provider"`
+	Region        string            `json:"region,omitempty"`
+	CredsProfile  string            `json:"creds_profile,omitempty"`
+	VPC           string            `json:"vpc,omitempty"`
+	Tag           string            `json:"tag"`
+	SearchPattern string            `json:"search_pattern"`
+	Query         string            `json:"query,omitempty"`
+	Filters       map[string]string `json:"filters,omitempty"`
+	States        []string          `json:"states,omitempty"`
+	MaxInstances  int               `json:"max_instances,omitempty"`
+	Endpoint      string            `json:"endpoint,omitempty"`
+	//Credentials is a hash identifying static credentials, the access key is never stored
+	Credentials string   `json:"credentials,omitempty"`
+	Roles       []string `json:"roles,omitempty"`
+	//Multi account discovery
+	Organization    bool              `json:"organization,omitempty"`
+	AccountIDs      []string          `json:"account_ids,omitempty"`
+	ExcludeAccounts []string          `json:"exclude_accounts,omitempty"`
+	AccountRole     string            `json:"account_role,omitempty"`
+	Settings        map[string]string `json:"settings,omitempty"`
+}
+
+//Entry is a cached provider query result
+type Entry struct {
+	Key       Key                  `json:"key"`
+	CreatedAt time.Time            `json:"created_at"`
+	Instances instance.XTInstances `json:"instances"`
+}
+
+//Cache stores provider query results on disk for TTL
+type Cache struct {
+	Dir string
+	TTL time.Duration
+}
+
+//DefaultDir returns the cache directory
+func DefaultDir() string {
+	return path.Join(config.DefaultDir(), "cache")
+}
+
+//New returns a cache stored in the default cache directory
+func New(ttl time.Duration) *Cache {
+	return &Cache{
+		Dir: DefaultDir(),
+		TTL: ttl,
+	}
+}
+
+//Enabled reports whether results should be read from and written to the cache
+func (c *Cache) Enabled() bool {
+	return c != nil && c.TTL > 0
+}
+
+//Get returns the cached instances of key if they have not expired
+func (c *Cache) Get(key Key) (instance.XTInstances, bool) {
+	if !c.Enabled() {
+		return nil, false
+	}
+	entry, err := c.read(c.filename(key))
+	if err != nil || c.expired(entry) {
+		return nil, false
+	}
+	return entry.Instances, true
+}
+
+//Set stores the instances of key
+func (c *Cache) Set(key Key, instances instance.XTInstances) error {
+	if !c.Enabled() {
+		return nil
+	}
+	if err := os.MkdirAll(c.Dir, 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(Entry{
+		Key:       key,
+		CreatedAt: time.Now(),
+		Instances: instances,
+	})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.filename(key), data, 0600)
+}
+
+//Clear removes all cached entries
+func (c *Cache) Clear() error {
+	files, err := c.files()
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := os.Remove(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Names returns the instance names of all valid entries cached for profile and tag
+func (c *Cache) Names(profile, tag string) []string {
+	files, err := c.files()
+	if err != nil {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var names []string
+	for _, f := range files {
+		entry, err := c.read(f)
+		if err != nil || c.expired(entry) {
+			continue
+		}
+		if entry.Key.Profile != profile || entry.Key.Tag != tag {
+			continue
+		}
+		for _, name := range entry.Instances.Names() {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (c *Cache) expired(entry *Entry) bool {
+	return time.Since(entry.CreatedAt) > c.TTL
+}
+
+func (c *Cache) filename(key Key) string {
+	data, _ := json.Marshal(key)
+	sum := sha256.Sum256(data)
+	return path.Join(c.Dir, hex.EncodeToString(sum[:])+fileSuffix)
+}
+
+func (c *Cache) files() ([]string, error) {
+	entries, err := ioutil.ReadDir(c.Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), fileSuffix) {
+			files = append(files, path.Join(c.Dir, e.Name()))
+		}
+	}
+	return files, nil
+}
+
+func (c *Cache) read(filename string) (*Entry, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var entry Entry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
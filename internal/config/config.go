@@ -2,8 +2,11 @@ package config
 
 import (
 	"fmt"
+	"os"
 	"sort"
 	"strings"
+	"text/template"
+	"time"
 )
 
 const JSON = "json"
@@ -34,6 +37,7 @@ type ProfileOptions struct {
 	ProviderOptions []ProviderOptions `yaml:"providers"`
 	SSHOptions      SSHOptions        `yaml:"ssh"`
 	DisplayMsg      string            `yaml:"message,omitempty"`
+	CacheTTL        string            `yaml:"cache-ttl,omitempty"`
 }
 
 type ProviderOptions struct {
@@ -42,12 +46,171 @@ type ProviderOptions struct {
 	Region       string            `yaml:"region"`
 	VPC          string            `yaml:"vpc-id"`
 	Filters      map[string]string `yaml:"filters,omitempty"`
+	PageSize     int64             `yaml:"page-size,omitempty"`
+	MaxInstances int               `yaml:"max-instances,omitempty"`
+	Endpoint     string            `yaml:"endpoint,omitempty"`
+	Insecure     bool              `yaml:"insecure,omitempty"`
+	//DisableSSL sends requests over http, SigningRegion signs requests to endpoint for another region
+	DisableSSL    bool              `yaml:"disable-ssl,omitempty"`
+	SigningRegion string            `yaml:"signing-region,omitempty"`
+	Settings      map[string]string `yaml:"settings,omitempty"`
+
+	//Static credentials are read from the environment variables named here instead of creds-profile
+	AccessKeyIDEnv     string `yaml:"access-key-id-env,omitempty"`
+	SecretAccessKeyEnv string `yaml:"secret-access-key-env,omitempty"`
+	SessionTokenEnv    string `yaml:"session-token-env,omitempty"`
+
+	//RoleChain lists roles assumed in order before the provider role
+	RoleChain   []RoleOptions `yaml:"role-chain,omitempty"`
+	RoleARN     string        `yaml:"role-arn,omitempty"`
+	ExternalID  string        `yaml:"external-id,omitempty"`
+	MFASerial   string        `yaml:"mfa-serial,omitempty"`
+	SessionName string        `yaml:"session-name,omitempty"`
+
+	//Accounts discovers instances in several accounts using the provider credentials to assume a role in each
+	Accounts *AccountsOptions `yaml:"accounts,omitempty"`
+}
+
+//AccountsOptions selects the accounts a provider searches
+type AccountsOptions struct {
+	Organization bool     `yaml:"organization,omitempty"`
+	IDs          []string `yaml:"ids,omitempty"`
+	Exclude      []string `yaml:"exclude,omitempty"`
+	RoleName     string   `yaml:"role-name"`
+	ExternalID   string   `yaml:"external-id,omitempty"`
+	SessionName  string   `yaml:"session-name,omitempty"`
+}
+
+//RoleOptions describes a role to assume
+type RoleOptions struct {
+	RoleARN     string `yaml:"role-arn"`
+	ExternalID  string `yaml:"external-id,omitempty"`
+	MFASerial   string `yaml:"mfa-serial,omitempty"`
+	SessionName string `yaml:"session-name,omitempty"`
 }
 
 type SSHOptions struct {
 	User   string   `yaml:"user"`
 	Domain string   `yaml:"domain"`
 	Args   []string `yaml:"options"`
+	//Address lists the address strategies tried in order to connect to an instance,
+	//a strategy is either a name below or a Go template over the instance fields
+	Address []string `yaml:"address,omitempty"`
+	//Jump lists the jump hosts connections go through in order
+	Jump []JumpOptions `yaml:"jump,omitempty"`
+	//Transport selects how connections reach instances, ssh by default
+	Transport string `yaml:"transport,omitempty"`
+	//InstanceConnect pushes a key with EC2 Instance Connect before connecting when set
+	InstanceConnect *InstanceConnectOptions `yaml:"instance-connect,omitempty"`
+	//Backend selects the ssh implementation, the ssh and scp binaries by default
+	Backend string `yaml:"backend,omitempty"`
+	//ConnectTimeout limits how long connecting to an instance may take, e.g. 10s
+	ConnectTimeout string `yaml:"connect-timeout,omitempty"`
+}
+
+//SSH backends
+const (
+	//BackendOpenSSH executes the ssh and scp binaries
+	BackendOpenSSH = "openssh"
+	//BackendNative connects in process and copies files with SFTP
+	BackendNative = "native"
+)
+
+//InstanceConnectOptions describes the key pushed with EC2 Instance Connect
+type InstanceConnectOptions struct {
+	//Key is the private key path, it is generated when missing
+	Key string `yaml:"key,omitempty"`
+}
+
+//Transports
+const (
+	//TransportSSH connects with ssh and scp
+	TransportSSH = "ssh"
+	//TransportSSM opens sessions with AWS SSM Session Manager and runs commands with SSM SendCommand,
+	//files are copied with scp tunneled through SSM
+	TransportSSM = "ssm"
+	//TransportSSMTunnel connects with ssh and scp tunneled through SSM
+	TransportSSMTunnel = "ssm-tunnel"
+)
+
+//ValidateTransport returns an error when transport is not supported
+func ValidateTransport(transport string) error {
+	switch transport {
+	case TransportSSH, TransportSSM, TransportSSMTunnel:
+		return nil
+	default:
+		return fmt.Errorf("transport %s is not supported, supported transports: %s", transport,
+			strings.Join([]string{TransportSSH, TransportSSM, TransportSSMTunnel}, ", "))
+	}
+}
+
+//ConnectTransport returns the transport of the profile, override replaces it when set
+func (s *SSHOptions) ConnectTransport(override string) string {
+	switch {
+	case override != "":
+		return override
+	case s.Transport != "":
+		return s.Transport
+	default:
+		return TransportSSH
+	}
+}
+
+//JumpOptions describes a jump host, the ssh user is used when User is not set
+type JumpOptions struct {
+	Host string `yaml:"host"`
+	User string `yaml:"user,omitempty"`
+	Port int    `yaml:"port,omitempty"`
+	Key  string `yaml:"key,omitempty"`
+}
+
+//Address strategies
+const (
+	//AddressName connects to the instance name followed by the ssh domain
+	AddressName = "name"
+	//AddressPrivateIP connects to the private IP address
+	AddressPrivateIP = "private-ip"
+	//AddressPublicIP connects to the public IP address
+	AddressPublicIP = "public-ip"
+	//AddressDNS connects to the private DNS name, or the public one when there is no private DNS name
+	AddressDNS = "dns"
+)
+
+//IsAddressTemplate reports whether an address strategy is a Go template
+func IsAddressTemplate(strategy string) bool {
+	return strings.Contains(strategy, "{{")
+}
+
+//AddressPolicy returns the address strategies of the profile, connecting by name by default
+func (s *SSHOptions) AddressPolicy() []string {
+	if len(s.Address) == 0 {
+		return []string{AddressName}
+	}
+	return s.Address
+}
+
+//ConnectDuration returns the connect timeout, 0 when not set.
+//The timeout is validated with the profile, invalid values are treated as not set.
+func (s *SSHOptions) ConnectDuration() time.Duration {
+	timeout, err := s.connectDuration()
+	if err != nil {
+		return 0
+	}
+	return timeout
+}
+
+func (s *SSHOptions) connectDuration() (time.Duration, error) {
+	if s.ConnectTimeout == "" {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(s.ConnectTimeout)
+	if err != nil {
+		return 0, fmt.Errorf("profile.ssh.connect-timeout is invalid: %w", err)
+	}
+	if timeout < time.Second {
+		return 0, fmt.Errorf("profile.ssh.connect-timeout must be at least 1s")
+	}
+	return timeout, nil
 }
 
 //SSHArgs returns ssh options if they exist in profile else returns default
@@ -141,10 +304,25 @@ func (p *ProfileOptions) Validate() error {
 			return err
 		}
 	}
+	if _, err := p.CacheDuration(); err != nil {
+		return err
+	}
 
 	return nil
 }
 
+//CacheDuration returns how long discovered instances are cached, caching is disabled when not set
+func (p *ProfileOptions) CacheDuration() (time.Duration, error) {
+	if p.CacheTTL == "" {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(p.CacheTTL)
+	if err != nil {
+		return 0, fmt.Errorf("profile.cache-ttl is invalid: %w", err)
+	}
+	return ttl, nil
+}
+
 func (p *ProfileOptions) Message() string {
 	if p.DisplayMsg != "" {
 		msg := strings.Builder{}
@@ -173,9 +351,52 @@ func (s *SSHOptions) validate() error {
 	if s.User == "" {
 		return fmt.Errorf(fmt.Sprintf(notSetError, "profile.ssh.user"))
 	}
-	if s.Domain == "" {
+	byName := false
+	for _, a := range s.AddressPolicy() {
+		switch {
+		case a == AddressName:
+			byName = true
+		case a == AddressPrivateIP, a == AddressPublicIP, a == AddressDNS:
+		case IsAddressTemplate(a):
+			if _, err := template.New("address").Parse(a); err != nil {
+				return fmt.Errorf("profile.ssh.address template %q is invalid: %w", a, err)
+			}
+		default:
+			return fmt.Errorf("profile.ssh.address %s is not supported, supported strategies: %s or a template",
+				a, strings.Join([]string{AddressName, AddressPrivateIP, AddressPublicIP, AddressDNS}, ", "))
+		}
+	}
+	if byName && s.Domain == "" {
 		return fmt.Errorf(fmt.Sprintf(notSetError, "profile.ssh.domain"))
 	}
+	if s.Transport != "" {
+		if err := ValidateTransport(s.Transport); err != nil {
+			return fmt.Errorf("profile.ssh.%w", err)
+		}
+		if s.Transport != TransportSSH && len(s.Jump) > 0 {
+			return fmt.Errorf("profile.ssh.jump can not be used with the %s transport", s.Transport)
+		}
+	}
+	switch s.Backend {
+	case "", BackendOpenSSH:
+	case BackendNative:
+		if s.Transport != "" && s.Transport != TransportSSH {
+			return fmt.Errorf("profile.ssh.backend %s does not support the %s transport", s.Backend, s.Transport)
+		}
+	default:
+		return fmt.Errorf("profile.ssh.backend %s is not supported, supported backends: %s, %s", s.Backend, BackendOpenSSH, BackendNative)
+	}
+	if _, err := s.connectDuration(); err != nil {
+		return err
+	}
+	for _, j := range s.Jump {
+		if j.Host == "" {
+			return fmt.Errorf(notSetError, "profile.ssh.jump.host")
+		}
+		if j.Port < 0 || j.Port > 65535 {
+			return fmt.Errorf("profile.ssh.jump.port %d is invalid", j.Port)
+		}
+	}
 	return nil
 }
 
@@ -183,18 +404,57 @@ func (p *ProviderOptions) validate() error {
 	if p.Name == "" {
 		return fmt.Errorf(fmt.Sprintf(notSetError, "profile.provider.name"))
 	}
-	if p.Region == "" {
-		return fmt.Errorf(fmt.Sprintf(notSetError, "profile.provider.region"))
-	}
-	if p.CredsProfile == "" {
-		return fmt.Errorf(fmt.Sprintf(notSetError, "profile.provider.creds-profile"))
+	for _, r := range p.RoleChain {
+		if r.RoleARN == "" {
+			return fmt.Errorf(notSetError, "profile.provider.role-chain.role-arn")
+		}
 	}
-	if p.VPC == "" {
-		return fmt.Errorf(fmt.Sprintf(notSetError, "profile.provider.vpc-id"))
+	if (p.AccessKeyIDEnv == "") != (p.SecretAccessKeyEnv == "") {
+		return fmt.Errorf("profile.provider.access-key-id-env and profile.provider.secret-access-key-env must be set together")
 	}
 	return nil
 }
 
+//Roles returns the roles to assume in order, ending with the provider role
+func (p *ProviderOptions) Roles() []RoleOptions {
+	roles := append([]RoleOptions{}, p.RoleChain...)
+	if p.RoleARN != "" {
+		roles = append(roles, RoleOptions{
+			RoleARN:     p.RoleARN,
+			ExternalID:  p.ExternalID,
+			MFASerial:   p.MFASerial,
+			SessionName: p.SessionName,
+		})
+	}
+	return roles
+}
+
+//StaticCredentials returns the credentials read from the environment variables of the provider
+func (p *ProviderOptions) StaticCredentials() (id, secret, token string, err error) {
+	if p.AccessKeyIDEnv == "" {
+		return "", "", "", nil
+	}
+	lookup := func(name string) (string, error) {
+		value := os.Getenv(name)
+		if value == "" {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return value, nil
+	}
+	if id, err = lookup(p.AccessKeyIDEnv); err != nil {
+		return "", "", "", err
+	}
+	if secret, err = lookup(p.SecretAccessKeyEnv); err != nil {
+		return "", "", "", err
+	}
+	if p.SessionTokenEnv != "" {
+		if token, err = lookup(p.SessionTokenEnv); err != nil {
+			return "", "", "", err
+		}
+	}
+	return id, secret, token, nil
+}
+
 //Provider returns the selected profile config
 func (p *ProfileOptions) Provider() []ProviderOptions {
 	return p.ProviderOptions
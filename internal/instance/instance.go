@@ -1,10 +1,12 @@
 package instance
 
 import (
+	"fmt"
 	"sort"
 
 	"github.com/adamkobi/xt/pkg/iostreams"
 	"github.com/adamkobi/xt/pkg/utils"
+	"github.com/aws/aws-sdk-go/aws/session"
 )
 
 //XTInstance describes all the fields that Xt collects from EC2 instances
@@ -14,25 +16,74 @@ type XTInstance struct {
 	ImageID           string
 	PrivateIPAddress  string
 	PublicIPAddress   string
+	PrivateDNSName    string
+	PublicDNSName     string
 	InstanceType      string
+	State             string
 	AvailabilityZone  string
 	InstanceLifecycle string
 	LaunchTime        string
 	SubnetID          string
+	AccountID         string
+	AccountAlias      string
+	//Region and CredsProfile locate the instance for AWS APIs such as SSM
+	Region       string
+	CredsProfile string
+	Tags         map[string]string
+	//Session creates an AWS session with the credentials, roles and account the instance was found with.
+	//It is set by the aws provider and is not cached.
+	Session func() (*session.Session, error) `json:"-"`
 }
 
-func (i *XTInstance) name() string {
+//Name returns the search tag value of the instance, or its ID when the tag is missing
+func (i *XTInstance) Name() string {
+	if i.InstanceName == "" {
+		return i.InstanceID
+	}
 	return i.InstanceName
 }
 
 //XTInstances Describes a slice of XTInstance
 type XTInstances []XTInstance
 
+//Label returns the name of the instance followed by its ID, which tells apart instances sharing a name
+func (i *XTInstance) Label() string {
+	if i.InstanceID == "" || i.InstanceID == i.Name() {
+		return i.Name()
+	}
+	return fmt.Sprintf("%s (%s)", i.Name(), i.InstanceID)
+}
+
+//Select asks the user to pick one of the instances and returns it. When there are no instances
+//the user may confirm the search pattern, which is returned as an instance with only a name.
+func (i *XTInstances) Select(io *iostreams.IOStreams, searchPattern string) (*XTInstance, error) {
+	sorted := make([]*XTInstance, len(*i))
+	for idx := range *i {
+		sorted[idx] = &(*i)[idx]
+	}
+	sort.SliceStable(sorted, func(a, b int) bool {
+		return sorted[a].Label() < sorted[b].Label()
+	})
+	labels := make([]string, len(sorted))
+	for idx, inst := range sorted {
+		labels[idx] = inst.Label()
+	}
+
+	idx, err := utils.SelectIndex(io, labels, searchPattern)
+	if err != nil {
+		return nil, err
+	}
+	if idx < 0 {
+		return &XTInstance{InstanceName: searchPattern}, nil
+	}
+	return sorted[idx], nil
+}
+
 //Names returns a slice of the instances search tag value
 func (i *XTInstances) Names() []string {
 	var instances []string
 	for _, instance := range *i {
-		instances = append(instances, instance.name())
+		instances = append(instances, instance.Name())
 	}
 	sort.Strings(instances)
 	return instances
@@ -41,8 +92,12 @@ func (i *XTInstances) Names() []string {
 func (i *XTInstances) Print(io *iostreams.IOStreams) {
 	cs := io.ColorScheme()
 	table := utils.NewTablePrinter(io)
-	headerFields := []string{"Instance Name", "Instance ID", "Type", "Image ID", "Private IP Address",
+	headerFields := []string{"Instance Name", "Instance ID", "State", "Type", "Image ID", "Private IP Address",
 		"Public IP Address", "Availability Zone", "Subnet", "Launch Time", "Lifecycle"}
+	accounts := i.hasAccounts()
+	if accounts {
+		headerFields = append(headerFields, "Account ID", "Account Alias")
+	}
 	for _, header := range headerFields {
 		table.AddField(header, nil, cs.MagentaBold)
 	}
@@ -50,6 +105,7 @@ func (i *XTInstances) Print(io *iostreams.IOStreams) {
 	for _, inst := range *i {
 		table.AddField(inst.InstanceName, nil, cs.Green)
 		table.AddField(inst.InstanceID, nil, cs.Green)
+		table.AddField(inst.State, nil, cs.Green)
 		table.AddField(inst.InstanceType, nil, cs.Green)
 		table.AddField(inst.ImageID, nil, cs.Green)
 		table.AddField(inst.PrivateIPAddress, nil, cs.Green)
@@ -58,7 +114,21 @@ func (i *XTInstances) Print(io *iostreams.IOStreams) {
 		table.AddField(inst.SubnetID, nil, cs.Green)
 		table.AddField(inst.LaunchTime, nil, cs.Green)
 		table.AddField(inst.InstanceLifecycle, nil, cs.Green)
+		if accounts {
+			table.AddField(inst.AccountID, nil, cs.Green)
+			table.AddField(inst.AccountAlias, nil, cs.Green)
+		}
 		table.EndRow()
 	}
 	_ = table.Render()
 }
+
+//hasAccounts reports whether any instance was discovered in a specific account
+func (i *XTInstances) hasAccounts() bool {
+	for _, inst := range *i {
+		if inst.AccountID != "" {
+			return true
+		}
+	}
+	return false
+}
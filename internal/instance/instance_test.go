@@ -0,0 +1,42 @@
+package instance
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/adamkobi/xt/pkg/iostreams"
+)
+
+func TestLabel(t *testing.T) {
+	tests := []struct {
+		name string
+		inst XTInstance
+		want string
+	}{
+		{"name and ID", XTInstance{InstanceName: "web", InstanceID: "i-1"}, "web (i-1)"},
+		{"no name", XTInstance{InstanceID: "i-1"}, "i-1"},
+		{"name is the ID", XTInstance{InstanceName: "web-1", InstanceID: "web-1"}, "web-1"},
+		{"no ID", XTInstance{InstanceName: "web-1"}, "web-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.inst.Label(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrintState(t *testing.T) {
+	io, _, stdout, _ := iostreams.Test()
+	instances := XTInstances{{InstanceName: "web-1", InstanceID: "i-1", State: "stopped"}}
+	instances.Print(io)
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %q, want a header and a row", stdout.String())
+	}
+	header, row := strings.Split(lines[0], "\t"), strings.Split(lines[1], "\t")
+	if header[2] != "State" || row[2] != "stopped" {
+		t.Errorf("got header %q and row %q, want the state after the instance ID", header, row)
+	}
+}
@@ -0,0 +1,41 @@
+package cmdutil
+
+import (
+	"strings"
+
+	"github.com/adamkobi/xt/internal/cache"
+	"github.com/spf13/cobra"
+)
+
+//CompleteInstances returns a completion func for the servers argument at position argIdx.
+//Only cached discovery results are used so completion never queries the providers.
+func CompleteInstances(f *Factory, argIdx int) func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+	return func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		if len(args) != argIdx {
+			return nil, cobra.ShellCompDirectiveDefault
+		}
+
+		cfg, err := f.Config()
+		if err != nil {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		profileID, _ := cmd.Flags().GetString("profile")
+		tag, _ := cmd.Flags().GetString("tag")
+		profile, err := cfg.Profile(profileID)
+		if err != nil {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		ttl, err := profile.CacheDuration()
+		if err != nil {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+
+		var names []string
+		for _, name := range cache.New(ttl).Names(profileID, tag) {
+			if strings.HasPrefix(name, toComplete) {
+				names = append(names, name)
+			}
+		}
+		return names, cobra.ShellCompDirectiveNoFileComp
+	}
+}
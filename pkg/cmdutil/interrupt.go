@@ -0,0 +1,39 @@
+package cmdutil
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+//NotifyInterrupt returns a copy of ctx cancelled on the first interrupt, the second interrupt exits.
+//Interrupts are only caught until stop is called, so commands not watching ctx still exit on the first one.
+func NotifyInterrupt(ctx context.Context, errOut io.Writer) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	interrupts := make(chan os.Signal, 2)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-interrupts:
+		case <-done:
+			return
+		}
+		fmt.Fprintln(errOut, "interrupt received, stopping remote commands, interrupt again to exit")
+		cancel()
+		select {
+		case <-interrupts:
+			fmt.Fprintln(errOut, "interrupt received, exiting")
+			os.Exit(1)
+		case <-done:
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(interrupts)
+		close(done)
+		cancel()
+	}
+}
@@ -0,0 +1,24 @@
+package cmdutil
+
+import (
+	"bytes"
+	"context"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestNotifyInterrupt(t *testing.T) {
+	var errOut bytes.Buffer
+	ctx, stop := NotifyInterrupt(context.Background(), &errOut)
+	defer stop()
+
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGINT); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("context was not cancelled by the interrupt")
+	}
+}
@@ -0,0 +1,26 @@
+package cache
+
+import (
+	"github.com/MakeNowJust/heredoc"
+	"github.com/adamkobi/xt/pkg/cmdutil"
+	clearCmd "github.com/adamkobi/xt/pkg/command/cache/clear"
+	"github.com/spf13/cobra"
+)
+
+func NewCmdCache(f *cmdutil.Factory) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "cache <command>",
+		Short: "Manage the local instance cache",
+		Long: heredoc.Doc(`
+			Discovered instances are cached locally when cache-ttl is set in the profile.
+
+			Use --refresh on any command to bypass the cache.
+		`),
+		Example: heredoc.Doc(`
+			$ xt cache clear
+		`),
+	}
+
+	cmd.AddCommand(clearCmd.NewCmdClear(f))
+	return cmd
+}
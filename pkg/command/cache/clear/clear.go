@@ -0,0 +1,41 @@
+package clear
+
+import (
+	"fmt"
+
+	"github.com/adamkobi/xt/internal/cache"
+	"github.com/adamkobi/xt/pkg/cmdutil"
+	"github.com/adamkobi/xt/pkg/iostreams"
+	"github.com/spf13/cobra"
+)
+
+type Options struct {
+	IO *iostreams.IOStreams
+}
+
+func NewCmdClear(f *cmdutil.Factory) *cobra.Command {
+	opts := &Options{
+		IO: f.IOStreams,
+	}
+
+	cmd := &cobra.Command{
+		Use:   "clear",
+		Short: "Clear cached instances",
+		Long:  "Remove all cached instances of all profiles",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runClear(opts)
+		},
+	}
+
+	return cmd
+}
+
+func runClear(opts *Options) error {
+	cs := opts.IO.ColorScheme()
+	if err := cache.New(0).Clear(); err != nil {
+		return err
+	}
+	fmt.Fprintf(opts.IO.Out, "%s cache cleared successfully\n", cs.SuccessIcon())
+	return nil
+}
@@ -0,0 +1,60 @@
+package completion
+
+import (
+	"fmt"
+
+	"github.com/MakeNowJust/heredoc"
+	"github.com/adamkobi/xt/pkg/cmdutil"
+	"github.com/adamkobi/xt/pkg/iostreams"
+	"github.com/spf13/cobra"
+)
+
+type Options struct {
+	IO *iostreams.IOStreams
+
+	Shell string
+}
+
+//NewCmdCompletion creates a completion command
+func NewCmdCompletion(f *cmdutil.Factory) *cobra.Command {
+	opts := &Options{
+		IO: f.IOStreams,
+	}
+
+	cmd := &cobra.Command{
+		Use:   "completion",
+		Short: "Generate shell completion scripts",
+		Long: heredoc.Doc(`
+			Generate shell completion scripts for xt commands.
+
+			Server names are completed from the local instance cache, see xt cache.
+		`),
+		Example: heredoc.Doc(`
+			$ xt completion -s bash > /etc/bash_completion.d/xt
+			$ xt completion -s zsh > "${fpath[1]}/_xt"
+		`),
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runCompletion(cmd.Root(), opts)
+		},
+	}
+
+	cmd.Flags().StringVarP(&opts.Shell, "shell", "s", "bash", "Shell type: bash|zsh|fish|powershell")
+	return cmd
+}
+
+func runCompletion(root *cobra.Command, opts *Options) error {
+	out := opts.IO.Out
+	switch opts.Shell {
+	case "bash":
+		return root.GenBashCompletion(out)
+	case "zsh":
+		return root.GenZshCompletion(out)
+	case "fish":
+		return root.GenFishCompletion(out, true)
+	case "powershell":
+		return root.GenPowerShellCompletion(out)
+	default:
+		return &cmdutil.FlagError{Err: fmt.Errorf("unsupported shell type %q", opts.Shell)}
+	}
+}
@@ -2,26 +2,20 @@ package connect
 
 import (
 	"fmt"
-	"strings"
 
 	"github.com/MakeNowJust/heredoc"
 	"github.com/adamkobi/xt/internal/config"
-	"github.com/adamkobi/xt/internal/instance"
 	"github.com/adamkobi/xt/pkg/cmdutil"
 	"github.com/adamkobi/xt/pkg/executer"
+	"github.com/adamkobi/xt/pkg/inventory"
 	"github.com/adamkobi/xt/pkg/iostreams"
-	"github.com/adamkobi/xt/pkg/provider"
-	"github.com/adamkobi/xt/pkg/utils"
 	"github.com/spf13/cobra"
 )
 
 type Options struct {
-	Config func() (*config.Config, error)
-	IO     *iostreams.IOStreams
-
-	SearchPattern string
-	Profile       string
-	Tag           string
+	Config    func() (*config.Config, error)
+	IO        *iostreams.IOStreams
+	Inventory inventory.Options
 }
 
 //NewCmdConnect creates a connect command
@@ -47,12 +41,22 @@ func NewCmdConnect(f *cmdutil.Factory) *cobra.Command {
 
 				# query server group webserver with production profile
 				$ xt connect -p production web
+
+				# query server group webserver in a single availability zone
+				$ xt connect --filter availability-zone=us-east-1a --filter env=prod web
+
+				# query servers by expression
+				$ xt connect 'role=web AND az=us-east-1a AND NOT lifecycle=spot'
 		`),
-		Args: cobra.ExactArgs(1),
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: cmdutil.CompleteInstances(f, 0),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			opts.SearchPattern = strings.TrimSuffix(args[0], "*")
-			opts.Tag, _ = cmd.Flags().GetString("tag")
-			opts.Profile, _ = cmd.Flags().GetString("profile")
+			if err := opts.Inventory.ParseSearch(args[0]); err != nil {
+				return &cmdutil.FlagError{Err: err}
+			}
+			if err := opts.Inventory.ParseFlags(cmd.Flags()); err != nil {
+				return &cmdutil.FlagError{Err: err}
+			}
 
 			return runConnect(opts)
 		},
@@ -62,57 +66,38 @@ func NewCmdConnect(f *cmdutil.Factory) *cobra.Command {
 }
 
 func runConnect(opts *Options) error {
-	cfg, _ := opts.Config()
 	cs := opts.IO.ColorScheme()
-	profile, err := cfg.Profile(opts.Profile)
+
+	profile, instances, err := inventory.New(opts.IO, opts.Config).Discover(&opts.Inventory)
 	if err != nil {
 		return err
 	}
 
-	if profile.DisplayMsg != "" {
-		fmt.Fprintf(opts.IO.Out, cs.Red("%s"), profile.Message())
-	}
-
-	var instances instance.XTInstances
-	for _, p := range profile.ProviderOptions {
-		opts := &provider.Options{
-			Name:          p.Name,
-			VPC:           p.VPC,
-			Region:        p.Region,
-			CredsProfile:  p.CredsProfile,
-			Tag:           opts.Tag,
-			SearchPattern: opts.SearchPattern,
-		}
-		svc, err := provider.New(opts)
-		if err != nil {
-			return err
-		}
-
-		i, err := svc.Get()
-		if err != nil {
-			return err
-		}
-		instances = append(instances, i...)
-	}
-
 	cmdOpts := &executer.Options{
-		IO:     opts.IO,
-		User:   profile.SSHOptions.User,
-		Domain: profile.SSHOptions.Domain,
-		Binary: executer.SSH,
-		Args:   profile.SSHArgs(),
+		IO:              opts.IO,
+		User:            profile.SSHOptions.User,
+		Domain:          profile.SSHOptions.Domain,
+		Address:         profile.SSHOptions.AddressPolicy(),
+		Jump:            profile.SSHOptions.Jump,
+		Transport:       profile.SSHOptions.ConnectTransport(opts.Inventory.Transport),
+		InstanceConnect: profile.SSHOptions.InstanceConnect,
+		Backend:         profile.SSHOptions.Backend,
+		ConnectTimeout:  profile.SSHOptions.ConnectDuration(),
+		Binary:          executer.SSH,
+		Args:            profile.SSHArgs(),
 	}
 
-	cmdOpts.Selected, err = utils.Select(opts.IO, instances.Names(), opts.SearchPattern)
+	selected, err := instances.Select(opts.IO, opts.Inventory.SearchPattern)
 	if err != nil {
 		return err
 	}
+	cmdOpts.Selected = selected
 
 	e, err := executer.New(cmdOpts)
 	if err != nil {
 		return err
 	}
 
-	fmt.Fprintf(opts.IO.Out, "connecting to %s\n", cs.Bold(cmdOpts.Selected))
+	fmt.Fprintf(opts.IO.Out, "connecting to %s\n", cs.Bold(cmdOpts.Selected.Name()))
 	return e.Connect()
 }
@@ -1,33 +1,29 @@
 package get
 
 import (
-	"fmt"
-	"strings"
+	"context"
 
 	"github.com/MakeNowJust/heredoc"
 	"github.com/adamkobi/xt/internal/config"
-	"github.com/adamkobi/xt/internal/instance"
 	"github.com/adamkobi/xt/pkg/cmdutil"
 	"github.com/adamkobi/xt/pkg/executer"
+	"github.com/adamkobi/xt/pkg/inventory"
 	"github.com/adamkobi/xt/pkg/iostreams"
-	"github.com/adamkobi/xt/pkg/provider"
-	"github.com/adamkobi/xt/pkg/utils"
 	"github.com/spf13/cobra"
 )
 
 type Options struct {
-	Config func() (*config.Config, error)
-	IO     *iostreams.IOStreams
+	Config    func() (*config.Config, error)
+	IO        *iostreams.IOStreams
+	Inventory inventory.Options
 
-	SearchPattern string
-	LocalPath     string
-	RemotePath    string
+	LocalPath  string
+	RemotePath string
 
-	Profile  string
-	Tag      string
 	Dest     string
 	All      bool
 	Download bool
+	Run      executer.RunOptions
 }
 
 //NewCmdDownload creates a new download command
@@ -51,87 +47,79 @@ func NewCmdDownload(f *cmdutil.Factory) *cobra.Command {
 			# download file from multiple servers
 			$ xt file get -a /tmp/remotefile.json .  web
 		`),
-		Args: cobra.ExactArgs(3),
+		Args:              cobra.ExactArgs(3),
+		ValidArgsFunction: cmdutil.CompleteInstances(f, 2),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			opts.RemotePath = args[0]
 			opts.LocalPath = args[1]
-			opts.SearchPattern = strings.TrimSuffix(args[2], "*")
-			opts.Tag, _ = cmd.Flags().GetString("tag")
-			opts.Profile, _ = cmd.Flags().GetString("profile")
-
-			return runDownload(opts)
+			if err := opts.Inventory.ParseSearch(args[2]); err != nil {
+				return &cmdutil.FlagError{Err: err}
+			}
+			if err := opts.Inventory.ParseFlags(cmd.Flags()); err != nil {
+				return &cmdutil.FlagError{Err: err}
+			}
+			if err := opts.Run.Validate(); err != nil {
+				return &cmdutil.FlagError{Err: err}
+			}
+
+			return runDownload(cmd.Context(), opts)
 		},
 	}
 
 	cmd.Flags().BoolVarP(&opts.All, "all", "a", false, "Download files from all servers matching search pattern")
 	cmd.Flags().StringVarP(&opts.Dest, "dest", "d", "xt-downloads", "Output destination for get command")
+	opts.Run.AddFlags(cmd.Flags())
 	return cmd
 }
 
-func runDownload(opts *Options) error {
-	cfg, _ := opts.Config()
-	cs := opts.IO.ColorScheme()
-	profile, err := cfg.Profile(opts.Profile)
+func runDownload(ctx context.Context, opts *Options) error {
+	profile, instances, err := inventory.New(opts.IO, opts.Config).Discover(&opts.Inventory)
 	if err != nil {
 		return err
 	}
 
-	if profile.DisplayMsg != "" {
-		fmt.Fprintf(opts.IO.Out, cs.Red("%s"), profile.Message())
-	}
-
-	var instances instance.XTInstances
-	for _, p := range profile.ProviderOptions {
-		opts := &provider.Options{
-			Name:          p.Name,
-			VPC:           p.VPC,
-			Region:        p.Region,
-			CredsProfile:  p.CredsProfile,
-			Tag:           opts.Tag,
-			SearchPattern: opts.SearchPattern,
-		}
-		svc, err := provider.New(opts)
-		if err != nil {
-			return err
-		}
-
-		i, err := svc.Get()
-		if err != nil {
-			return err
-		}
-		instances = append(instances, i...)
-	}
-
 	cmdOpts := &executer.Options{
-		IO:         opts.IO,
-		User:       profile.SSHOptions.User,
-		Domain:     profile.SSHOptions.Domain,
-		Binary:     executer.SCP,
-		Args:       profile.SCPArgs(),
-		Hostnames:  instances.Names(),
-		LocalPath:  opts.LocalPath,
-		RemotePath: opts.RemotePath,
-		Download:   true,
+		IO:              opts.IO,
+		User:            profile.SSHOptions.User,
+		Domain:          profile.SSHOptions.Domain,
+		Address:         profile.SSHOptions.AddressPolicy(),
+		Jump:            profile.SSHOptions.Jump,
+		Transport:       profile.SSHOptions.ConnectTransport(opts.Inventory.Transport),
+		InstanceConnect: profile.SSHOptions.InstanceConnect,
+		Backend:         profile.SSHOptions.Backend,
+		ConnectTimeout:  profile.SSHOptions.ConnectDuration(),
+		Binary:          executer.SCP,
+		Args:            profile.SCPArgs(),
+		LocalPath:       opts.LocalPath,
+		RemotePath:      opts.RemotePath,
+		Download:        true,
 	}
 
 	if !opts.All {
-		cmdOpts.Selected, err = utils.Select(opts.IO, instances.Names(), opts.SearchPattern)
+		selected, err := instances.Select(opts.IO, opts.Inventory.SearchPattern)
 		if err != nil {
 			return err
 		}
+		cmdOpts.Selected = selected
 
 		c, err := executer.New(cmdOpts)
 		if err != nil {
 			return err
 		}
 
-		return c.Connect()
+		hostCtx, cancel := opts.Run.HostContext(ctx)
+		defer cancel()
+		return c.ConnectContext(hostCtx)
 	}
+	cmdOpts.Instances = instances
 	executers, err := executer.CreateAll(cmdOpts)
 	if err != nil {
 		return err
 	}
 
-	executer.RunCommands(opts.IO, executers)
-	return nil
+	//the first interrupt stops the commands still running on all hosts
+	ctx, stop := cmdutil.NotifyInterrupt(ctx, opts.IO.ErrOut)
+	defer stop()
+	_, err = executer.RunCommands(ctx, opts.IO, executers, opts.Run)
+	return err
 }
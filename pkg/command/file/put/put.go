@@ -1,31 +1,27 @@
 package put
 
 import (
-	"fmt"
-	"strings"
+	"context"
 
 	"github.com/MakeNowJust/heredoc"
 	"github.com/adamkobi/xt/internal/config"
-	"github.com/adamkobi/xt/internal/instance"
 	"github.com/adamkobi/xt/pkg/cmdutil"
 	"github.com/adamkobi/xt/pkg/executer"
+	"github.com/adamkobi/xt/pkg/inventory"
 	"github.com/adamkobi/xt/pkg/iostreams"
-	"github.com/adamkobi/xt/pkg/provider"
-	"github.com/adamkobi/xt/pkg/utils"
 	"github.com/spf13/cobra"
 )
 
 type Options struct {
-	Config func() (*config.Config, error)
-	IO     *iostreams.IOStreams
+	Config    func() (*config.Config, error)
+	IO        *iostreams.IOStreams
+	Inventory inventory.Options
 
-	SearchPattern string
-	LocalPath     string
-	RemotePath    string
+	LocalPath  string
+	RemotePath string
 
-	Profile string
-	Tag     string
-	All     bool
+	All bool
+	Run executer.RunOptions
 }
 
 //NewCmdUpload creates a new upload command
@@ -49,84 +45,76 @@ func NewCmdUpload(f *cmdutil.Factory) *cobra.Command {
 			# upload file to multiple servers
 			$ xt file put localfile.json /tmp/ web -a
 		`),
-		Args: cobra.ExactArgs(3),
+		Args:              cobra.ExactArgs(3),
+		ValidArgsFunction: cmdutil.CompleteInstances(f, 2),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			opts.LocalPath = args[0]
 			opts.RemotePath = args[1]
-			opts.SearchPattern = strings.TrimSuffix(args[2], "*")
-			opts.Tag, _ = cmd.Flags().GetString("tag")
-			opts.Profile, _ = cmd.Flags().GetString("profile")
-
-			return runUpload(opts)
+			if err := opts.Inventory.ParseSearch(args[2]); err != nil {
+				return &cmdutil.FlagError{Err: err}
+			}
+			if err := opts.Inventory.ParseFlags(cmd.Flags()); err != nil {
+				return &cmdutil.FlagError{Err: err}
+			}
+			if err := opts.Run.Validate(); err != nil {
+				return &cmdutil.FlagError{Err: err}
+			}
+
+			return runUpload(cmd.Context(), opts)
 		},
 	}
 
 	cmd.Flags().BoolVarP(&opts.All, "all", "a", false, "Upload files to all remote servers matching search pattern")
+	opts.Run.AddFlags(cmd.Flags())
 	return cmd
 }
 
-func runUpload(opts *Options) error {
-	cfg, _ := opts.Config()
-	profile, err := cfg.Profile(opts.Profile)
+func runUpload(ctx context.Context, opts *Options) error {
+	profile, instances, err := inventory.New(opts.IO, opts.Config).Discover(&opts.Inventory)
 	if err != nil {
 		return err
 	}
 
-	cs := opts.IO.ColorScheme()
-	if profile.DisplayMsg != "" {
-		fmt.Fprintf(opts.IO.Out, cs.Red("%s"), profile.Message())
-	}
-
-	var instances instance.XTInstances
-	for _, p := range profile.ProviderOptions {
-		opts := &provider.Options{
-			Name:          p.Name,
-			VPC:           p.VPC,
-			Region:        p.Region,
-			CredsProfile:  p.CredsProfile,
-			Tag:           opts.Tag,
-			SearchPattern: opts.SearchPattern,
-		}
-		svc, err := provider.New(opts)
-		if err != nil {
-			return err
-		}
-
-		i, err := svc.Get()
-		if err != nil {
-			return err
-		}
-		instances = append(instances, i...)
-	}
-
 	cmdOpts := &executer.Options{
-		IO:         opts.IO,
-		User:       profile.SSHOptions.User,
-		Domain:     profile.SSHOptions.Domain,
-		Binary:     executer.SCP,
-		Args:       profile.SCPArgs(),
-		Hostnames:  instances.Names(),
-		LocalPath:  opts.LocalPath,
-		RemotePath: opts.RemotePath,
+		IO:              opts.IO,
+		User:            profile.SSHOptions.User,
+		Domain:          profile.SSHOptions.Domain,
+		Address:         profile.SSHOptions.AddressPolicy(),
+		Jump:            profile.SSHOptions.Jump,
+		Transport:       profile.SSHOptions.ConnectTransport(opts.Inventory.Transport),
+		InstanceConnect: profile.SSHOptions.InstanceConnect,
+		Backend:         profile.SSHOptions.Backend,
+		ConnectTimeout:  profile.SSHOptions.ConnectDuration(),
+		Binary:          executer.SCP,
+		Args:            profile.SCPArgs(),
+		LocalPath:       opts.LocalPath,
+		RemotePath:      opts.RemotePath,
 	}
 
 	if !opts.All {
-		cmdOpts.Selected, err = utils.Select(opts.IO, instances.Names(), opts.SearchPattern)
+		selected, err := instances.Select(opts.IO, opts.Inventory.SearchPattern)
 		if err != nil {
 			return err
 		}
+		cmdOpts.Selected = selected
 
 		e, err := executer.New(cmdOpts)
 		if err != nil {
 			return err
 		}
-		return e.Connect()
+		hostCtx, cancel := opts.Run.HostContext(ctx)
+		defer cancel()
+		return e.ConnectContext(hostCtx)
 
 	}
+	cmdOpts.Instances = instances
 	executers, err := executer.CreateAll(cmdOpts)
 	if err != nil {
 		return err
 	}
-	executer.RunCommands(opts.IO, executers)
-	return nil
+	//the first interrupt stops the commands still running on all hosts
+	ctx, stop := cmdutil.NotifyInterrupt(ctx, opts.IO.ErrOut)
+	defer stop()
+	_, err = executer.RunCommands(ctx, opts.IO, executers, opts.Run)
+	return err
 }
@@ -57,6 +57,6 @@ func runDelete(opts *Options) error {
 	if err != nil {
 		return err
 	}
-	fmt.Fprintf(opts.IO.Out, "%s flow %s deleted successfully", cs.SuccessIcon())
+	fmt.Fprintf(opts.IO.Out, "%s flow %s deleted successfully\n", cs.SuccessIcon(), opts.FlowID)
 	return nil
 }
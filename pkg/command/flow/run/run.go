@@ -9,23 +9,20 @@ import (
 
 	"github.com/MakeNowJust/heredoc"
 	"github.com/adamkobi/xt/internal/config"
-	"github.com/adamkobi/xt/internal/instance"
 	"github.com/adamkobi/xt/pkg/cmdutil"
 	"github.com/adamkobi/xt/pkg/executer"
+	"github.com/adamkobi/xt/pkg/inventory"
 	"github.com/adamkobi/xt/pkg/iostreams"
-	"github.com/adamkobi/xt/pkg/provider"
 	"github.com/adamkobi/xt/pkg/utils"
 	"github.com/spf13/cobra"
 	"github.com/tidwall/gjson"
 )
 
 type Options struct {
-	Config        func() (*config.Config, error)
-	IO            *iostreams.IOStreams
-	SearchPattern string
-	Profile       string
-	Tag           string
-	FlowID        string
+	Config    func() (*config.Config, error)
+	IO        *iostreams.IOStreams
+	Inventory inventory.Options
+	FlowID    string
 }
 
 func NewCmdRun(f *cmdutil.Factory) *cobra.Command {
@@ -47,12 +44,16 @@ func NewCmdRun(f *cmdutil.Factory) *cobra.Command {
 		Example: heredoc.Doc(`
 				$ xt flow run connect-pods web
 		`),
-		Args: cobra.ExactArgs(2),
+		Args:              cobra.ExactArgs(2),
+		ValidArgsFunction: cmdutil.CompleteInstances(f, 1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			opts.FlowID = args[0]
-			opts.SearchPattern = strings.TrimSuffix(args[1], "*")
-			opts.Tag, _ = cmd.Flags().GetString("tag")
-			opts.Profile, _ = cmd.Flags().GetString("profile")
+			if err := opts.Inventory.ParseSearch(args[1]); err != nil {
+				return &cmdutil.FlagError{Err: err}
+			}
+			if err := opts.Inventory.ParseFlags(cmd.Flags()); err != nil {
+				return &cmdutil.FlagError{Err: err}
+			}
 
 			return runFlow(opts)
 		},
@@ -63,56 +64,35 @@ func NewCmdRun(f *cmdutil.Factory) *cobra.Command {
 
 func runFlow(opts *Options) error {
 	cfg, _ := opts.Config()
-	profile, err := cfg.Profile(opts.Profile)
+	flow, err := cfg.Flow(opts.FlowID)
 	if err != nil {
 		return err
 	}
 
-	flow, err := cfg.Flow(opts.FlowID)
+	profile, instances, err := inventory.New(opts.IO, opts.Config).Discover(&opts.Inventory)
 	if err != nil {
 		return err
 	}
 
-	cs := opts.IO.ColorScheme()
-
-	if profile.DisplayMsg != "" {
-		fmt.Fprintf(opts.IO.Out, cs.Red("%s"), profile.Message())
-	}
-
-	var instances instance.XTInstances
-	for _, p := range profile.ProviderOptions {
-		opts := &provider.Options{
-			Name:          p.Name,
-			VPC:           p.VPC,
-			Region:        p.Region,
-			CredsProfile:  p.CredsProfile,
-			Tag:           opts.Tag,
-			SearchPattern: opts.SearchPattern,
-		}
-		svc, err := provider.New(opts)
-		if err != nil {
-			return err
-		}
-
-		i, err := svc.Get()
-		if err != nil {
-			return err
-		}
-		instances = append(instances, i...)
-	}
-
 	cmdOpts := &executer.Options{
-		IO:     opts.IO,
-		User:   profile.SSHOptions.User,
-		Domain: profile.SSHOptions.Domain,
-		Binary: executer.SSH,
-		Args:   profile.SSHArgs(),
-	}
-
-	cmdOpts.Selected, err = utils.Select(opts.IO, instances.Names(), opts.SearchPattern)
+		IO:              opts.IO,
+		User:            profile.SSHOptions.User,
+		Domain:          profile.SSHOptions.Domain,
+		Address:         profile.SSHOptions.AddressPolicy(),
+		Jump:            profile.SSHOptions.Jump,
+		Transport:       profile.SSHOptions.ConnectTransport(opts.Inventory.Transport),
+		InstanceConnect: profile.SSHOptions.InstanceConnect,
+		Backend:         profile.SSHOptions.Backend,
+		ConnectTimeout:  profile.SSHOptions.ConnectDuration(),
+		Binary:          executer.SSH,
+		Args:            profile.SSHArgs(),
+	}
+
+	selected, err := instances.Select(opts.IO, opts.Inventory.SearchPattern)
 	if err != nil {
 		return err
 	}
+	cmdOpts.Selected = selected
 	return runCommands(cmdOpts, flow)
 }
 
@@ -122,6 +102,8 @@ func runCommands(opts *executer.Options, flow []config.FlowOptions) error {
 		runCmd        string
 		renderedTempl bytes.Buffer
 	)
+	//the steps of the flow reuse the connection of the native backend
+	defer executer.KeepConnections()()
 
 	for idx, cmd := range flow {
 
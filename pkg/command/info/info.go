@@ -1,24 +1,18 @@
 package infocmd
 
 import (
-	"fmt"
-	"strings"
-
 	"github.com/MakeNowJust/heredoc"
 	"github.com/adamkobi/xt/internal/config"
-	"github.com/adamkobi/xt/internal/instance"
 	"github.com/adamkobi/xt/pkg/cmdutil"
+	"github.com/adamkobi/xt/pkg/inventory"
 	"github.com/adamkobi/xt/pkg/iostreams"
-	"github.com/adamkobi/xt/pkg/provider"
 	"github.com/spf13/cobra"
 )
 
 type Options struct {
-	Config        func() (*config.Config, error)
-	IO            *iostreams.IOStreams
-	SearchPattern string
-	Profile       string
-	Tag           string
+	Config    func() (*config.Config, error)
+	IO        *iostreams.IOStreams
+	Inventory inventory.Options
 }
 
 //NewCmdInfo creates an info command
@@ -35,11 +29,15 @@ func NewCmdInfo(f *cmdutil.Factory) *cobra.Command {
 				$ xt info web
 				$ xt -p production info mongo
 		`),
-		Args: cobra.ExactArgs(1),
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: cmdutil.CompleteInstances(f, 0),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			opts.SearchPattern = strings.TrimSuffix(args[0], "*")
-			opts.Tag, _ = cmd.Flags().GetString("tag")
-			opts.Profile, _ = cmd.Flags().GetString("profile")
+			if err := opts.Inventory.ParseSearch(args[0]); err != nil {
+				return &cmdutil.FlagError{Err: err}
+			}
+			if err := opts.Inventory.ParseFlags(cmd.Flags()); err != nil {
+				return &cmdutil.FlagError{Err: err}
+			}
 
 			return runInfo(opts)
 		},
@@ -49,38 +47,10 @@ func NewCmdInfo(f *cmdutil.Factory) *cobra.Command {
 }
 
 func runInfo(opts *Options) error {
-	cfg, _ := opts.Config()
-	profile, err := cfg.Profile(opts.Profile)
+	_, instances, err := inventory.New(opts.IO, opts.Config).Discover(&opts.Inventory)
 	if err != nil {
 		return err
 	}
-
-	cs := opts.IO.ColorScheme()
-	if profile.DisplayMsg != "" {
-		fmt.Fprintf(opts.IO.Out, cs.Red("%s"), profile.Message())
-	}
-
-	var instances instance.XTInstances
-	for _, p := range profile.ProviderOptions {
-		opts := &provider.Options{
-			Name:          p.Name,
-			VPC:           p.VPC,
-			Region:        p.Region,
-			CredsProfile:  p.CredsProfile,
-			Tag:           opts.Tag,
-			SearchPattern: opts.SearchPattern,
-		}
-		svc, err := provider.New(opts)
-		if err != nil {
-			return err
-		}
-
-		i, err := svc.Get()
-		if err != nil {
-			return err
-		}
-		instances = append(instances, i...)
-	}
 	instances.Print(opts.IO)
 	return nil
 }
@@ -6,6 +6,8 @@ import (
 
 	"github.com/MakeNowJust/heredoc"
 	"github.com/adamkobi/xt/pkg/cmdutil"
+	cacheCmd "github.com/adamkobi/xt/pkg/command/cache"
+	completionCmd "github.com/adamkobi/xt/pkg/command/completion"
 	connectCmd "github.com/adamkobi/xt/pkg/command/connect"
 	runCmd "github.com/adamkobi/xt/pkg/command/run"
 
@@ -56,6 +58,12 @@ func NewCmd(f *cmdutil.Factory, version, buildDate string) *cobra.Command {
 
 	cmd.PersistentFlags().StringP("profile", "p", cfg.DefaultProfile(), fmt.Sprint("Select profile to use (required): ", strings.Join(cfg.Profiles(), "|")))
 	cmd.PersistentFlags().StringP("tag", "t", "Name", "Search instances by this tag")
+	cmd.PersistentFlags().StringArray("filter", nil, "Filter instances by tag or EC2 filter `key=value`, can be repeated")
+	cmd.PersistentFlags().StringSlice("state", []string{"running"}, "Search instances in these states, use all to search instances in any state")
+	cmd.PersistentFlags().Bool("strict", false, "Fail when any provider of the profile fails to return instances")
+	cmd.PersistentFlags().Bool("refresh", false, "Query providers instead of using cached instances")
+	cmd.PersistentFlags().String("transport", "", "Override the profile transport: ssh|ssm|ssm-tunnel")
+	cmd.PersistentFlags().Bool("no-login", false, "Fail instead of running an interactive SSO login when credentials expired")
 
 	// Child commands
 	cmd.AddCommand(versionCmd.NewCmdVersion(f, version, buildDate))
@@ -64,6 +72,8 @@ func NewCmd(f *cmdutil.Factory, version, buildDate string) *cobra.Command {
 	cmd.AddCommand(runCmd.NewCmdRun(f))
 	cmd.AddCommand(flowCmd.NewCmdFlow(f))
 	cmd.AddCommand(fileCmd.NewCmdFile(f))
+	cmd.AddCommand(cacheCmd.NewCmdCache(f))
+	cmd.AddCommand(completionCmd.NewCmdCompletion(f))
 
 	return cmd
 }
@@ -0,0 +1,44 @@
+package root
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/adamkobi/xt/internal/config"
+	"github.com/adamkobi/xt/pkg/cmdutil"
+	"github.com/adamkobi/xt/pkg/inventory"
+	"github.com/adamkobi/xt/pkg/iostreams"
+)
+
+func TestStateFlag(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{"running by default", nil, []string{"running"}},
+		{"states list", []string{"--state", "stopped,pending"}, []string{"stopped", "pending"}},
+		{"repeated states", []string{"--state", "stopped", "--state", "running"}, []string{"stopped", "running"}},
+		{"all states", []string{"--state", "all"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			io, _, _, _ := iostreams.Test()
+			cmd := NewCmd(&cmdutil.Factory{
+				IOStreams: io,
+				Config:    func() (*config.Config, error) { return &config.Config{}, nil },
+			}, "", "")
+			flags := cmd.PersistentFlags()
+			if err := flags.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			var opts inventory.Options
+			if err := opts.ParseFlags(flags); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(opts.States, tt.want) {
+				t.Errorf("got states %q, want %q", opts.States, tt.want)
+			}
+		})
+	}
+}
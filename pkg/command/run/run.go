@@ -1,6 +1,7 @@
 package run
 
 import (
+	"context"
 	"fmt"
 	"strings"
 
@@ -10,23 +11,21 @@ import (
 	"github.com/adamkobi/xt/internal/instance"
 	"github.com/adamkobi/xt/pkg/cmdutil"
 	"github.com/adamkobi/xt/pkg/executer"
+	"github.com/adamkobi/xt/pkg/inventory"
 	"github.com/adamkobi/xt/pkg/iostreams"
-	"github.com/adamkobi/xt/pkg/provider"
-	"github.com/adamkobi/xt/pkg/utils"
 	"github.com/spf13/cobra"
 )
 
 type Options struct {
-	Config func() (*config.Config, error)
-	IO     *iostreams.IOStreams
+	Config    func() (*config.Config, error)
+	IO        *iostreams.IOStreams
+	Inventory inventory.Options
 
-	SearchPattern string
-	RemoteCmd     []string
+	RemoteCmd []string
 
-	Profile string
-	Tag     string
-	All     bool
-	Force   bool
+	All   bool
+	Force bool
+	Run   executer.RunOptions
 }
 
 //NewCmdRun creates an exec command
@@ -43,73 +42,74 @@ func NewCmdRun(f *cmdutil.Factory) *cobra.Command {
 		Example: heredoc.Doc(`
 				$ xt run web "ls -la"
 				$ xt run -af web "cat ~/.bash_profile"
+				$ xt run -af --fail-fast web "systemctl restart nginx"
+				$ xt run -af --batch-percent 25 --batch-pause 1m --max-failures 2 web "systemctl restart nginx"
+				$ xt run -af --output ndjson web "uptime" | jq -r 'select(.line) | .host + " " + .line'
 		`),
-		Args: cobra.MinimumNArgs(2),
+		Args:              cobra.MinimumNArgs(2),
+		ValidArgsFunction: cmdutil.CompleteInstances(f, 0),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			opts.SearchPattern = strings.TrimSuffix(args[0], "*")
+			if err := opts.Inventory.ParseSearch(args[0]); err != nil {
+				return &cmdutil.FlagError{Err: err}
+			}
 			opts.RemoteCmd = args[1:]
-			opts.Tag, _ = cmd.Flags().GetString("tag")
-			opts.Profile, _ = cmd.Flags().GetString("profile")
-
-			return runCmds(opts)
+			if err := opts.Inventory.ParseFlags(cmd.Flags()); err != nil {
+				return &cmdutil.FlagError{Err: err}
+			}
+			if err := opts.Run.Validate(); err != nil {
+				return &cmdutil.FlagError{Err: err}
+			}
+			if opts.Run.Output != executer.OutputText && !opts.Force {
+				return &cmdutil.FlagError{Err: fmt.Errorf("--output %s requires --force", opts.Run.Output)}
+			}
+
+			return runCmds(cmd.Context(), opts)
 		},
 	}
 
 	cmd.Flags().BoolVarP(&opts.All, "all", "a", false, "run command on all servers matching search pattern")
 	cmd.Flags().BoolVarP(&opts.Force, "force", "f", false, "run command without requesting approval")
+	opts.Run.AddFlags(cmd.Flags())
+	cmd.Flags().StringVarP(&opts.Run.Output, "output", "o", executer.OutputText, "output format: text|json|ndjson")
 	return cmd
 }
 
-func runCmds(opts *Options) error {
-	cfg, _ := opts.Config()
-	profile, err := cfg.Profile(opts.Profile)
+func runCmds(ctx context.Context, opts *Options) error {
+	profile, instances, err := inventory.New(opts.IO, opts.Config).Discover(&opts.Inventory)
 	if err != nil {
 		return err
 	}
 
-	cs := opts.IO.ColorScheme()
-	if profile.DisplayMsg != "" {
-		fmt.Fprintf(opts.IO.Out, cs.Red("%s"), profile.Message())
-	}
-
-	var instances instance.XTInstances
-	for _, p := range profile.ProviderOptions {
-		opts := &provider.Options{
-			Name:          p.Name,
-			VPC:           p.VPC,
-			Region:        p.Region,
-			CredsProfile:  p.CredsProfile,
-			Tag:           opts.Tag,
-			SearchPattern: opts.SearchPattern,
-		}
-		svc, err := provider.New(opts)
-		if err != nil {
-			return err
-		}
-
-		i, err := svc.Get()
-		if err != nil {
-			return err
-		}
-		instances = append(instances, i...)
-	}
-
 	cmdOpts := &executer.Options{
-		IO:        opts.IO,
-		User:      profile.SSHOptions.User,
-		Domain:    profile.SSHOptions.Domain,
-		Binary:    executer.SSH,
-		Args:      profile.SSHArgs(),
-		RemoteCmd: opts.RemoteCmd,
-		Hostnames: instances.Names(),
+		IO:              opts.IO,
+		User:            profile.SSHOptions.User,
+		Domain:          profile.SSHOptions.Domain,
+		Address:         profile.SSHOptions.AddressPolicy(),
+		Jump:            profile.SSHOptions.Jump,
+		Transport:       profile.SSHOptions.ConnectTransport(opts.Inventory.Transport),
+		InstanceConnect: profile.SSHOptions.InstanceConnect,
+		Backend:         profile.SSHOptions.Backend,
+		ConnectTimeout:  profile.SSHOptions.ConnectDuration(),
+		Binary:          executer.SSH,
+		Args:            profile.SSHArgs(),
+		RemoteCmd:       opts.RemoteCmd,
+	}
+	//the structured output formats report the remote stderr separately, without a remote terminal
+	//the remote command is wrapped so it is still hung up when ssh is killed
+	if opts.Run.Output != executer.OutputText {
+		cmdOpts.Args = executer.WithoutTTY(cmdOpts.Args)
+		cmdOpts.HangupOnClose = true
 	}
 
-	if !opts.All {
-		cmdOpts.Selected, err = utils.Select(opts.IO, instances.Names(), opts.SearchPattern)
+	if opts.All {
+		cmdOpts.Instances = instances
+	} else {
+		selected, err := instances.Select(opts.IO, opts.Inventory.SearchPattern)
 		if err != nil {
 			return err
 		}
-		cmdOpts.Hostnames = []string{cmdOpts.Selected}
+		cmdOpts.Selected = selected
+		cmdOpts.Instances = instance.XTInstances{*cmdOpts.Selected}
 	}
 
 	if !opts.Force {
@@ -118,7 +118,7 @@ func runCmds(opts *Options) error {
 			Message: fmt.Sprintf(
 				"Will Execute\n$ %s\nOn\n%s\n\n",
 				strings.Join(cmdOpts.RemoteCmd, " "),
-				strings.Join(cmdOpts.Hostnames, "\n")),
+				strings.Join(cmdOpts.Instances.Names(), "\n")),
 		}, &approved)
 		if err != nil {
 			return err
@@ -128,18 +128,24 @@ func runCmds(opts *Options) error {
 		}
 	}
 
-	if !opts.All {
+	//structured output formats run a single server like all servers so the output can be parsed
+	if !opts.All && opts.Run.Output == executer.OutputText {
 		e, err := executer.New(cmdOpts)
 		if err != nil {
 			return err
 		}
-		return e.Connect()
+		hostCtx, cancel := opts.Run.HostContext(ctx)
+		defer cancel()
+		return e.ConnectContext(hostCtx)
 
 	}
 	executers, err := executer.CreateAll(cmdOpts)
 	if err != nil {
 		return err
 	}
-	executer.RunCommands(opts.IO, executers)
-	return nil
+	//the first interrupt stops the commands still running on all hosts
+	ctx, stop := cmdutil.NotifyInterrupt(ctx, opts.IO.ErrOut)
+	defer stop()
+	_, err = executer.RunCommands(ctx, opts.IO, executers, opts.Run)
+	return err
 }
@@ -0,0 +1,99 @@
+package run
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/adamkobi/xt/internal/config"
+	"github.com/adamkobi/xt/pkg/executer"
+	"github.com/adamkobi/xt/pkg/iostreams"
+)
+
+//fakeSSH prints its args to stdout and a line to stderr
+const fakeSSH = `#!/bin/sh
+echo "args $*"
+echo "warning" >&2
+`
+
+func TestRunCmdsNDJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xt-run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "ssh"), []byte(fakeSSH), 0755); err != nil {
+		t.Fatal(err)
+	}
+	hosts := filepath.Join(dir, "hosts")
+	if err := ioutil.WriteFile(hosts, []byte("web-1 address=10.0.1.1\nweb-2 address=10.0.1.2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	io, _, stdout, stderr := iostreams.Test()
+	opts := &Options{
+		IO: io,
+		Config: func() (*config.Config, error) {
+			return &config.Config{ProfileOptions: map[string]config.ProfileOptions{"test": {
+				DisplayMsg:      "production",
+				ProviderOptions: []config.ProviderOptions{{Name: "static", Settings: map[string]string{"path": hosts}}},
+				SSHOptions:      config.SSHOptions{User: "admin", Address: []string{"private-ip"}},
+			}}}, nil
+		},
+		RemoteCmd: []string{"uptime"},
+		All:       true,
+		Force:     true,
+		Run:       executer.RunOptions{Output: executer.OutputNDJSON},
+	}
+	opts.Inventory.Profile = "test"
+	opts.Inventory.Tag = "Name"
+	if err := opts.Inventory.ParseSearch("web"); err != nil {
+		t.Fatal(err)
+	}
+	if err := runCmds(context.Background(), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := map[string]string{}
+	statuses := map[string]string{}
+	scanner := bufio.NewScanner(strings.NewReader(stdout.String()))
+	for scanner.Scan() {
+		var record struct {
+			Host   string `json:"host"`
+			Stream string `json:"stream"`
+			Line   string `json:"line"`
+			Status string `json:"status"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("stdout line %q is not json: %v", scanner.Text(), err)
+		}
+		if record.Stream != "" {
+			lines[record.Host+"/"+record.Stream] = record.Line
+			continue
+		}
+		statuses[record.Host] = record.Status
+	}
+
+	for _, host := range []string{"web-1", "web-2"} {
+		if statuses[host] != "ok" {
+			t.Errorf("got %s status %q, want ok", host, statuses[host])
+		}
+		args := lines[host+"/stdout"]
+		if !strings.HasPrefix(args, "args -C ") || !strings.HasSuffix(args, " uptime") {
+			t.Errorf("got %s ssh %q, want the default args without -t", host, args)
+		}
+		if got := lines[host+"/stderr"]; got != "warning" {
+			t.Errorf("got %s stderr %q, want warning", host, got)
+		}
+	}
+	if !strings.Contains(stderr.String(), "production") {
+		t.Errorf("got stderr %q, want the profile message", stderr.String())
+	}
+}
@@ -0,0 +1,75 @@
+package executer
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/adamkobi/xt/internal/config"
+	"github.com/adamkobi/xt/internal/instance"
+)
+
+//notFound is the value providers set for missing instance fields
+const notFound = "not found"
+
+//Address returns the address of inst using the first strategy of policy that yields one
+func Address(inst *instance.XTInstance, policy []string, domain string) (string, error) {
+	for _, strategy := range policy {
+		var address string
+		switch {
+		case strategy == config.AddressName:
+			if inst.InstanceName != "" {
+				address = inst.InstanceName + domain
+			}
+		case strategy == config.AddressPrivateIP:
+			address = inst.PrivateIPAddress
+		case strategy == config.AddressPublicIP:
+			address = inst.PublicIPAddress
+		case strategy == config.AddressDNS:
+			address = firstFound(inst.PrivateDNSName, inst.PublicDNSName)
+		case config.IsAddressTemplate(strategy):
+			var err error
+			address, err = renderAddress(inst, strategy)
+			if err != nil {
+				return "", err
+			}
+		default:
+			return "", fmt.Errorf("address strategy %s is not supported", strategy)
+		}
+		if found(address) {
+			return address, nil
+		}
+	}
+	return "", fmt.Errorf("no address found for instance %s using %s", inst.Name(), strings.Join(policy, ", "))
+}
+
+//renderAddress executes an address template on inst, templates referring to missing values yield no address
+func renderAddress(inst *instance.XTInstance, text string) (string, error) {
+	tmpl, err := template.New("address").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid address template %q: %w", text, err)
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, inst); err != nil {
+		return "", fmt.Errorf("rendering address template %q: %w", text, err)
+	}
+	address := strings.TrimSpace(b.String())
+	if strings.Contains(address, notFound) || strings.Contains(address, "<no value>") {
+		return "", nil
+	}
+	return address, nil
+}
+
+func found(value string) bool {
+	return value != "" && value != notFound
+}
+
+func firstFound(values ...string) string {
+	for _, v := range values {
+		if found(v) {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,54 @@
+package executer
+
+import (
+	"testing"
+
+	"github.com/adamkobi/xt/internal/instance"
+)
+
+func TestAddress(t *testing.T) {
+	inst := &instance.XTInstance{
+		InstanceName:     "web-1",
+		InstanceID:       "i-0001",
+		PrivateIPAddress: "10.0.0.1",
+		PublicIPAddress:  "not found",
+		PrivateDNSName:   "ip-10-0-0-1.ec2.internal",
+		PublicDNSName:    "not found",
+		Tags:             map[string]string{"Env": "prod"},
+	}
+	tests := []struct {
+		name    string
+		inst    *instance.XTInstance
+		policy  []string
+		want    string
+		wantErr bool
+	}{
+		{"name", inst, []string{"name"}, "web-1.example.com", false},
+		{"private ip", inst, []string{"private-ip", "name"}, "10.0.0.1", false},
+		{"falls back when public ip is missing", inst, []string{"public-ip", "private-ip"}, "10.0.0.1", false},
+		{"dns", inst, []string{"dns"}, "ip-10-0-0-1.ec2.internal", false},
+		{"template", inst, []string{"{{.InstanceName}}.{{index .Tags \"Env\"}}.internal"}, "web-1.prod.internal", false},
+		{"template with missing value falls back", inst, []string{"{{.PublicDNSName}}", "{{index .Tags \"Team\"}}", "private-ip"}, "10.0.0.1", false},
+		{"invalid template", inst, []string{"{{.InstanceName"}, "", true},
+		{"no address", inst, []string{"public-ip"}, "", true},
+		{"unnamed instance", &instance.XTInstance{InstanceID: "i-0002"}, []string{"name"}, "", true},
+		{"unsupported strategy", inst, []string{"carrier-pigeon"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Address(tt.inst, tt.policy, ".example.com")
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected error, got %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
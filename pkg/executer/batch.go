@@ -0,0 +1,132 @@
+package executer
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/adamkobi/xt/pkg/utils"
+	"github.com/spf13/pflag"
+)
+
+//RunOptions controls how RunCommands schedules the hosts and handles failed hosts
+type RunOptions struct {
+	//FailFast stops the commands still running once a host fails
+	FailFast bool
+	//IgnoreErrors reports failed hosts in the summary without returning an error
+	IgnoreErrors bool
+	//Parallel limits the number of hosts running at once, 0 runs all hosts of a batch at once
+	Parallel int
+	//BatchSize and BatchPercent split the hosts into batches run one after the other
+	BatchSize    int
+	BatchPercent int
+	//BatchPause is waited between batches
+	BatchPause time.Duration
+	//BatchConfirm asks for approval before every batch after the first
+	BatchConfirm bool
+	//MaxFailures stops starting hosts once that many hosts failed, 0 never stops
+	MaxFailures int
+	//Timeout limits the whole run and HostTimeout the command on every host, 0 never times out
+	Timeout     time.Duration
+	HostTimeout time.Duration
+	//Output is the output format, OutputText when empty
+	Output string
+
+	//confirm asks for approval of the next batch, utils.Confirm when nil
+	confirm func(message string) (bool, error)
+}
+
+//AddFlags adds the flags of the run options to a command
+func (o *RunOptions) AddFlags(flags *pflag.FlagSet) {
+	flags.BoolVar(&o.FailFast, "fail-fast", false, "stop running commands once a server fails")
+	flags.BoolVar(&o.IgnoreErrors, "ignore-errors", false, "exit successfully even when servers fail")
+	flags.IntVar(&o.Parallel, "parallel", 0, "maximum number of servers to run on at once, 0 for no limit")
+	flags.IntVar(&o.BatchSize, "batch-size", 0, "run on batches of this many servers one after the other")
+	flags.IntVar(&o.BatchPercent, "batch-percent", 0, "run on batches of this percent of the servers one after the other")
+	flags.DurationVar(&o.BatchPause, "batch-pause", 0, "time to wait between batches")
+	flags.BoolVar(&o.BatchConfirm, "batch-confirm", false, "ask for approval before every batch after the first")
+	flags.IntVar(&o.MaxFailures, "max-failures", 0, "stop starting servers once this many servers failed, 0 for no limit")
+	flags.DurationVar(&o.Timeout, "timeout", 0, "kill the commands still running after this long, 0 for no limit")
+	flags.DurationVar(&o.HostTimeout, "host-timeout", 0, "kill the command on a server running for longer than this, 0 for no limit")
+}
+
+//Validate checks the run options set by flags
+func (o *RunOptions) Validate() error {
+	switch {
+	case o.Parallel < 0:
+		return fmt.Errorf("--parallel must not be negative")
+	case o.BatchSize < 0:
+		return fmt.Errorf("--batch-size must not be negative")
+	case o.BatchPercent < 0 || o.BatchPercent > 100:
+		return fmt.Errorf("--batch-percent must be between 1 and 100")
+	case o.BatchSize > 0 && o.BatchPercent > 0:
+		return fmt.Errorf("--batch-size and --batch-percent cannot be used together")
+	case o.BatchPause < 0:
+		return fmt.Errorf("--batch-pause must not be negative")
+	case (o.BatchPause > 0 || o.BatchConfirm) && o.BatchSize == 0 && o.BatchPercent == 0:
+		return fmt.Errorf("--batch-pause and --batch-confirm require --batch-size or --batch-percent")
+	case o.MaxFailures < 0:
+		return fmt.Errorf("--max-failures must not be negative")
+	case o.Timeout < 0:
+		return fmt.Errorf("--timeout must not be negative")
+	case o.HostTimeout < 0:
+		return fmt.Errorf("--host-timeout must not be negative")
+	}
+	switch o.Output {
+	case "", OutputText:
+	case OutputJSON, OutputNDJSON:
+		if o.BatchConfirm {
+			return fmt.Errorf("--batch-confirm cannot be used with --output %s", o.Output)
+		}
+	default:
+		return fmt.Errorf("--output %s is not supported, supported formats: %s, %s, %s", o.Output, OutputText, OutputJSON, OutputNDJSON)
+	}
+	return nil
+}
+
+//HostContext returns ctx limited by the shorter of the run and host timeouts, for commands run on a single host
+func (o *RunOptions) HostContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := o.Timeout
+	if o.HostTimeout > 0 && (timeout == 0 || o.HostTimeout < timeout) {
+		timeout = o.HostTimeout
+	}
+	if timeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+//batches splits total hosts into batches of command indexes, all hosts are a single batch when batches are not set
+func (o *RunOptions) batches(total int) [][]int {
+	size := total
+	switch {
+	case o.BatchSize > 0:
+		size = o.BatchSize
+	case o.BatchPercent > 0:
+		size = (total*o.BatchPercent + 99) / 100
+	}
+	if size < 1 {
+		size = 1
+	}
+
+	var batches [][]int
+	for start := 0; start < total; start += size {
+		var batch []int
+		for idx := start; idx < start+size && idx < total; idx++ {
+			batch = append(batch, idx)
+		}
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+//confirmBatch asks whether to run the next batch
+func (o *RunOptions) confirmBatch(batch, total int) (bool, error) {
+	confirm := o.confirm
+	if confirm == nil {
+		confirm = func(message string) (bool, error) {
+			return utils.Confirm(message, true)
+		}
+	}
+	return confirm(fmt.Sprintf("Continue with batch %d of %d?", batch, total))
+}
@@ -1,8 +1,8 @@
 package executer
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -11,7 +11,10 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/adamkobi/xt/internal/config"
+	"github.com/adamkobi/xt/internal/instance"
 	"github.com/adamkobi/xt/pkg/iostreams"
 	"github.com/cli/safeexec"
 	"github.com/creack/pty"
@@ -27,30 +30,69 @@ const SCP = "scp"
 type Cmd struct {
 	Hostname string
 	Exec     *exec.Cmd
+	//remote runs the command in process instead of Exec when set
+	remote remoteCmd
+	//prepare runs right before the command starts when set, such as pushing keys accepted for a short time
+	prepare func() error
+}
+
+//remoteCmd runs a command in process instead of executing a binary
+type remoteCmd interface {
+	//run runs the command until ctx is done, stdin is only set for interactive commands
+	run(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer) error
+	args() []string
 }
 
 //Options describes all parameters Cmd can receive
 type Options struct {
-	IO         *iostreams.IOStreams
-	Selected   string
-	Hostnames  []string
-	User       string
-	Domain     string
-	Binary     string
-	Args       []string
-	RemoteCmd  []string
-	LocalPath  string
-	RemotePath string
-	Download   bool
+	IO *iostreams.IOStreams
+	//Selected is the instance a single command connects to
+	Selected *instance.XTInstance
+	//Instances are the instances CreateAll creates commands for
+	Instances instance.XTInstances
+	User      string
+	Domain    string
+	//Address lists the strategies tried in order to find the address of an instance
+	Address []string
+	//Jump lists the jump hosts connections go through
+	Jump []config.JumpOptions
+	//Transport selects how connections reach the instance, ssh by default
+	Transport string
+	//InstanceConnect pushes a key with EC2 Instance Connect before connecting when set
+	InstanceConnect *config.InstanceConnectOptions
+	//Backend selects the ssh implementation, the ssh and scp binaries by default
+	Backend string
+	//ConnectTimeout limits how long connecting may take when set
+	ConnectTimeout time.Duration
+	Binary         string
+	Args           []string
+	RemoteCmd      []string
+	//HangupOnClose hangs up the remote command of the ssh binary once the connection closes,
+	//commands run without a remote terminal otherwise keep running when ssh is killed
+	HangupOnClose bool
+	LocalPath     string
+	RemotePath    string
+	Download      bool
 }
 
 //New creates a new executer for the required binary
 func New(options *Options) (*Cmd, error) {
 	switch options.Binary {
 	case SSH:
+		if options.Transport == config.TransportSSM {
+			return newSSM(options)
+		}
+		if options.Backend == config.BackendNative {
+			return newNative(options)
+		}
 		return newSSH(options)
 	case SCP:
+		if options.Backend == config.BackendNative {
+			return newNative(options)
+		}
 		return newSCP(options)
+	case SSM:
+		return newSSM(options)
 	default:
 		return nil, fmt.Errorf("binary %s not suppoerted", options.Binary)
 	}
@@ -67,16 +109,27 @@ func newSSH(options *Options) (*Cmd, error) {
 		return nil, err
 	}
 
-	connStr := fmt.Sprintf("%s@%s%s", options.User, options.Selected, options.Domain)
-	options.Args = append(options.Args, connStr)
+	address, args, prepare, err := connectArgs(options)
+	if err != nil {
+		return nil, err
+	}
+	connStr := fmt.Sprintf("%s@%s", options.User, address)
+	args = append(args, connStr)
 
-	if options.RemoteCmd != nil {
-		options.Args = append(options.Args, options.RemoteCmd...)
+	if options.RemoteCmd != nil && options.HangupOnClose {
+		args = append(args, hangupOnClose(options.RemoteCmd)...)
+	} else if options.RemoteCmd != nil {
+		args = append(args, options.RemoteCmd...)
 	}
 
+	cmd := exec.Command(sshExe, args...)
+	if cmd.Env, err = proxyEnv(options); err != nil {
+		return nil, err
+	}
 	return &Cmd{
-		Exec:     exec.Command(sshExe, options.Args...),
-		Hostname: options.Selected,
+		Exec:     cmd,
+		Hostname: options.Selected.Name(),
+		prepare:  prepare,
 	}, nil
 }
 
@@ -91,38 +144,111 @@ func newSCP(options *Options) (*Cmd, error) {
 		return nil, err
 	}
 
-	connStr := fmt.Sprintf("%s@%s%s:%s", options.User, options.Selected, options.Domain, options.RemotePath)
+	address, args, prepare, err := connectArgs(options)
+	if err != nil {
+		return nil, err
+	}
+	connStr := fmt.Sprintf("%s@%s:%s", options.User, address, options.RemotePath)
 	if options.Download {
-		options.Args = append(options.Args, connStr, options.LocalPath)
+		args = append(args, connStr, options.LocalPath)
 	} else {
-		options.Args = append(options.Args, options.LocalPath, connStr)
+		args = append(args, options.LocalPath, connStr)
 	}
 
+	cmd := exec.Command(scpExe, args...)
+	if cmd.Env, err = proxyEnv(options); err != nil {
+		return nil, err
+	}
 	return &Cmd{
-		Exec:     exec.Command(scpExe, options.Args...),
-		Hostname: options.Selected,
+		Exec:     cmd,
+		Hostname: options.Selected.Name(),
+		prepare:  prepare,
 	}, nil
 }
 
+//proxyEnv returns the environment of ssh and scp, the SSM ProxyCommand reads the credentials of the instance from it
+func proxyEnv(o *Options) ([]string, error) {
+	switch o.Transport {
+	case config.TransportSSM, config.TransportSSMTunnel:
+		return awsEnv(o.Selected)
+	default:
+		return nil, nil
+	}
+}
+
+//connectArgs returns the ssh address of the selected instance, the ssh options reaching it and the func
+//preparing the connection right before it starts. Connections tunneled through SSM use the instance ID
+//as address, keys pushed with EC2 Instance Connect are passed with -i and pushed by prepare.
+func connectArgs(o *Options) (address string, args []string, prepare func() error, err error) {
+	args = append(append([]string{}, o.Args...), connectTimeoutArgs(o.ConnectTimeout)...)
+	if o.InstanceConnect != nil {
+		var key string
+		key, prepare, err = instanceConnect(o.InstanceConnect, o.Selected, o.User)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		args = append(args, "-i", key)
+	}
+	switch o.Transport {
+	case config.TransportSSM, config.TransportSSMTunnel:
+		if len(o.Jump) > 0 {
+			return "", nil, nil, fmt.Errorf("jump hosts can not be used with the %s transport", o.Transport)
+		}
+		if err := requireAWS(o.Selected, "the "+o.Transport+" transport"); err != nil {
+			return "", nil, nil, err
+		}
+		awsExe, err := lookPathAWS()
+		if err != nil {
+			return "", nil, nil, err
+		}
+		args = append(args, "-o", "ProxyCommand="+ssmProxyCommand(awsExe, o.Selected))
+		return o.Selected.InstanceID, args, prepare, nil
+	default:
+		address, err := Address(o.Selected, o.Address, o.Domain)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		return address, append(args, jumpArgs(o.Jump, o.User)...), prepare, nil
+	}
+}
+
+//connectTimeoutArgs returns the ssh option setting the connect timeout in whole seconds, options set in the profile args take precedence
+func connectTimeoutArgs(timeout time.Duration) []string {
+	if timeout <= 0 {
+		return nil
+	}
+	seconds := int((timeout + time.Second - 1) / time.Second)
+	return []string{"-o", fmt.Sprintf("ConnectTimeout=%d", seconds)}
+}
+
 func validate(o *Options) error {
-	if o.Selected == "" {
-		return fmt.Errorf("hostname must be set")
+	if o.Selected == nil {
+		return fmt.Errorf("instance must be selected")
 	}
 
 	if o.User == "" {
 		return fmt.Errorf("user must be set")
 	}
 
-	if o.Domain == "" {
-		return fmt.Errorf("domain must be set")
-	}
 	return nil
 }
 
 //Output will run a single command and return stdout or stderr
 func (c Cmd) Output() ([]byte, error) {
 	if os.Getenv("DEBUG") != "" {
-		_ = printArgs(os.Stderr, c.Exec.Args)
+		_ = printArgs(os.Stderr, c.args())
+	}
+	if err := c.beforeStart(); err != nil {
+		return nil, err
+	}
+	if c.remote != nil {
+		var out bytes.Buffer
+		errStream := &bytes.Buffer{}
+		err := c.remote.run(context.Background(), nil, &out, errStream)
+		if err != nil {
+			err = &CmdError{errStream, c.Hostname, c.args(), err}
+		}
+		return out.Bytes(), err
 	}
 	if c.Exec.Stderr != nil {
 		return c.Exec.Output()
@@ -136,62 +262,274 @@ func (c Cmd) Output() ([]byte, error) {
 	return out, err
 }
 
-//Start is a wrapper around pty.Start()
-func (c *Cmd) Start() (*os.File, error) {
-	return pty.Start(c.Exec)
-}
-
 //Connect will run command and request for TTY
 func (c *Cmd) Connect() error {
+	return c.ConnectContext(context.Background())
+}
+
+//ConnectContext runs the command like Connect, the command is killed once ctx is done
+func (c *Cmd) ConnectContext(ctx context.Context) error {
 	if os.Getenv("DEBUG") != "" {
-		_ = printArgs(os.Stderr, c.Exec.Args)
+		_ = printArgs(os.Stderr, c.args())
+	}
+	if err := c.beforeStart(); err != nil {
+		return err
+	}
+	if c.remote != nil {
+		defer KeepConnections()()
+		return c.contextError(ctx, c.remote.run(ctx, os.Stdin, os.Stdout, os.Stderr))
 	}
 	c.Exec.Stdout = os.Stdout
 	c.Exec.Stderr = os.Stderr
 	c.Exec.Stdin = os.Stdin
-	return c.Exec.Run()
-}
-
-func printOutput(io *iostreams.IOStreams, f *os.File, wg *sync.WaitGroup, c *Cmd) {
-	out := io.Out
-	cs := io.ColorScheme()
-	defer wg.Done()
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		line := scanner.Text()
-		fmt.Fprintf(out, "%s | %s\n", cs.Green(c.Hostname), line)
-	}
-	fmt.Println()
-}
-
-//RunCommands takes Cmd slice and executes all commands using go routines then prints output accordingly
-func RunCommands(io *iostreams.IOStreams, executers []*Cmd) {
-	out := io.Out
-	errOut := io.ErrOut
-	cs := io.ColorScheme()
-	var wg sync.WaitGroup
-	for _, c := range executers {
-		wg.Add(1)
-		f, err := c.Start()
-		if err != nil {
-			fmt.Fprintf(errOut, "%s error starting command\n%s\n", cs.WarningIcon(), err)
-			os.Exit(1)
+	if err := c.Exec.Start(); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = c.Exec.Process.Kill()
+		case <-done:
+		}
+	}()
+	return c.contextError(ctx, c.Exec.Wait())
+}
+
+//beforeStart prepares the command right before it starts
+func (c *Cmd) beforeStart() error {
+	if c.prepare == nil {
+		return nil
+	}
+	return c.prepare()
+}
+
+//contextError describes the error of a command killed because ctx is done
+func (c *Cmd) contextError(ctx context.Context, err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case ctx.Err() == context.DeadlineExceeded:
+		return fmt.Errorf("command %s on %s", errTimedOut, c.Hostname)
+	case ctx.Err() != nil:
+		return fmt.Errorf("command %s on %s", errCancelled, c.Hostname)
+	default:
+		return err
+	}
+}
+
+//RunCommands runs the commands printing their output in the output format of opts, then prints the results.
+//Commands run in batches one after the other, all commands of a batch run concurrently up to the parallel limit.
+//Commands still running are killed once ctx is done, hosts not started are reported as skipped.
+//A *RunError is returned when any host failed unless errors are ignored, or when any host was skipped.
+func RunCommands(ctx context.Context, io *iostreams.IOStreams, executers []*Cmd, opts RunOptions) (Results, error) {
+	//connections of the native backend are shared by the hosts of the run
+	defer KeepConnections()()
+	printer := newRunPrinter(io, opts.Output, len(executers))
+	results := make(Results, len(executers))
+	for idx, c := range executers {
+		results[idx] = Result{Hostname: c.Hostname, ExitCode: -1, Stderr: errSkipped.Error(), Err: errSkipped}
+	}
+
+	parent := ctx
+	if opts.Timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		parent, cancelTimeout = context.WithTimeout(parent, opts.Timeout)
+		defer cancelTimeout()
+	}
+	//cancelling ctx kills the commands running, abort stops starting commands
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	abort := make(chan struct{})
+	var abortOnce sync.Once
+	aborted := func() bool {
+		select {
+		case <-abort:
+			return true
+		case <-ctx.Done():
+			return true
+		default:
+			return false
+		}
+	}
+	var slots chan struct{}
+	if opts.Parallel > 0 {
+		slots = make(chan struct{}, opts.Parallel)
+	}
+	var mu sync.Mutex
+	failures := 0
+	var stopErr error
+
+	batches := opts.batches(len(executers))
+	for b, batch := range batches {
+		if aborted() {
+			break
+		}
+		if b > 0 {
+			if opts.BatchPause > 0 {
+				printer.status("waiting %s before the next batch", opts.BatchPause)
+				select {
+				case <-time.After(opts.BatchPause):
+				case <-ctx.Done():
+					continue
+				}
+			}
+			if opts.BatchConfirm {
+				approved, err := opts.confirmBatch(b+1, len(batches))
+				if err != nil {
+					stopErr = err
+					break
+				}
+				if !approved {
+					stopErr = errDeclined
+					break
+				}
+			}
 		}
-		fmt.Fprintf(out, "running command on %s\n", cs.Bold(c.Hostname))
-		go printOutput(io, f, &wg, c)
+		if len(batches) > 1 {
+			printer.status("batch %d of %d", b+1, len(batches))
+		}
+
+		var wg sync.WaitGroup
+		for _, idx := range batch {
+			if slots != nil {
+				select {
+				case slots <- struct{}{}:
+				case <-abort:
+				case <-ctx.Done():
+				}
+			}
+			if aborted() {
+				break
+			}
+			c := executers[idx]
+			stdout, stderr, flush := printer.host(idx, c.Hostname)
+			wg.Add(1)
+			go func(idx int, c *Cmd) {
+				defer wg.Done()
+				if slots != nil {
+					defer func() { <-slots }()
+				}
+				results[idx] = c.runHost(ctx, opts.HostTimeout, stdout, stderr)
+				flush()
+				printer.result(idx, results[idx])
+				if !results[idx].Failed() || results[idx].Err == errCancelled {
+					return
+				}
+				mu.Lock()
+				failures++
+				maxed := opts.MaxFailures > 0 && failures >= opts.MaxFailures
+				mu.Unlock()
+				if opts.FailFast {
+					cancel()
+				}
+				if maxed {
+					abortOnce.Do(func() { close(abort) })
+				}
+			}(idx, c)
+		}
+		wg.Wait()
+	}
+	if stopErr == nil {
+		stopErr = parent.Err()
+	}
+
+	if err := printer.summary(results); err != nil {
+		return results, err
+	}
+	runErr := &RunError{Total: len(results), Failed: results.Failed(), TimedOut: results.TimedOut(), Skipped: results.Skipped(), Err: stopErr}
+	if runErr.Failed > 0 && opts.IgnoreErrors {
+		runErr.Failed, runErr.TimedOut = 0, 0
 	}
-	wg.Wait()
+	if runErr.Failed > 0 || runErr.Skipped > 0 || runErr.Err != nil {
+		return results, runErr
+	}
+	return results, nil
+}
+
+//runHost runs the command writing its output to stdout and stderr,
+//the command is killed once ctx is done or after timeout when it is set
+func (c *Cmd) runHost(ctx context.Context, timeout time.Duration, stdout, stderr io.Writer) Result {
+	outTail, errTail := &tailWriter{}, &tailWriter{}
+
+	hostCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		hostCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	start := time.Now()
+	err := c.run(hostCtx, io.MultiWriter(stdout, outTail), io.MultiWriter(stderr, errTail))
+
+	res := Result{
+		Hostname: c.Hostname,
+		ExitCode: exitCode(err),
+		Duration: time.Since(start),
+		Stderr:   errTail.String(),
+		Output:   outTail.String(),
+		Err:      err,
+	}
+	if err == nil {
+		return res
+	}
+	switch {
+	case hostCtx.Err() == context.DeadlineExceeded:
+		res.ExitCode = -1
+		res.Err = errTimedOut
+		res.Stderr = fmt.Sprintf("%s after %s", errTimedOut, res.Duration.Round(time.Millisecond))
+		return res
+	case ctx.Err() != nil:
+		res.ExitCode = -1
+		res.Err = errCancelled
+		res.Stderr = errCancelled.Error()
+		return res
+	}
+	if res.message() == "" {
+		res.Stderr = err.Error()
+	}
+	return res
+}
+
+//run runs the command under a PTY, the command is killed once ctx is done
+func (c *Cmd) run(ctx context.Context, stdout, stderr io.Writer) error {
+	if err := c.beforeStart(); err != nil {
+		return err
+	}
+	if c.remote != nil {
+		return c.remote.run(ctx, nil, stdout, stderr)
+	}
+	c.Exec.Stderr = stderr
+	f, err := pty.Start(c.Exec)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			//the PTY puts the command in its own session, it does not receive the interrupts of the terminal
+			_ = c.Exec.Process.Kill()
+		case <-done:
+		}
+	}()
+	//reading the PTY fails once the command exited
+	_, _ = io.Copy(stdout, f)
+	return c.Exec.Wait()
 }
 
-//CreateAll creates executers for all hostnames listed
+//CreateAll creates executers for all instances listed
 func CreateAll(opts *Options) ([]*Cmd, error) {
 	var executers []*Cmd
 	var err error
-	for _, host := range opts.Hostnames {
+	for idx := range opts.Instances {
 		hostOpts := *opts
-		hostOpts.Selected = host
+		hostOpts.Selected = &opts.Instances[idx]
 		if hostOpts.Download && hostOpts.LocalPath != "" {
-			hostOpts.LocalPath, err = prepareDownloads(hostOpts.LocalPath, host)
+			hostOpts.LocalPath, err = prepareDownloads(hostOpts.LocalPath, downloadDir(hostOpts.Selected))
 			if err != nil {
 				return nil, err
 			}
@@ -205,6 +543,14 @@ func CreateAll(opts *Options) ([]*Cmd, error) {
 	return executers, nil
 }
 
+//downloadDir returns the directory of the files downloaded from an instance, instances may share a name but not an ID
+func downloadDir(inst *instance.XTInstance) string {
+	if inst.InstanceID != "" {
+		return inst.InstanceID
+	}
+	return inst.Name()
+}
+
 func prepareDownloads(localPath, host string) (string, error) {
 	fi, err := os.Stat(localPath)
 	if err != nil {
@@ -238,6 +584,17 @@ func (e CmdError) Error() string {
 	return fmt.Sprintf("%s%s: %s", msg, e.Args[0], e.Err)
 }
 
+func (e CmdError) Unwrap() error {
+	return e.Err
+}
+
+func (c *Cmd) args() []string {
+	if c.remote != nil {
+		return c.remote.args()
+	}
+	return c.Exec.Args
+}
+
 func printArgs(w io.Writer, args []string) error {
 	if len(args) > 0 {
 		// print commands, but omit the full path to an executable
@@ -0,0 +1,117 @@
+package executer
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/adamkobi/xt/internal/config"
+	"github.com/adamkobi/xt/internal/instance"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2instanceconnect"
+	"github.com/aws/aws-sdk-go/service/ec2instanceconnect/ec2instanceconnectiface"
+	"github.com/mitchellh/go-homedir"
+	"golang.org/x/crypto/ssh"
+)
+
+//instanceConnectKeyBits is the size of generated keys, EC2 Instance Connect accepts RSA keys of 2048 bits and more
+const instanceConnectKeyBits = 2048
+
+//newInstanceConnectClient creates the EC2 Instance Connect client of an instance, it is replaced in tests
+var newInstanceConnectClient = func(inst *instance.XTInstance) (ec2instanceconnectiface.EC2InstanceConnectAPI, error) {
+	sess, err := instanceSession(inst)
+	if err != nil {
+		return nil, err
+	}
+	return ec2instanceconnect.New(sess), nil
+}
+
+//instanceConnect returns the private key path of opts, generating the key when missing, and push, which pushes
+//its public key to inst for user. Pushed keys are accepted by the instance for 60 seconds, so push is called
+//right before the command connects rather than when it is created.
+func instanceConnect(opts *config.InstanceConnectOptions, inst *instance.XTInstance, user string) (string, func() error, error) {
+	if err := requireAWS(inst, "EC2 Instance Connect"); err != nil {
+		return "", nil, err
+	}
+	if inst.AvailabilityZone == "" || inst.AvailabilityZone == notFound {
+		return "", nil, fmt.Errorf("instance %s has no availability zone, EC2 Instance Connect requires it", inst.Name())
+	}
+
+	keyPath := opts.Key
+	if keyPath == "" {
+		keyPath = path.Join(config.DefaultDir(), "instance-connect", "id_rsa")
+	}
+	keyPath, err := homedir.Expand(keyPath)
+	if err != nil {
+		return "", nil, err
+	}
+	publicKey, err := loadOrGenerateKey(keyPath)
+	if err != nil {
+		return "", nil, err
+	}
+
+	push := func() error {
+		client, err := newInstanceConnectClient(inst)
+		if err != nil {
+			return err
+		}
+		_, err = client.SendSSHPublicKey(&ec2instanceconnect.SendSSHPublicKeyInput{
+			InstanceId:       aws.String(inst.InstanceID),
+			InstanceOSUser:   aws.String(user),
+			SSHPublicKey:     aws.String(publicKey),
+			AvailabilityZone: aws.String(inst.AvailabilityZone),
+		})
+		if err != nil {
+			return fmt.Errorf("pushing key to %s with EC2 Instance Connect: %w", inst.Name(), err)
+		}
+		return nil
+	}
+	return keyPath, push, nil
+}
+
+//loadOrGenerateKey returns the authorized_keys line of the private key at keyPath, generating the key when missing
+func loadOrGenerateKey(keyPath string) (string, error) {
+	data, err := ioutil.ReadFile(keyPath)
+	if os.IsNotExist(err) {
+		return generateKey(keyPath)
+	}
+	if err != nil {
+		return "", err
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return "", fmt.Errorf("reading key %s: %w", keyPath, err)
+	}
+	return string(ssh.MarshalAuthorizedKey(signer.PublicKey())), nil
+}
+
+//generateKey writes a new RSA private key to keyPath and its public key next to it
+func generateKey(keyPath string) (string, error) {
+	key, err := rsa.GenerateKey(rand.Reader, instanceConnectKeyBits)
+	if err != nil {
+		return "", err
+	}
+	publicKey, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	authorizedKey := ssh.MarshalAuthorizedKey(publicKey)
+
+	if err := os.MkdirAll(filepath.Dir(keyPath), 0700); err != nil {
+		return "", err
+	}
+	privateKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := ioutil.WriteFile(keyPath, privateKey, 0600); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(keyPath+".pub", authorizedKey, 0644); err != nil {
+		return "", err
+	}
+	return string(authorizedKey), nil
+}
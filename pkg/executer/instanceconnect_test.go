@@ -0,0 +1,197 @@
+package executer
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/adamkobi/xt/internal/config"
+	"github.com/adamkobi/xt/internal/instance"
+	"github.com/adamkobi/xt/pkg/iostreams"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2instanceconnect"
+	"github.com/aws/aws-sdk-go/service/ec2instanceconnect/ec2instanceconnectiface"
+)
+
+type fakeInstanceConnect struct {
+	ec2instanceconnectiface.EC2InstanceConnectAPI
+	pushed []*ec2instanceconnect.SendSSHPublicKeyInput
+}
+
+func (f *fakeInstanceConnect) SendSSHPublicKey(input *ec2instanceconnect.SendSSHPublicKeyInput) (*ec2instanceconnect.SendSSHPublicKeyOutput, error) {
+	f.pushed = append(f.pushed, input)
+	return &ec2instanceconnect.SendSSHPublicKeyOutput{Success: aws.Bool(true)}, nil
+}
+
+func TestInstanceConnect(t *testing.T) {
+	fake := &fakeInstanceConnect{}
+	newInstanceConnectClient = func(*instance.XTInstance) (ec2instanceconnectiface.EC2InstanceConnectAPI, error) { return fake, nil }
+
+	dir, err := ioutil.TempDir("", "xt-instance-connect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyPath := filepath.Join(dir, "keys", "id_rsa")
+	inst := &instance.XTInstance{
+		InstanceName:     "web-1",
+		InstanceID:       "i-0001",
+		PrivateIPAddress: "10.0.0.1",
+		AvailabilityZone: "us-east-1a",
+		Region:           "us-east-1",
+	}
+	opts := &Options{
+		Selected:        inst,
+		User:            "ec2-user",
+		Address:         []string{config.AddressPrivateIP},
+		Args:            []string{"-C"},
+		InstanceConnect: &config.InstanceConnectOptions{Key: keyPath},
+	}
+
+	for i := 0; i < 2; i++ {
+		address, args, prepare, err := connectArgs(opts)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if address != "10.0.0.1" {
+			t.Errorf("got address %s, want 10.0.0.1", address)
+		}
+		if want := []string{"-C", "-i", keyPath}; !reflect.DeepEqual(args, want) {
+			t.Errorf("got args %q, want %q", args, want)
+		}
+		if len(fake.pushed) != i {
+			t.Fatalf("got %d pushed keys before the command started, want %d", len(fake.pushed), i)
+		}
+		if err := prepare(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if len(fake.pushed) != 2 {
+		t.Fatalf("got %d pushed keys, want 2", len(fake.pushed))
+	}
+	publicKey, err := ioutil.ReadFile(keyPath + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range fake.pushed {
+		if aws.StringValue(p.SSHPublicKey) != string(publicKey) {
+			t.Errorf("pushed key %q was not reused from %s", aws.StringValue(p.SSHPublicKey), keyPath)
+		}
+		if aws.StringValue(p.InstanceOSUser) != "ec2-user" || aws.StringValue(p.AvailabilityZone) != "us-east-1a" ||
+			aws.StringValue(p.InstanceId) != "i-0001" {
+			t.Errorf("unexpected push %v", p)
+		}
+	}
+
+	opts.Selected = &instance.XTInstance{InstanceName: "static-1", PrivateIPAddress: "10.0.0.2"}
+	if _, _, _, err := connectArgs(opts); err == nil {
+		t.Errorf("expected error for an instance not found by the aws provider")
+	}
+}
+
+func TestInstanceConnectBatches(t *testing.T) {
+	fake := &fakeInstanceConnect{}
+	newInstanceConnectClient = func(*instance.XTInstance) (ec2instanceconnectiface.EC2InstanceConnectAPI, error) { return fake, nil }
+
+	dir, err := ioutil.TempDir("", "xt-instance-connect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var cmds []*Cmd
+	for _, name := range []string{"web-1", "web-2"} {
+		_, _, prepare, err := connectArgs(&Options{
+			Selected: &instance.XTInstance{
+				InstanceName:     name,
+				InstanceID:       "i-" + name,
+				PrivateIPAddress: "10.0.0.1",
+				AvailabilityZone: "us-east-1a",
+				Region:           "us-east-1",
+			},
+			User:            "ec2-user",
+			Address:         []string{config.AddressPrivateIP},
+			InstanceConnect: &config.InstanceConnectOptions{Key: filepath.Join(dir, "id_rsa")},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd := shellCmd(name, "true")
+		cmd.prepare = prepare
+		cmds = append(cmds, cmd)
+	}
+	if len(fake.pushed) != 0 {
+		t.Fatalf("got %d pushed keys before the run, want none", len(fake.pushed))
+	}
+
+	//the key of a host is pushed when its batch starts, not when the run starts
+	var pushedAtConfirm []string
+	confirm := func(string) (bool, error) {
+		for _, p := range fake.pushed {
+			pushedAtConfirm = append(pushedAtConfirm, aws.StringValue(p.InstanceId))
+		}
+		return true, nil
+	}
+	io, _, _, _ := iostreams.Test()
+	if _, err := RunCommands(context.Background(), io, cmds, RunOptions{BatchSize: 1, BatchConfirm: true, confirm: confirm}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := []string{"i-web-1"}; !reflect.DeepEqual(pushedAtConfirm, want) {
+		t.Errorf("got keys %q pushed before the second batch, want %q", pushedAtConfirm, want)
+	}
+	if len(fake.pushed) != 2 {
+		t.Errorf("got %d pushed keys, want 2", len(fake.pushed))
+	}
+}
+
+//defaultInstanceConnectClient is the client factory before tests replace it
+var defaultInstanceConnectClient = newInstanceConnectClient
+
+func TestInstanceConnectSession(t *testing.T) {
+	var auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		fmt.Fprint(w, `{"RequestId": "req-1", "Success": true}`)
+	}))
+	defer server.Close()
+
+	//the session of an instance found through a role chain signs with the credentials of the last role
+	sess := session.Must(session.NewSession(aws.NewConfig().
+		WithRegion("us-east-1").
+		WithEndpoint(server.URL).
+		WithCredentials(credentials.NewStaticCredentials("ASIAROLE", "SECRET", "TOKEN"))))
+	inst := &instance.XTInstance{
+		InstanceID:   "i-0123456789abcdef0",
+		Region:       "us-east-1",
+		CredsProfile: "base",
+		Session:      func() (*session.Session, error) { return sess, nil },
+	}
+
+	client, err := defaultInstanceConnectClient(inst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.SendSSHPublicKey(&ec2instanceconnect.SendSSHPublicKeyInput{
+		InstanceId:       aws.String(inst.InstanceID),
+		InstanceOSUser:   aws.String("ec2-user"),
+		SSHPublicKey:     aws.String("ssh-rsa " + strings.Repeat("A", 372)),
+		AvailabilityZone: aws.String("us-east-1a"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(auth, "Credential=ASIAROLE/") {
+		t.Errorf("got authorization %q, want it signed with the instance session", auth)
+	}
+}
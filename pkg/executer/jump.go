@@ -0,0 +1,68 @@
+package executer
+
+import (
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/adamkobi/xt/internal/config"
+)
+
+//shellSafe matches words passed to the shell running a ProxyCommand without quoting
+var shellSafe = regexp.MustCompile(`^[a-zA-Z0-9@%_+=:,./~-]+$`)
+
+//jumpArgs returns the ssh options connecting through the jump hosts in order.
+//-J is used unless a jump host has its own key, which -J can not express
+func jumpArgs(jumps []config.JumpOptions, user string) []string {
+	if len(jumps) == 0 {
+		return nil
+	}
+	for _, j := range jumps {
+		if j.Key != "" {
+			return []string{"-o", "ProxyCommand=" + proxyCommand(jumps, user)}
+		}
+	}
+	var hosts []string
+	for _, j := range jumps {
+		host := j.Host
+		if j.Port != 0 {
+			host = net.JoinHostPort(j.Host, strconv.Itoa(j.Port))
+		}
+		hosts = append(hosts, jumpUser(j, user)+"@"+host)
+	}
+	return []string{"-J", strings.Join(hosts, ",")}
+}
+
+//proxyCommand returns an ssh -W command through the last jump host, reaching it through the previous ones
+func proxyCommand(jumps []config.JumpOptions, user string) string {
+	last := jumps[len(jumps)-1]
+	args := []string{"ssh"}
+	if last.Key != "" {
+		args = append(args, "-i", shellQuote(last.Key))
+	}
+	if last.Port != 0 {
+		args = append(args, "-p", strconv.Itoa(last.Port))
+	}
+	if len(jumps) > 1 {
+		//tokens of the inner command are expanded by the ssh running it, so they are escaped from this one
+		inner := strings.ReplaceAll(proxyCommand(jumps[:len(jumps)-1], user), "%", "%%")
+		args = append(args, "-o", shellQuote("ProxyCommand="+inner))
+	}
+	args = append(args, "-W", "%h:%p", shellQuote(jumpUser(last, user)+"@"+last.Host))
+	return strings.Join(args, " ")
+}
+
+func jumpUser(j config.JumpOptions, user string) string {
+	if j.User != "" {
+		return j.User
+	}
+	return user
+}
+
+func shellQuote(s string) string {
+	if shellSafe.MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
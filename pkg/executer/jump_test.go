@@ -0,0 +1,80 @@
+package executer
+
+import (
+	"os/exec"
+	"reflect"
+	"testing"
+
+	"github.com/adamkobi/xt/internal/config"
+	"github.com/adamkobi/xt/internal/instance"
+)
+
+func TestJumpArgs(t *testing.T) {
+	tests := []struct {
+		name  string
+		jumps []config.JumpOptions
+		want  []string
+	}{
+		{"no jump hosts", nil, nil},
+		{
+			"single jump host",
+			[]config.JumpOptions{{Host: "bastion.example.com"}},
+			[]string{"-J", "ubuntu@bastion.example.com"},
+		},
+		{
+			"jump hosts with users and ports",
+			[]config.JumpOptions{{Host: "edge.example.com", User: "admin", Port: 2222}, {Host: "fd00::1", Port: 22}},
+			[]string{"-J", "admin@edge.example.com:2222,ubuntu@[fd00::1]:22"},
+		},
+		{
+			"jump host with key",
+			[]config.JumpOptions{{Host: "bastion.example.com", Key: "~/.ssh/bastion key.pem", Port: 2222}},
+			[]string{"-o", "ProxyCommand=ssh -i '~/.ssh/bastion key.pem' -p 2222 -W %h:%p ubuntu@bastion.example.com"},
+		},
+		{
+			"chained jump hosts with keys",
+			[]config.JumpOptions{{Host: "edge.example.com", Key: "/keys/edge"}, {Host: "bastion.internal", User: "ops", Key: "/keys/bastion"}},
+			[]string{"-o", "ProxyCommand=ssh -i /keys/bastion -o 'ProxyCommand=ssh -i /keys/edge -W %%h:%%p ubuntu@edge.example.com' -W %h:%p ops@bastion.internal"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := jumpArgs(tt.jumps, "ubuntu"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewSSHJump(t *testing.T) {
+	if _, err := exec.LookPath("ssh"); err != nil {
+		t.Skip("ssh is not installed")
+	}
+	args := defaultArgs()
+	opts := &Options{
+		Selected: &instance.XTInstance{InstanceName: "web-1"},
+		User:     "ubuntu",
+		Domain:   ".example.com",
+		Address:  []string{config.AddressName},
+		Jump:     []config.JumpOptions{{Host: "bastion.example.com"}},
+		Binary:   SSH,
+		Args:     args,
+	}
+	cmd, err := New(opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got := cmd.Exec.Args[1:]
+	want := append(defaultArgs(), "-J", "ubuntu@bastion.example.com", "ubuntu@web-1.example.com")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if !reflect.DeepEqual(opts.Args, defaultArgs()) {
+		t.Errorf("profile args were modified: %q", opts.Args)
+	}
+}
+
+//defaultArgs returns ControlMaster options like the profile defaults
+func defaultArgs() []string {
+	return []string{"-o", "ControlPath=~/.ssh/cm-%C", "-o", "ControlMaster=auto", "-o", "ControlPersist=5m"}
+}
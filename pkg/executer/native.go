@@ -0,0 +1,441 @@
+package executer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adamkobi/xt/internal/config"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+//nativeClients are the open connections of the native backend, reused by commands to the same host with
+//the same keys. They are keyed by the chain of hops they were dialed through, a broken connection is
+//evicted with the connections made through it and all are closed once the last KeepConnections is done.
+var nativeClients = struct {
+	sync.Mutex
+	clients map[string]*ssh.Client
+	//holds counts the callers keeping the connections open
+	holds int
+}{clients: make(map[string]*ssh.Client)}
+
+//evictNativeClients closes and forgets the connection of key and the connections made through it
+func evictNativeClients(key string) {
+	nativeClients.Lock()
+	defer nativeClients.Unlock()
+	evictNativeClientsLocked(key)
+}
+
+func evictNativeClientsLocked(key string) {
+	for k, c := range nativeClients.clients {
+		if strings.HasPrefix(k, key) {
+			c.Close()
+			delete(nativeClients.clients, k)
+		}
+	}
+}
+
+//KeepConnections keeps the connections of the native backend open until the returned func is called.
+//Calls nest, the connections and the connection to the ssh agent are closed once the outermost caller is done.
+func KeepConnections() (done func()) {
+	nativeClients.Lock()
+	nativeClients.holds++
+	nativeClients.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			nativeClients.Lock()
+			defer nativeClients.Unlock()
+			nativeClients.holds--
+			if nativeClients.holds == 0 {
+				evictNativeClientsLocked("")
+				closeAgent()
+			}
+		})
+	}
+}
+
+//connectionError is returned when an open connection could not start a session, the connection is likely broken
+type connectionError struct {
+	err error
+}
+
+func (e *connectionError) Error() string {
+	return e.err.Error()
+}
+
+func (e *connectionError) Unwrap() error {
+	return e.err
+}
+
+//nativeHop is a host dialed by the native backend
+type nativeHop struct {
+	host string
+	//port overrides the ssh_config port of host when set
+	port string
+	user string
+	keys []string
+}
+
+//nativeCommand runs a command or copies files over an in process ssh connection
+type nativeCommand struct {
+	settings  *nativeSettings
+	hops      []nativeHop
+	remoteCmd []string
+
+	binary     string
+	localPath  string
+	remotePath string
+	download   bool
+}
+
+//newNative creates an executer using the native backend
+func newNative(options *Options) (*Cmd, error) {
+	if err := validate(options); err != nil {
+		return nil, err
+	}
+	if options.Transport != "" && options.Transport != config.TransportSSH {
+		return nil, fmt.Errorf("the native backend does not support the %s transport", options.Transport)
+	}
+
+	settings, err := newNativeSettings(append(append([]string{}, options.Args...), connectTimeoutArgs(options.ConnectTimeout)...))
+	if err != nil {
+		return nil, err
+	}
+	address, err := Address(options.Selected, options.Address, options.Domain)
+	if err != nil {
+		return nil, err
+	}
+	target := nativeHop{host: address, port: settings.port, user: options.User}
+	var prepare func() error
+	if options.InstanceConnect != nil {
+		key, push, err := instanceConnect(options.InstanceConnect, options.Selected, options.User)
+		if err != nil {
+			return nil, err
+		}
+		target.keys = []string{key}
+		prepare = push
+	}
+
+	var hops []nativeHop
+	for _, j := range options.Jump {
+		hop := nativeHop{host: j.Host, user: jumpUser(j, options.User)}
+		if j.Port != 0 {
+			hop.port = strconv.Itoa(j.Port)
+		}
+		if j.Key != "" {
+			hop.keys = []string{j.Key}
+		}
+		hops = append(hops, hop)
+	}
+
+	return &Cmd{
+		Hostname: options.Selected.Name(),
+		prepare:  prepare,
+		remote: &nativeCommand{
+			settings:   settings,
+			hops:       append(hops, target),
+			remoteCmd:  options.RemoteCmd,
+			binary:     options.Binary,
+			localPath:  options.LocalPath,
+			remotePath: options.RemotePath,
+			download:   options.Download,
+		},
+	}, nil
+}
+
+//args describes the command for debug output and errors
+func (c *nativeCommand) args() []string {
+	target := c.hops[len(c.hops)-1]
+	dest := fmt.Sprintf("%s@%s", target.user, target.host)
+	if c.binary == SCP {
+		if c.download {
+			return []string{"sftp", dest + ":" + c.remotePath, c.localPath}
+		}
+		return []string{"sftp", c.localPath, dest + ":" + c.remotePath}
+	}
+	return append([]string{"ssh", dest}, c.remoteCmd...)
+}
+
+//run connects and runs the command, or copies the files.
+//Reused connections the hosts closed meanwhile are evicted and connected again once.
+func (c *nativeCommand) run(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer) error {
+	for attempt := 0; ; attempt++ {
+		client, key, err := c.dial(ctx)
+		if err == nil {
+			err = c.start(ctx, client, stdin, stdout, stderr)
+		}
+		var connErr *connectionError
+		if !errors.As(err, &connErr) {
+			return err
+		}
+		//dial evicts the broken jump hosts itself
+		if client != nil {
+			evictNativeClients(key)
+		}
+		if attempt > 0 {
+			return err
+		}
+	}
+}
+
+//start runs the command or copies the files over client
+func (c *nativeCommand) start(ctx context.Context, client *ssh.Client, stdin io.Reader, stdout, stderr io.Writer) error {
+	if c.binary == SCP {
+		return c.copy(client, stdout)
+	}
+	return c.session(ctx, client, stdin, stdout, stderr)
+}
+
+//hopKey returns the key of the connection to hop at addr, made through the connection of prefix
+func hopKey(prefix string, hop nativeHop, addr string) string {
+	return fmt.Sprintf("%s%s@%s[%s]/", prefix, hop.user, addr, strings.Join(hop.keys, ","))
+}
+
+//dial returns a connection to the target and its key, connecting through the jump hosts before it
+func (c *nativeCommand) dial(ctx context.Context) (*ssh.Client, string, error) {
+	var client *ssh.Client
+	var key string
+	for _, hop := range c.hops {
+		addr := c.settings.endpoint(hop.host, hop.port)
+		prefix := key
+		key = hopKey(prefix, hop, addr)
+		nativeClients.Lock()
+		existing, ok := nativeClients.clients[key]
+		nativeClients.Unlock()
+		if ok {
+			client = existing
+			continue
+		}
+
+		cfg, err := c.settings.clientConfig(hop.host, hop.user, hop.keys)
+		if err != nil {
+			return nil, "", err
+		}
+		next, err := dialHop(ctx, client, addr, cfg)
+		if err != nil {
+			err = fmt.Errorf("connecting to %s: %w", hop.host, err)
+			//a jump host refusing the connection is healthy, any other failure means it is broken
+			var openErr *ssh.OpenChannelError
+			if client != nil && !errors.As(err, &openErr) {
+				evictNativeClients(prefix)
+				return nil, "", &connectionError{err}
+			}
+			return nil, "", err
+		}
+		if c.settings.agentForwarding(hop.host) {
+			if err := forwardAgent(next); err != nil {
+				next.Close()
+				return nil, "", err
+			}
+		}
+
+		nativeClients.Lock()
+		//another command may have connected to the same host meanwhile
+		if existing, ok := nativeClients.clients[key]; ok {
+			next.Close()
+			next = existing
+		} else {
+			nativeClients.clients[key] = next
+		}
+		nativeClients.Unlock()
+		client = next
+	}
+	return client, key, nil
+}
+
+//dialHop connects to addr directly, or through client when connecting through a jump host.
+//The connect timeout of cfg limits both the TCP connection and the ssh handshake.
+func dialHop(ctx context.Context, client *ssh.Client, addr string, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+	var conn net.Conn
+	var err error
+	if client == nil {
+		dialer := net.Dialer{Timeout: cfg.Timeout}
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = client.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	//closing the connection aborts the handshake once ctx is done
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	if cfg.Timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(cfg.Timeout))
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, cfg)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+//forwardAgent serves agent requests of the remote host with the local agent
+func forwardAgent(client *ssh.Client) error {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return fmt.Errorf("agent forwarding requires SSH_AUTH_SOCK")
+	}
+	return agent.ForwardToRemote(client, sock)
+}
+
+//session runs the remote command, or a shell when there is none.
+//A PTY is requested when stdin is a terminal, the remote command is killed once ctx is done.
+func (c *nativeCommand) session(ctx context.Context, client *ssh.Client, stdin io.Reader, stdout, stderr io.Writer) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return &connectionError{err}
+	}
+	defer session.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			//servers ignoring signals hang up the command once the channel is closed
+			_ = session.Signal(ssh.SIGKILL)
+			session.Close()
+		case <-done:
+		}
+	}()
+
+	target := c.hops[len(c.hops)-1]
+	if c.settings.agentForwarding(target.host) {
+		if err := agent.RequestAgentForwarding(session); err != nil {
+			return err
+		}
+	}
+
+	session.Stdout = stdout
+	session.Stderr = stderr
+	if stdin != nil {
+		session.Stdin = stdin
+		if f, ok := stdin.(*os.File); ok && terminal.IsTerminal(int(f.Fd())) {
+			restore, err := requestPty(session, int(f.Fd()))
+			if err != nil {
+				return err
+			}
+			defer restore()
+		}
+	}
+
+	if len(c.remoteCmd) == 0 {
+		if err := session.Shell(); err != nil {
+			return err
+		}
+		return session.Wait()
+	}
+	return session.Run(strings.Join(c.remoteCmd, " "))
+}
+
+//requestPty requests a PTY the size of the local terminal and puts the local terminal in raw mode
+func requestPty(session *ssh.Session, fd int) (func(), error) {
+	width, height, err := terminal.GetSize(fd)
+	if err != nil {
+		width, height = 80, 24
+	}
+	term := os.Getenv("TERM")
+	if term == "" {
+		term = "xterm"
+	}
+	if err := session.RequestPty(term, height, width, ssh.TerminalModes{ssh.ECHO: 1}); err != nil {
+		return nil, err
+	}
+	state, err := terminal.MakeRaw(fd)
+	if err != nil {
+		return nil, err
+	}
+	return func() { _ = terminal.Restore(fd, state) }, nil
+}
+
+//copy uploads or downloads a file with SFTP, a directory destination receives the file under its own name
+func (c *nativeCommand) copy(client *ssh.Client, out io.Writer) error {
+	sc, err := sftp.NewClient(client)
+	if err != nil {
+		return &connectionError{fmt.Errorf("starting sftp: %w", err)}
+	}
+	defer sc.Close()
+
+	if c.download {
+		src, err := sc.Open(c.remotePath)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		info, err := src.Stat()
+		if err != nil {
+			return err
+		}
+		dest := c.localPath
+		if fi, err := os.Stat(dest); err == nil && fi.IsDir() {
+			dest = filepath.Join(dest, path.Base(c.remotePath))
+		}
+		dst, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		defer dst.Close()
+		n, err := io.Copy(dst, src)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%s %d bytes\n", dest, n)
+		return nil
+	}
+
+	src, err := os.Open(c.localPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", c.localPath)
+	}
+	dest := c.remotePath
+	if fi, err := sc.Stat(dest); err == nil && fi.IsDir() {
+		dest = path.Join(dest, filepath.Base(c.localPath))
+	}
+	dst, err := sc.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	if err := dst.Chmod(info.Mode().Perm()); err != nil {
+		return err
+	}
+	n, err := io.Copy(dst, src)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%s %d bytes\n", dest, n)
+	return nil
+}
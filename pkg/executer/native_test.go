@@ -0,0 +1,541 @@
+package executer
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adamkobi/xt/internal/config"
+	"github.com/adamkobi/xt/internal/instance"
+	"github.com/adamkobi/xt/pkg/iostreams"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+//testSSHServer is an ssh server running exec requests as "ran: <command>", the command fail exits with status 3
+//and agent-keys lists the keys of the forwarded agent. It serves SFTP on the local file system.
+type testSSHServer struct {
+	addr    string
+	hostKey ssh.Signer
+
+	mu    sync.Mutex
+	conns int
+}
+
+func newTestSSHServer(t *testing.T, authorized ssh.PublicKey) *testSSHServer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == "ec2-user" && string(key.Marshal()) == string(authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unauthorized")
+		},
+	}
+	cfg.AddHostKey(hostKey)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testSSHServer{addr: l.Addr().String(), hostKey: hostKey}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn, cfg)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return s
+}
+
+func (s *testSSHServer) serve(conn net.Conn, cfg *ssh.ServerConfig) {
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, cfg)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.conns++
+	s.mu.Unlock()
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unsupported")
+			continue
+		}
+		ch, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go s.session(sconn, ch, requests)
+	}
+}
+
+func (s *testSSHServer) session(sconn *ssh.ServerConn, ch ssh.Channel, requests <-chan *ssh.Request) {
+	defer ch.Close()
+	exit := func(status uint32) {
+		_, _ = ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+	}
+	for req := range requests {
+		switch req.Type {
+		case "auth-agent-req@openssh.com", "pty-req":
+			_ = req.Reply(true, nil)
+		case "subsystem":
+			_ = req.Reply(true, nil)
+			server, err := sftp.NewServer(ch)
+			if err != nil {
+				return
+			}
+			_ = server.Serve()
+			return
+		case "exec":
+			var payload struct{ Command string }
+			_ = ssh.Unmarshal(req.Payload, &payload)
+			_ = req.Reply(true, nil)
+			switch payload.Command {
+			case "fail":
+				fmt.Fprint(ch.Stderr(), "command failed\n")
+				exit(3)
+			case "agent-keys":
+				agentCh, reqs, err := sconn.OpenChannel("auth-agent@openssh.com", nil)
+				if err != nil {
+					fmt.Fprint(ch.Stderr(), err)
+					exit(1)
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				keys, err := agent.NewClient(agentCh).List()
+				agentCh.Close()
+				if err != nil {
+					fmt.Fprint(ch.Stderr(), err)
+					exit(1)
+					return
+				}
+				fmt.Fprintf(ch, "%d keys\n", len(keys))
+				exit(0)
+			default:
+				fmt.Fprintf(ch, "ran: %s\n", payload.Command)
+				exit(0)
+			}
+			return
+		default:
+			_ = req.Reply(false, nil)
+		}
+	}
+}
+
+func (s *testSSHServer) connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns
+}
+
+//nativeTest sets up a client key, an ssh_config pointing web-1 at the server and a known hosts file
+type nativeTest struct {
+	dir        string
+	key        string
+	knownHosts string
+	server     *testSSHServer
+}
+
+func newNativeTest(t *testing.T) *nativeTest {
+	dir, err := ioutil.TempDir("", "xt-native")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	key := filepath.Join(dir, "id_rsa")
+	authorizedKey, err := generateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newTestSSHServer(t, publicKey)
+
+	host, port, _ := net.SplitHostPort(server.addr)
+	sshConfig := filepath.Join(dir, "ssh_config")
+	write(t, sshConfig, fmt.Sprintf("Host web-1\n  HostName %s\n  Port %s\n  IdentityFile %s\n", host, port, key))
+	knownHosts := filepath.Join(dir, "known_hosts")
+	write(t, knownHosts, knownhosts.Line([]string{knownhosts.Normalize(server.addr)}, server.hostKey.PublicKey())+"\n")
+
+	files, sock := sshConfigFiles, os.Getenv("SSH_AUTH_SOCK")
+	sshConfigFiles = []string{sshConfig}
+	os.Unsetenv("SSH_AUTH_SOCK")
+	t.Cleanup(func() {
+		sshConfigFiles = files
+		os.Setenv("SSH_AUTH_SOCK", sock)
+		closeConnections()
+	})
+	return &nativeTest{dir: dir, key: key, knownHosts: knownHosts, server: server}
+}
+
+func (n *nativeTest) options(binary string, args ...string) *Options {
+	return &Options{
+		Selected: &instance.XTInstance{InstanceName: "web-1"},
+		User:     "ec2-user",
+		Address:  []string{config.AddressName},
+		Backend:  config.BackendNative,
+		Binary:   binary,
+		Args:     append([]string{"-o", "UserKnownHostsFile=" + n.knownHosts}, args...),
+	}
+}
+
+func write(t *testing.T, path, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//closeConnections closes the connections of the native backend, no caller keeps them open in tests
+func closeConnections() {
+	KeepConnections()()
+}
+
+func openNativeClients() int {
+	nativeClients.Lock()
+	defer nativeClients.Unlock()
+	return len(nativeClients.clients)
+}
+
+func TestNativeCommand(t *testing.T) {
+	n := newNativeTest(t)
+
+	for _, cmd := range []string{"uptime", "df -h"} {
+		opts := n.options(SSH)
+		opts.RemoteCmd = strings.Fields(cmd)
+		e, err := New(opts)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		out, err := e.Output()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if want := "ran: " + cmd + "\n"; string(out) != want {
+			t.Errorf("got %q, want %q", out, want)
+		}
+	}
+	if got := n.server.connections(); got != 1 {
+		t.Errorf("got %d connections, want the connection reused", got)
+	}
+
+	opts := n.options(SSH)
+	opts.RemoteCmd = []string{"fail"}
+	e, err := New(opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err = e.Output()
+	var exitErr *ssh.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitStatus() != 3 {
+		t.Fatalf("got error %v, want exit status 3", err)
+	}
+	if !strings.HasPrefix(err.Error(), "command failed\n") {
+		t.Errorf("got error %q, want stderr included", err)
+	}
+}
+
+func TestNativeConnections(t *testing.T) {
+	n := newNativeTest(t)
+	command := func(keys ...string) *Cmd {
+		opts := n.options(SSH)
+		opts.RemoteCmd = []string{"uptime"}
+		e, err := New(opts)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		e.remote.(*nativeCommand).hops[0].keys = keys
+		return e
+	}
+	output := func(e *Cmd) {
+		t.Helper()
+		if out, err := e.Output(); err != nil || string(out) != "ran: uptime\n" {
+			t.Fatalf("got %q, %v, want the command output", out, err)
+		}
+	}
+
+	output(command())
+	output(command(n.key))
+	if got := n.server.connections(); got != 2 {
+		t.Errorf("got %d connections, want a connection per key", got)
+	}
+
+	//a connection closed meanwhile is evicted and connected again
+	nativeClients.Lock()
+	for _, c := range nativeClients.clients {
+		c.Close()
+	}
+	nativeClients.Unlock()
+	output(command())
+	if got := n.server.connections(); got != 3 {
+		t.Errorf("got %d connections, want the closed connection replaced", got)
+	}
+
+	io, _, _, _ := iostreams.Test()
+	if _, err := RunCommands(context.Background(), io, []*Cmd{command()}, RunOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := openNativeClients(); got != 0 {
+		t.Errorf("got %d open connections after the run, want them closed", got)
+	}
+}
+
+func TestKeepConnections(t *testing.T) {
+	n := newNativeTest(t)
+	opts := n.options(SSH)
+	opts.RemoteCmd = []string{"uptime"}
+	e, err := New(opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	//a flow keeps the connection open for its steps, each step keeps it while it runs
+	flow := KeepConnections()
+	step := KeepConnections()
+	if _, err := e.Output(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	step()
+	step()
+	if got := openNativeClients(); got != 1 {
+		t.Errorf("got %d open connections after a step, want the connection kept for the next step", got)
+	}
+	flow()
+	if got := openNativeClients(); got != 0 {
+		t.Errorf("got %d open connections after the flow, want them closed", got)
+	}
+}
+
+func TestNativeHostKeys(t *testing.T) {
+	tests := []struct {
+		name       string
+		knownHosts string
+		strict     string
+		wantErr    bool
+	}{
+		{"known host", "", "", false},
+		{"unknown host", "empty", "", true},
+		{"unknown host without strict checking", "empty", "no", false},
+		{"unknown host accepted and recorded", "empty", "accept-new", false},
+		{"changed host key", "other", "no", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := newNativeTest(t)
+			switch tt.knownHosts {
+			case "empty":
+				write(t, n.knownHosts, "")
+			case "other":
+				other, err := rsa.GenerateKey(rand.Reader, 2048)
+				if err != nil {
+					t.Fatal(err)
+				}
+				otherKey, _ := ssh.NewPublicKey(&other.PublicKey)
+				write(t, n.knownHosts, knownhosts.Line([]string{knownhosts.Normalize(n.server.addr)}, otherKey)+"\n")
+			}
+			var args []string
+			if tt.strict != "" {
+				args = []string{"-o", "StrictHostKeyChecking=" + tt.strict}
+			}
+			opts := n.options(SSH, args...)
+			opts.RemoteCmd = []string{"hostname"}
+			e, err := New(opts)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			_, err = e.Output()
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+
+			if tt.strict == "accept-new" {
+				recorded, _ := ioutil.ReadFile(n.knownHosts)
+				if !strings.Contains(string(recorded), knownhosts.Normalize(n.server.addr)) {
+					t.Errorf("host key was not recorded: %q", recorded)
+				}
+			}
+		})
+	}
+}
+
+func TestNativeSFTP(t *testing.T) {
+	n := newNativeTest(t)
+	local := filepath.Join(n.dir, "upload.txt")
+	write(t, local, "hello")
+	remoteDir := filepath.Join(n.dir, "remote")
+	if err := os.Mkdir(remoteDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	put := n.options(SCP)
+	put.LocalPath, put.RemotePath = local, remoteDir
+	e, err := New(put)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := e.Output(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	uploaded, err := ioutil.ReadFile(filepath.Join(remoteDir, "upload.txt"))
+	if err != nil || string(uploaded) != "hello" {
+		t.Fatalf("got %q, %v, want the uploaded file", uploaded, err)
+	}
+
+	downloadDir := filepath.Join(n.dir, "download")
+	if err := os.Mkdir(downloadDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	get := n.options(SCP)
+	get.Download = true
+	get.LocalPath, get.RemotePath = downloadDir, filepath.Join(remoteDir, "upload.txt")
+	e, err = New(get)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := e.Output(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	downloaded, err := ioutil.ReadFile(filepath.Join(downloadDir, "upload.txt"))
+	if err != nil || string(downloaded) != "hello" {
+		t.Fatalf("got %q, %v, want the downloaded file", downloaded, err)
+	}
+}
+
+//testAgent is an ssh agent holding the client key of a native test
+type testAgent struct {
+	sock string
+
+	mu          sync.Mutex
+	conns, open int
+}
+
+func newTestAgent(t *testing.T, n *nativeTest) *testAgent {
+	data, err := ioutil.ReadFile(n.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ssh.ParseRawPrivateKey(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: raw}); err != nil {
+		t.Fatal(err)
+	}
+	a := &testAgent{sock: filepath.Join(n.dir, "agent.sock")}
+	l, err := net.Listen("unix", a.sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			a.mu.Lock()
+			a.conns++
+			a.open++
+			a.mu.Unlock()
+			go func(c io.ReadWriteCloser) {
+				defer c.Close()
+				_ = agent.ServeAgent(keyring, c)
+				a.mu.Lock()
+				a.open--
+				a.mu.Unlock()
+			}(conn)
+		}
+	}()
+	os.Setenv("SSH_AUTH_SOCK", a.sock)
+	return a
+}
+
+//connections returns the connections the agent accepted and how many are still open
+func (a *testAgent) connections() (conns, open int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.conns, a.open
+}
+
+func TestNativeAgentForwarding(t *testing.T) {
+	n := newNativeTest(t)
+	//the agent holds the client key, the identity file is not needed
+	newTestAgent(t, n)
+	write(t, sshConfigFiles[0], strings.Replace(readFile(t, sshConfigFiles[0]), "  IdentityFile "+n.key+"\n", "", 1))
+
+	opts := n.options(SSH, "-A")
+	opts.RemoteCmd = []string{"agent-keys"}
+	e, err := New(opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	out, err := e.Output()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(out) != "1 keys\n" {
+		t.Errorf("got %q, want the forwarded agent keys", out)
+	}
+}
+
+func TestNativeAgentConnection(t *testing.T) {
+	n := newNativeTest(t)
+	a := newTestAgent(t, n)
+	settings, err := newNativeSettings(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := settings.clientConfig("web-1", "ec2-user", nil); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if conns, _ := a.connections(); conns != 1 {
+		t.Errorf("got %d agent connections, want a single connection shared by the hosts", conns)
+	}
+
+	closeConnections()
+	deadline := time.Now().Add(time.Second)
+	for _, open := a.connections(); open > 0 && time.Now().Before(deadline); _, open = a.connections() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, open := a.connections(); open != 0 {
+		t.Error("agent connection is still open once the connections were closed")
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
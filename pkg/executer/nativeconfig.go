@@ -0,0 +1,331 @@
+package executer
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kevinburke/ssh_config"
+	"github.com/mitchellh/go-homedir"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+//sshConfigFiles are read in order by the native backend, the first value found for an option is used
+var sshConfigFiles = []string{"~/.ssh/config", "/etc/ssh/ssh_config"}
+
+//defaultIdentities are the keys tried when no identity file is configured
+var defaultIdentities = []string{"~/.ssh/id_ed25519", "~/.ssh/id_ecdsa", "~/.ssh/id_rsa"}
+
+//defaultKnownHosts are the known hosts files used when UserKnownHostsFile is not configured
+var defaultKnownHosts = []string{"~/.ssh/known_hosts", "~/.ssh/known_hosts2"}
+
+//nativeSettings resolves ssh options like OpenSSH: options of the profile args first, then ssh_config files
+type nativeSettings struct {
+	options      map[string]string
+	identities   []string
+	port         string
+	forwardAgent bool
+	configs      []*ssh_config.Config
+}
+
+//newNativeSettings reads the ssh options of the profile args and the ssh_config files
+func newNativeSettings(args []string) (*nativeSettings, error) {
+	s := &nativeSettings{options: make(map[string]string)}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		next := func() string {
+			if i+1 < len(args) {
+				i++
+				return args[i]
+			}
+			return ""
+		}
+		switch {
+		case arg == "-o":
+			s.setOption(next())
+		case strings.HasPrefix(arg, "-o"):
+			s.setOption(strings.TrimPrefix(arg, "-o"))
+		case arg == "-i":
+			s.identities = append(s.identities, next())
+		case arg == "-p", arg == "-P":
+			s.port = next()
+		case arg == "-J", arg == "-F", arg == "-l", arg == "-c", arg == "-m", arg == "-L", arg == "-R", arg == "-D":
+			next()
+		case strings.HasPrefix(arg, "-") && !strings.HasPrefix(arg, "--"):
+			//combined flags without values, e.g. -Ct or -A
+			if strings.Contains(arg, "A") {
+				s.forwardAgent = true
+			}
+		}
+	}
+
+	for _, f := range sshConfigFiles {
+		path, err := homedir.Expand(f)
+		if err != nil {
+			return nil, err
+		}
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		cfg, err := ssh_config.Decode(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", path, err)
+		}
+		s.configs = append(s.configs, cfg)
+	}
+	return s, nil
+}
+
+func (s *nativeSettings) setOption(option string) {
+	parts := strings.SplitN(strings.TrimSpace(option), "=", 2)
+	if len(parts) != 2 {
+		parts = strings.SplitN(strings.TrimSpace(option), " ", 2)
+	}
+	if len(parts) == 2 {
+		key := strings.ToLower(strings.TrimSpace(parts[0]))
+		if _, ok := s.options[key]; !ok {
+			s.options[key] = strings.TrimSpace(parts[1])
+		}
+	}
+}
+
+//get returns the value of an ssh option for host
+func (s *nativeSettings) get(host, key string) string {
+	if v, ok := s.options[strings.ToLower(key)]; ok {
+		return v
+	}
+	for _, cfg := range s.configs {
+		if v := configValues(cfg, host, key); len(v) > 0 {
+			return v[0]
+		}
+	}
+	return ""
+}
+
+//getAll returns all values of an ssh option for host from the ssh_config files
+func (s *nativeSettings) getAll(host, key string) []string {
+	var values []string
+	for _, cfg := range s.configs {
+		values = append(values, configValues(cfg, host, key)...)
+	}
+	return values
+}
+
+//configValues returns the values of key for host, Match blocks are not supported and ignored
+func configValues(cfg *ssh_config.Config, host, key string) (values []string) {
+	defer func() {
+		if recover() != nil {
+			values = nil
+		}
+	}()
+	values, _ = cfg.GetAll(host, key)
+	return values
+}
+
+//endpoint returns the address dialed for host, applying HostName and Port unless port is set
+func (s *nativeSettings) endpoint(host, port string) string {
+	hostname := s.get(host, "HostName")
+	if hostname == "" {
+		hostname = host
+	}
+	if port == "" {
+		port = s.get(host, "Port")
+	}
+	if port == "" {
+		port = "22"
+	}
+	return net.JoinHostPort(hostname, port)
+}
+
+//clientConfig returns the ssh client config used to connect to host as user
+func (s *nativeSettings) clientConfig(host, user string, keys []string) (*ssh.ClientConfig, error) {
+	auth, err := s.auth(host, keys)
+	if err != nil {
+		return nil, err
+	}
+	hostKeys, err := s.hostKeyCallback(host)
+	if err != nil {
+		return nil, err
+	}
+	var timeout time.Duration
+	if seconds, err := strconv.Atoi(s.get(host, "ConnectTimeout")); err == nil && seconds > 0 {
+		timeout = time.Duration(seconds) * time.Second
+	}
+	return &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: hostKeys,
+		Timeout:         timeout,
+	}, nil
+}
+
+//auth returns the ssh agent keys followed by the identity files found
+func (s *nativeSettings) auth(host string, keys []string) ([]ssh.AuthMethod, error) {
+	var signers []ssh.Signer
+	if a, err := sshAgent(); err == nil {
+		agentSigners, err := a.Signers()
+		if err == nil {
+			signers = append(signers, agentSigners...)
+		}
+	}
+
+	identities := append(append(append([]string{}, keys...), s.identities...), s.getAll(host, "IdentityFile")...)
+	if len(identities) == 0 {
+		identities = defaultIdentities
+	}
+	for _, identity := range identities {
+		signer, err := loadIdentity(identity)
+		if err != nil {
+			return nil, err
+		}
+		if signer != nil {
+			signers = append(signers, signer)
+		}
+	}
+	if len(signers) == 0 {
+		return nil, fmt.Errorf("no ssh keys found, load keys into ssh-agent or configure an identity file")
+	}
+	return []ssh.AuthMethod{ssh.PublicKeys(signers...)}, nil
+}
+
+//loadIdentity reads a private key, missing and passphrase protected keys are skipped
+func loadIdentity(identity string) (ssh.Signer, error) {
+	path, err := homedir.Expand(identity)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	var passphraseErr *ssh.PassphraseMissingError
+	if errors.As(err, &passphraseErr) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading key %s: %w", path, err)
+	}
+	return signer, nil
+}
+
+//hostKeyCallback verifies host keys against the known hosts files following StrictHostKeyChecking.
+//Unknown hosts are accepted when it is no or accept-new, which also records them, changed keys are always rejected.
+func (s *nativeSettings) hostKeyCallback(host string) (ssh.HostKeyCallback, error) {
+	files := strings.Fields(s.get(host, "UserKnownHostsFile"))
+	if len(files) == 0 {
+		files = defaultKnownHosts
+	}
+	var existing []string
+	for _, f := range files {
+		path, err := homedir.Expand(f)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(path); err == nil {
+			existing = append(existing, path)
+		}
+	}
+	known, err := knownhosts.New(existing...)
+	if err != nil {
+		return nil, err
+	}
+
+	strict := strings.ToLower(s.get(host, "StrictHostKeyChecking"))
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := known(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) || len(keyErr.Want) > 0 {
+			return err
+		}
+		switch strict {
+		case "no", "off":
+			return nil
+		case "accept-new":
+			return recordHostKey(files[0], hostname, key)
+		default:
+			return fmt.Errorf("host key of %s is unknown, add it to %s or set StrictHostKeyChecking", hostname, files[0])
+		}
+	}, nil
+}
+
+//knownHostsMu serializes writes to known hosts files
+var knownHostsMu sync.Mutex
+
+func recordHostKey(file, hostname string, key ssh.PublicKey) error {
+	path, err := homedir.Expand(file)
+	if err != nil {
+		return err
+	}
+	knownHostsMu.Lock()
+	defer knownHostsMu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key))
+	return err
+}
+
+//nativeAgent is the connection to the ssh agent shared by the connections of the native backend.
+//Agent keys sign over it during every handshake, it stays open until the connections are closed.
+var nativeAgent struct {
+	sync.Mutex
+	conn   net.Conn
+	client agent.ExtendedAgent
+}
+
+//sshAgent returns the client of the agent of SSH_AUTH_SOCK, connecting on first use
+func sshAgent() (agent.ExtendedAgent, error) {
+	nativeAgent.Lock()
+	defer nativeAgent.Unlock()
+	if nativeAgent.client != nil {
+		return nativeAgent.client, nil
+	}
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, fmt.Errorf("SSH_AUTH_SOCK is not set")
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, err
+	}
+	nativeAgent.conn, nativeAgent.client = conn, agent.NewClient(conn)
+	return nativeAgent.client, nil
+}
+
+//closeAgent closes the connection to the ssh agent
+func closeAgent() {
+	nativeAgent.Lock()
+	defer nativeAgent.Unlock()
+	if nativeAgent.conn != nil {
+		nativeAgent.conn.Close()
+		nativeAgent.conn, nativeAgent.client = nil, nil
+	}
+}
+
+//agentForwarding reports whether the agent is forwarded to host
+func (s *nativeSettings) agentForwarding(host string) bool {
+	return s.forwardAgent || strings.EqualFold(s.get(host, "ForwardAgent"), "yes")
+}
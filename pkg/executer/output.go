@@ -0,0 +1,282 @@
+package executer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adamkobi/xt/pkg/iostreams"
+)
+
+//Output formats of RunCommands
+const (
+	//OutputText prefixes every line by the host name and prints a summary table
+	OutputText = "text"
+	//OutputJSON prints a single document with the output and result of every host once all commands finished
+	OutputJSON = "json"
+	//OutputNDJSON prints a record for every line as it arrives, followed by a record with the result of every host
+	OutputNDJSON = "ndjson"
+)
+
+//sshArgFlags are the ssh flags followed by an argument
+const sshArgFlags = "BbcDEeFIiJLlmOopQRSWw"
+
+//WithoutTTY removes the -t flags from ssh args. Commands run under a remote terminal write their stderr
+//to the output, which the structured output formats report separately.
+func WithoutTTY(args []string) []string {
+	var result []string
+	for idx := 0; idx < len(args); idx++ {
+		arg := args[idx]
+		if len(arg) < 2 || arg[0] != '-' || arg[1] == '-' {
+			result = append(result, arg)
+			continue
+		}
+		flags := []byte{'-'}
+		for pos := 1; pos < len(arg); pos++ {
+			if strings.IndexByte(sshArgFlags, arg[pos]) >= 0 {
+				//the rest of the arg is the value of the flag, or the value is the next arg
+				flags = append(flags, arg[pos:]...)
+				if pos == len(arg)-1 && idx+1 < len(args) {
+					idx++
+					result = append(result, string(flags), args[idx])
+					flags = nil
+				}
+				break
+			}
+			if arg[pos] != 't' {
+				flags = append(flags, arg[pos])
+			}
+		}
+		if len(flags) > 1 {
+			result = append(result, string(flags))
+		}
+	}
+	return result
+}
+
+//hangupScript runs the command given as first argument and hangs up its process group, which sshd starts
+//the remote shell in, once stdin closes. Without a remote terminal the command is not hung up when the
+//connection closes, ssh closes the stdin of the remote shell instead. Stdin is kept on fd 3 since
+//commands run in the background read /dev/null.
+const hangupScript = `exec 3<&0; sh -c "$1" </dev/null 3<&- & pid=$!; ` +
+	`{ cat <&3; kill -HUP 0; } >/dev/null 2>&1 & watcher=$!; ` +
+	`exec 3<&-; wait "$pid"; status=$?; kill "$watcher" 2>/dev/null; exit "$status"`
+
+//hangupOnClose wraps remoteCmd so the remote command is hung up once the connection closes, as it is under a
+//remote terminal. Commands run without -t otherwise keep running when ssh is killed on timeout or interrupt.
+//The command no longer reads the stdin of the connection.
+func hangupOnClose(remoteCmd []string) []string {
+	if len(remoteCmd) == 0 {
+		return remoteCmd
+	}
+	return []string{"sh", "-c", shellQuote(hangupScript), "xt", shellQuote(strings.Join(remoteCmd, " "))}
+}
+
+//runPrinter writes the output of the commands of a run
+type runPrinter interface {
+	//status writes progress of the run
+	status(format string, a ...interface{})
+	//host returns the writers of the command output on the host at idx, flush is called once the command exited
+	host(idx int, hostname string) (stdout, stderr io.Writer, flush func())
+	//result writes the result of the host at idx once its command exited
+	result(idx int, res Result)
+	//summary writes the results once the run finished
+	summary(results Results) error
+}
+
+//newRunPrinter returns the printer of the output format for a run on total hosts
+func newRunPrinter(io *iostreams.IOStreams, format string, total int) runPrinter {
+	//stdout and stderr may be the same stream, writes to both are serialized
+	var mu sync.Mutex
+	out, errOut := &lockedWriter{mu: &mu, w: io.Out}, &lockedWriter{mu: &mu, w: io.ErrOut}
+	switch format {
+	case OutputJSON:
+		return &jsonPrinter{out: out, stdout: make([]bytes.Buffer, total), stderr: make([]bytes.Buffer, total)}
+	case OutputNDJSON:
+		return &ndjsonPrinter{enc: json.NewEncoder(out)}
+	default:
+		return &textPrinter{io: io, cs: io.ColorScheme(), out: out, errOut: errOut}
+	}
+}
+
+//textPrinter prefixes every line by the host name and prints a summary table
+type textPrinter struct {
+	io          *iostreams.IOStreams
+	cs          *iostreams.ColorScheme
+	out, errOut io.Writer
+}
+
+func (p *textPrinter) status(format string, a ...interface{}) {
+	fmt.Fprintf(p.out, format+"\n", a...)
+}
+
+func (p *textPrinter) host(idx int, hostname string) (io.Writer, io.Writer, func()) {
+	fmt.Fprintf(p.out, "running command on %s\n", p.cs.Bold(hostname))
+	prefix := p.cs.Green(hostname)
+	out, errOut := newPrefixWriter(p.out, prefix), newPrefixWriter(p.errOut, prefix)
+	return out, errOut, func() {
+		out.Flush()
+		errOut.Flush()
+	}
+}
+
+func (p *textPrinter) result(idx int, res Result) {
+	if res.TimedOut() {
+		fmt.Fprintf(p.errOut, "%s | %s\n", p.cs.Green(res.Hostname), p.cs.Red(res.Stderr))
+	}
+}
+
+func (p *textPrinter) summary(results Results) error {
+	fmt.Fprintln(p.io.Out)
+	return results.Print(p.io)
+}
+
+//hostRecord is the result of a host in the json and ndjson output formats
+type hostRecord struct {
+	Host string `json:"host"`
+	//Status is ok, failed, timeout, cancelled or skipped
+	Status     string  `json:"status"`
+	ExitCode   int     `json:"exit_code"`
+	DurationMS int64   `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+	Stdout     *string `json:"stdout,omitempty"`
+	Stderr     *string `json:"stderr,omitempty"`
+}
+
+func newHostRecord(res Result) hostRecord {
+	r := hostRecord{
+		Host:       res.Hostname,
+		Status:     "ok",
+		ExitCode:   res.ExitCode,
+		DurationMS: res.Duration.Milliseconds(),
+	}
+	switch {
+	case res.Skipped():
+		r.Status = "skipped"
+	case res.TimedOut():
+		r.Status = "timeout"
+	case res.Err == errCancelled:
+		r.Status = "cancelled"
+	case res.Failed():
+		r.Status = "failed"
+	}
+	if res.Err != nil {
+		r.Error = res.Err.Error()
+	}
+	return r
+}
+
+//jsonPrinter collects the output of every host and prints a single document once the run finished
+type jsonPrinter struct {
+	out            io.Writer
+	stdout, stderr []bytes.Buffer
+}
+
+func (p *jsonPrinter) status(string, ...interface{}) {}
+
+func (p *jsonPrinter) host(idx int, hostname string) (io.Writer, io.Writer, func()) {
+	//a host is run once, its buffers are only written by its command
+	return &p.stdout[idx], &p.stderr[idx], func() {}
+}
+
+func (p *jsonPrinter) result(int, Result) {}
+
+func (p *jsonPrinter) summary(results Results) error {
+	hosts := make([]hostRecord, len(results))
+	for idx, res := range results {
+		hosts[idx] = newHostRecord(res)
+		if !res.Skipped() {
+			//commands run under a PTY end lines with \r\n
+			stdout := strings.ReplaceAll(p.stdout[idx].String(), "\r\n", "\n")
+			stderr := strings.ReplaceAll(p.stderr[idx].String(), "\r\n", "\n")
+			hosts[idx].Stdout, hosts[idx].Stderr = &stdout, &stderr
+		}
+	}
+	enc := json.NewEncoder(p.out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		Hosts    []hostRecord `json:"hosts"`
+		Total    int          `json:"total"`
+		Failed   int          `json:"failed"`
+		TimedOut int          `json:"timed_out"`
+		Skipped  int          `json:"skipped"`
+	}{hosts, len(results), results.Failed(), results.TimedOut(), results.Skipped()})
+}
+
+//ndjsonPrinter prints a record for every line as it arrives and a record with the result of every host
+type ndjsonPrinter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+//lineRecord is a line of output in the ndjson output format
+type lineRecord struct {
+	Host   string    `json:"host"`
+	Stream string    `json:"stream"`
+	Line   string    `json:"line"`
+	Time   time.Time `json:"ts"`
+}
+
+func (p *ndjsonPrinter) encode(v interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_ = p.enc.Encode(v)
+}
+
+func (p *ndjsonPrinter) status(string, ...interface{}) {}
+
+func (p *ndjsonPrinter) host(idx int, hostname string) (io.Writer, io.Writer, func()) {
+	out, errOut := p.lineWriter(hostname, "stdout"), p.lineWriter(hostname, "stderr")
+	return out, errOut, func() {
+		out.Close()
+		errOut.Close()
+	}
+}
+
+//lineWriter returns a writer encoding every line written to it, Close encodes the last partial line
+func (p *ndjsonPrinter) lineWriter(hostname, stream string) io.WriteCloser {
+	r, w := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			p.encode(lineRecord{Host: hostname, Stream: stream, Line: strings.TrimRight(scanner.Text(), "\r"), Time: time.Now().UTC()})
+		}
+		//drain the pipe when a line is too long so the command is not blocked
+		_, _ = io.Copy(ioutil.Discard, r)
+	}()
+	return &pipeLineWriter{PipeWriter: w, done: done}
+}
+
+//pipeLineWriter waits for the lines written to be encoded when closed
+type pipeLineWriter struct {
+	*io.PipeWriter
+	done chan struct{}
+}
+
+func (w *pipeLineWriter) Close() error {
+	err := w.PipeWriter.Close()
+	<-w.done
+	return err
+}
+
+func (p *ndjsonPrinter) result(idx int, res Result) {
+	p.encode(newHostRecord(res))
+}
+
+func (p *ndjsonPrinter) summary(results Results) error {
+	for _, res := range results {
+		if res.Skipped() {
+			p.encode(newHostRecord(res))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package executer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os/exec"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/adamkobi/xt/pkg/iostreams"
+)
+
+func TestRunCommandsNDJSON(t *testing.T) {
+	io, _, stdout, _ := iostreams.Test()
+	cmds := []*Cmd{shellCmd("web-1", "echo one; echo two >&2"), shellCmd("web-2", "echo three; exit 2")}
+	_, err := RunCommands(context.Background(), io, cmds, RunOptions{Output: OutputNDJSON})
+	if err == nil {
+		t.Fatal("got no error, want web-2 failed")
+	}
+
+	lines := map[string]string{}
+	results := map[string]map[string]interface{}{}
+	scanner := bufio.NewScanner(strings.NewReader(stdout.String()))
+	for scanner.Scan() {
+		var record map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("line %q is not json: %v", scanner.Text(), err)
+		}
+		host := record["host"].(string)
+		if line, ok := record["line"]; ok {
+			if _, err := time.Parse(time.RFC3339Nano, record["ts"].(string)); err != nil {
+				t.Errorf("record %v has an invalid ts: %v", record, err)
+			}
+			lines[host+"/"+record["stream"].(string)] += line.(string)
+			continue
+		}
+		results[host] = record
+	}
+
+	wantLines := map[string]string{"web-1/stdout": "one", "web-1/stderr": "two", "web-2/stdout": "three"}
+	for key, want := range wantLines {
+		if lines[key] != want {
+			t.Errorf("got %s lines %q, want %q", key, lines[key], want)
+		}
+	}
+	if got := results["web-1"]["status"]; got != "ok" {
+		t.Errorf("got web-1 status %v, want ok", got)
+	}
+	if got := results["web-2"]["exit_code"]; got != float64(2) {
+		t.Errorf("got web-2 exit code %v, want 2", got)
+	}
+}
+
+func TestRunCommandsJSON(t *testing.T) {
+	io, _, stdout, _ := iostreams.Test()
+	cmds := []*Cmd{shellCmd("web-1", "echo one; echo two >&2"), shellCmd("web-2", "sleep 10")}
+	_, err := RunCommands(context.Background(), io, cmds, RunOptions{Output: OutputJSON, HostTimeout: 300 * time.Millisecond})
+	if err == nil {
+		t.Fatal("got no error, want web-2 timed out")
+	}
+
+	var doc struct {
+		Hosts []struct {
+			Host     string  `json:"host"`
+			Status   string  `json:"status"`
+			ExitCode int     `json:"exit_code"`
+			Stdout   *string `json:"stdout"`
+			Stderr   *string `json:"stderr"`
+		} `json:"hosts"`
+		Total    int `json:"total"`
+		TimedOut int `json:"timed_out"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &doc); err != nil {
+		t.Fatalf("output is not a json document: %v\n%s", err, stdout.String())
+	}
+	if doc.Total != 2 || doc.TimedOut != 1 || len(doc.Hosts) != 2 {
+		t.Fatalf("got %+v, want 2 hosts with 1 timed out", doc)
+	}
+	web1 := doc.Hosts[0]
+	if web1.Status != "ok" || web1.Stdout == nil || strings.TrimSpace(*web1.Stdout) != "one" || strings.TrimSpace(*web1.Stderr) != "two" {
+		t.Errorf("got web-1 %+v, want its stdout and stderr", web1)
+	}
+	if web2 := doc.Hosts[1]; web2.Status != "timeout" || web2.ExitCode != -1 {
+		t.Errorf("got web-2 %+v, want it timed out", web2)
+	}
+}
+
+func TestWithoutTTY(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{"default args", []string{"-Ct", "-o", "LogLevel=INFO", "-o", "ControlMaster=auto"}, []string{"-C", "-o", "LogLevel=INFO", "-o", "ControlMaster=auto"}},
+		{"forced tty", []string{"-tt", "-A"}, []string{"-A"}},
+		{"flag values", []string{"-i", "/keys/t", "-tiid_t", "-p22"}, []string{"-i", "/keys/t", "-iid_t", "-p22"}},
+		{"no tty", []string{"-C", "-o", "User=t"}, []string{"-C", "-o", "User=t"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := WithoutTTY(tt.args); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+//remoteShell runs remoteCmd the way sshd does, joined by spaces and parsed by the shell of the user
+//in a new session
+func remoteShell(remoteCmd []string) *exec.Cmd {
+	cmd := exec.Command("sh", "-c", strings.Join(remoteCmd, " "))
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	return cmd
+}
+
+func TestHangupOnClose(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	cmd := remoteShell(hangupOnClose([]string{"echo", "'it''s'", "out;", "echo err >&2;", "exit", "3"}))
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	//the connection is open while the command runs
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	if err := cmd.Run(); exitCode(err) != 3 {
+		t.Errorf("got error %v, want exit code 3", err)
+	}
+	if stdout.String() != "its out\n" || stderr.String() != "err\n" {
+		t.Errorf("got stdout %q and stderr %q, want the streams of the command", stdout.String(), stderr.String())
+	}
+
+	//every process of the command is hung up once the connection closes
+	stdout.Reset()
+	cmd = remoteShell(hangupOnClose([]string{"sleep 10;", "echo done"}))
+	cmd.Stdout = &stdout
+	stdin, err = cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	start := time.Now()
+	stdin.Close()
+	if err := cmd.Wait(); exitCode(err) == 0 {
+		t.Errorf("got error %v, want the command hung up", err)
+	}
+	if time.Since(start) > 5*time.Second || stdout.Len() > 0 {
+		t.Errorf("command ran for %s and printed %q after the connection closed", time.Since(start), stdout.String())
+	}
+}
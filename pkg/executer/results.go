@@ -0,0 +1,299 @@
+package executer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adamkobi/xt/pkg/iostreams"
+	"github.com/adamkobi/xt/pkg/utils"
+	"golang.org/x/crypto/ssh"
+)
+
+//tailLines is the number of stderr lines kept for the summary of a run
+const tailLines = 3
+
+//errCancelled is the error of commands killed after another host failed or the run was interrupted
+var errCancelled = errors.New("cancelled")
+
+//errTimedOut is the error of commands killed once the host or run timeout passed
+var errTimedOut = errors.New("timed out")
+
+//errDeclined stops a run when the next batch was not approved
+var errDeclined = errors.New("run cancelled")
+
+//errSkipped is the error of commands not started because the run was aborted
+var errSkipped = errors.New("skipped")
+
+//RunError describes a run that did not succeed on all hosts
+type RunError struct {
+	Total  int
+	Failed int
+	//TimedOut is the number of failed hosts that timed out
+	TimedOut int
+	Skipped  int
+	//Err is the reason the run stopped before all hosts finished, if any
+	Err error
+}
+
+func (e *RunError) Error() string {
+	var msg string
+	switch {
+	case e.Failed > 0:
+		msg = fmt.Sprintf("command failed on %d of %d hosts", e.Failed, e.Total)
+		if e.TimedOut > 0 {
+			msg += fmt.Sprintf(", %d timed out", e.TimedOut)
+		}
+		if e.Skipped > 0 {
+			msg += fmt.Sprintf(", %d skipped", e.Skipped)
+		}
+	case e.Skipped > 0:
+		msg = fmt.Sprintf("command skipped on %d of %d hosts", e.Skipped, e.Total)
+	}
+
+	var reason string
+	switch {
+	case errors.Is(e.Err, context.Canceled):
+		reason = "interrupted"
+	case errors.Is(e.Err, context.DeadlineExceeded):
+		reason = "run timed out"
+	case e.Err != nil:
+		reason = e.Err.Error()
+	default:
+		return msg
+	}
+	if msg == "" {
+		return reason
+	}
+	return reason + ": " + msg
+}
+
+func (e *RunError) Unwrap() error {
+	return e.Err
+}
+
+//Result describes the command run on a single host
+type Result struct {
+	Hostname string
+	//ExitCode is the exit code of the command, -1 when it did not exit by itself
+	ExitCode int
+	Duration time.Duration
+	//Stderr is the tail of the command stderr and Output the tail of its output
+	Stderr string
+	Output string
+	Err    error
+}
+
+//message returns the tail of the stderr of the host, or of its output when stderr is empty,
+//commands run with ssh -t write their stderr to the output
+func (r *Result) message() string {
+	if r.Stderr != "" {
+		return r.Stderr
+	}
+	return r.Output
+}
+
+//Failed reports whether the command failed on the host
+func (r *Result) Failed() bool {
+	return r.Err != nil && !r.Skipped()
+}
+
+//Skipped reports whether the command was not started on the host
+func (r *Result) Skipped() bool {
+	return r.Err == errSkipped
+}
+
+//TimedOut reports whether the command was killed because it timed out
+func (r *Result) TimedOut() bool {
+	return r.Err == errTimedOut
+}
+
+//Results are the results of a run in the order of the commands
+type Results []Result
+
+//Failed returns the number of hosts the command failed on
+func (r Results) Failed() int {
+	failed := 0
+	for idx := range r {
+		if r[idx].Failed() {
+			failed++
+		}
+	}
+	return failed
+}
+
+//TimedOut returns the number of hosts the command timed out on
+func (r Results) TimedOut() int {
+	timedOut := 0
+	for idx := range r {
+		if r[idx].TimedOut() {
+			timedOut++
+		}
+	}
+	return timedOut
+}
+
+//Skipped returns the number of hosts the command was not started on
+func (r Results) Skipped() int {
+	skipped := 0
+	for idx := range r {
+		if r[idx].Skipped() {
+			skipped++
+		}
+	}
+	return skipped
+}
+
+//Print writes a summary table of the results
+func (r Results) Print(io *iostreams.IOStreams) error {
+	cs := io.ColorScheme()
+	table := utils.NewTablePrinter(io)
+	if table.IsTTY() {
+		for _, header := range []string{"Host", "Exit Code", "Duration", "Stderr"} {
+			table.AddField(header, nil, cs.MagentaBold)
+		}
+		table.EndRow()
+	}
+	for _, res := range r {
+		color := cs.Green
+		exitCode := strconv.Itoa(res.ExitCode)
+		switch {
+		case res.Failed():
+			color = cs.Red
+		case res.Skipped():
+			color = cs.Yellow
+		}
+		switch {
+		case res.TimedOut():
+			exitCode = "timeout"
+		case res.ExitCode < 0:
+			exitCode = "-"
+		}
+		table.AddField(res.Hostname, nil, cs.Bold)
+		table.AddField(exitCode, nil, color)
+		table.AddField(res.Duration.Round(time.Millisecond).String(), nil, nil)
+		table.AddField(strings.ReplaceAll(res.message(), "\n", " | "), nil, cs.Gray)
+		table.EndRow()
+	}
+	return table.Render()
+}
+
+//exitCode returns the exit code of a command that returned err, -1 when the command did not exit
+func exitCode(err error) int {
+	var execErr *exec.ExitError
+	var sshErr *ssh.ExitError
+	var ssmErr *ssmCommandError
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &execErr):
+		return execErr.ExitCode()
+	case errors.As(err, &sshErr):
+		return sshErr.ExitStatus()
+	case errors.As(err, &ssmErr):
+		return int(ssmErr.Code)
+	default:
+		return -1
+	}
+}
+
+//lockedWriter serializes the writes of concurrent commands to a shared stream
+type lockedWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
+
+//prefixWriter writes complete lines prefixed by the host name, the last partial line is written by Flush
+type prefixWriter struct {
+	mu     sync.Mutex
+	out    io.Writer
+	prefix string
+	buf    bytes.Buffer
+}
+
+func newPrefixWriter(out io.Writer, prefix string) *prefixWriter {
+	return &prefixWriter{out: out, prefix: prefix}
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf.Write(p)
+	for {
+		line, err := w.buf.ReadString('\n')
+		if err != nil {
+			//keep the partial line until it is completed
+			w.buf.Reset()
+			w.buf.WriteString(line)
+			return len(p), nil
+		}
+		fmt.Fprintf(w.out, "%s | %s\n", w.prefix, strings.TrimRight(line, "\r\n"))
+	}
+}
+
+//Flush writes the last partial line
+func (w *prefixWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.buf.Len() > 0 {
+		fmt.Fprintf(w.out, "%s | %s\n", w.prefix, strings.TrimRight(w.buf.String(), "\r\n"))
+		w.buf.Reset()
+	}
+}
+
+//tailWriter keeps the last lines written to it
+type tailWriter struct {
+	mu    sync.Mutex
+	lines []string
+	buf   bytes.Buffer
+}
+
+func (w *tailWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf.Write(p)
+	for {
+		line, err := w.buf.ReadString('\n')
+		if err != nil {
+			w.buf.Reset()
+			w.buf.WriteString(line)
+			return len(p), nil
+		}
+		w.add(line)
+	}
+}
+
+func (w *tailWriter) add(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	w.lines = append(w.lines, line)
+	if len(w.lines) > tailLines {
+		w.lines = w.lines[len(w.lines)-tailLines:]
+	}
+}
+
+//String returns the last lines, including a trailing partial line
+func (w *tailWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.buf.Len() > 0 {
+		w.add(w.buf.String())
+		w.buf.Reset()
+	}
+	return strings.Join(w.lines, "\n")
+}
@@ -0,0 +1,279 @@
+package executer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adamkobi/xt/pkg/iostreams"
+)
+
+func shellCmd(host, script string) *Cmd {
+	return &Cmd{Hostname: host, Exec: exec.Command("sh", "-c", script)}
+}
+
+func TestRunCommands(t *testing.T) {
+	tests := []struct {
+		name      string
+		cmds      []*Cmd
+		opts      RunOptions
+		wantCodes []int
+		wantErr   bool
+		maxTime   time.Duration
+	}{
+		{
+			"all succeed",
+			[]*Cmd{shellCmd("web-1", "echo ok"), shellCmd("web-2", "echo ok")},
+			RunOptions{},
+			[]int{0, 0},
+			false,
+			0,
+		},
+		{
+			"failed host",
+			[]*Cmd{shellCmd("web-1", "echo ok"), shellCmd("web-2", "echo first >&2; echo disk full >&2; exit 3")},
+			RunOptions{},
+			[]int{0, 3},
+			true,
+			0,
+		},
+		{
+			"ignore errors",
+			[]*Cmd{shellCmd("web-1", "exit 1")},
+			RunOptions{IgnoreErrors: true},
+			[]int{1},
+			false,
+			0,
+		},
+		{
+			"fail fast",
+			[]*Cmd{shellCmd("web-1", "exit 2"), shellCmd("web-2", "sleep 10")},
+			RunOptions{FailFast: true},
+			[]int{2, -1},
+			true,
+			5 * time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			io, _, stdout, _ := iostreams.Test()
+			start := time.Now()
+			results, err := RunCommands(context.Background(), io, tt.cmds, tt.opts)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if tt.maxTime > 0 && time.Since(start) > tt.maxTime {
+				t.Errorf("run took %s, want less than %s", time.Since(start), tt.maxTime)
+			}
+			for idx, want := range tt.wantCodes {
+				if results[idx].ExitCode != want {
+					t.Errorf("%s exit code %d, want %d", results[idx].Hostname, results[idx].ExitCode, want)
+				}
+			}
+			if !strings.Contains(stdout.String(), "web-1 | ") && tt.wantCodes[0] == 0 {
+				t.Errorf("output is not prefixed by host: %q", stdout.String())
+			}
+		})
+	}
+}
+
+func TestResultStderr(t *testing.T) {
+	io, _, stdout, stderr := iostreams.Test()
+	results, _ := RunCommands(context.Background(), io, []*Cmd{shellCmd("web-2", "echo one >&2; echo two >&2; echo three >&2; echo four >&2; exit 3")}, RunOptions{})
+	if got, want := results[0].Stderr, "two\nthree\nfour"; got != want {
+		t.Errorf("got stderr tail %q, want %q", got, want)
+	}
+	if !strings.Contains(stderr.String(), "web-2 | one") {
+		t.Errorf("stderr is not prefixed by host: %q", stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "web-2\t3\t") || !strings.Contains(stdout.String(), "two | three | four") {
+		t.Errorf("summary is missing the failed host: %q", stdout.String())
+	}
+
+	results, _ = RunCommands(context.Background(), io, []*Cmd{shellCmd("web-3", "echo permission denied; exit 1")}, RunOptions{})
+	if got := results[0].Stderr; got != "" {
+		t.Errorf("got stderr %q, want it empty", got)
+	}
+	if got := results[0].Output; got != "permission denied" {
+		t.Errorf("got output tail %q, want %q", got, "permission denied")
+	}
+	if !strings.Contains(stdout.String(), "web-3\t1\t") || !strings.Contains(stdout.String(), "permission denied") {
+		t.Errorf("summary is missing the output of the failed host: %q", stdout.String())
+	}
+}
+
+func TestRunOptionsBatches(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  RunOptions
+		total int
+		want  []int
+	}{
+		{"no batches", RunOptions{}, 5, []int{5}},
+		{"batch size", RunOptions{BatchSize: 2}, 5, []int{2, 2, 1}},
+		{"batch percent rounds up", RunOptions{BatchPercent: 30}, 5, []int{2, 2, 1}},
+		{"batch percent of few hosts", RunOptions{BatchPercent: 10}, 3, []int{1, 1, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []int
+			for _, batch := range tt.opts.batches(tt.total) {
+				got = append(got, len(batch))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got batch sizes %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunCommandsScheduling(t *testing.T) {
+	hosts := func(script string, n int) []*Cmd {
+		var cmds []*Cmd
+		for i := 1; i <= n; i++ {
+			cmds = append(cmds, shellCmd(fmt.Sprintf("web-%d", i), script))
+		}
+		return cmds
+	}
+	tests := []struct {
+		name        string
+		cmds        []*Cmd
+		opts        RunOptions
+		wantSkipped int
+		wantErr     bool
+		minTime     time.Duration
+	}{
+		{
+			"parallel limit",
+			hosts("sleep 0.3", 3),
+			RunOptions{Parallel: 1},
+			0,
+			false,
+			900 * time.Millisecond,
+		},
+		{
+			"batch pause",
+			hosts("true", 3),
+			RunOptions{BatchSize: 1, BatchPause: 200 * time.Millisecond},
+			0,
+			false,
+			400 * time.Millisecond,
+		},
+		{
+			"max failures",
+			hosts("exit 1", 5),
+			RunOptions{BatchSize: 2, MaxFailures: 2},
+			3,
+			true,
+			0,
+		},
+		{
+			"max failures with parallel limit",
+			hosts("exit 1", 4),
+			RunOptions{Parallel: 1, MaxFailures: 1, IgnoreErrors: true},
+			3,
+			true,
+			0,
+		},
+		{
+			"batch declined",
+			hosts("true", 3),
+			RunOptions{BatchSize: 1, BatchConfirm: true, confirm: func(string) (bool, error) { return false, nil }},
+			2,
+			true,
+			0,
+		},
+		{
+			"batch approved",
+			hosts("true", 3),
+			RunOptions{BatchSize: 1, BatchConfirm: true, confirm: func(string) (bool, error) { return true, nil }},
+			0,
+			false,
+			0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			io, _, _, _ := iostreams.Test()
+			start := time.Now()
+			results, err := RunCommands(context.Background(), io, tt.cmds, tt.opts)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if got := results.Skipped(); got != tt.wantSkipped {
+				t.Errorf("got %d skipped hosts, want %d", got, tt.wantSkipped)
+			}
+			if time.Since(start) < tt.minTime {
+				t.Errorf("run took %s, want at least %s", time.Since(start), tt.minTime)
+			}
+		})
+	}
+}
+
+func TestRunCommandsInterrupted(t *testing.T) {
+	io, _, _, _ := iostreams.Test()
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(300*time.Millisecond, cancel)
+	start := time.Now()
+	results, err := RunCommands(ctx, io, []*Cmd{shellCmd("web-1", "sleep 10"), shellCmd("web-2", "sleep 10"), shellCmd("web-3", "sleep 10")}, RunOptions{Parallel: 2})
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("run took %s, want the commands killed", time.Since(start))
+	}
+	var runErr *RunError
+	if !errors.As(err, &runErr) || !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want an interrupted run error", err)
+	}
+	if runErr.Failed != 2 || runErr.Skipped != 1 {
+		t.Errorf("got %d failed and %d skipped hosts, want 2 and 1", runErr.Failed, runErr.Skipped)
+	}
+	for _, res := range results[:2] {
+		if res.Err != errCancelled {
+			t.Errorf("%s got error %v, want it cancelled", res.Hostname, res.Err)
+		}
+	}
+}
+
+func TestRunCommandsTimeout(t *testing.T) {
+	tests := []struct {
+		name         string
+		opts         RunOptions
+		wantTimedOut int
+		wantSkipped  int
+		wantRunErr   error
+	}{
+		{"host timeout", RunOptions{HostTimeout: 300 * time.Millisecond}, 2, 0, nil},
+		{"run timeout", RunOptions{Timeout: 300 * time.Millisecond, Parallel: 1}, 1, 2, context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			io, _, _, stderr := iostreams.Test()
+			cmds := []*Cmd{shellCmd("web-1", "sleep 10"), shellCmd("web-2", "true"), shellCmd("web-3", "sleep 10")}
+			start := time.Now()
+			results, err := RunCommands(context.Background(), io, cmds, tt.opts)
+			if time.Since(start) > 5*time.Second {
+				t.Fatalf("run took %s, want the commands killed", time.Since(start))
+			}
+			var runErr *RunError
+			if !errors.As(err, &runErr) {
+				t.Fatalf("got error %v, want a run error", err)
+			}
+			if runErr.TimedOut != tt.wantTimedOut || runErr.Skipped != tt.wantSkipped {
+				t.Errorf("got %d timed out and %d skipped hosts, want %d and %d", runErr.TimedOut, runErr.Skipped, tt.wantTimedOut, tt.wantSkipped)
+			}
+			if runErr.Err != tt.wantRunErr {
+				t.Errorf("got run error reason %v, want %v", runErr.Err, tt.wantRunErr)
+			}
+			if !results[0].TimedOut() || results[1].Failed() {
+				t.Errorf("got results %+v, want only the sleeping hosts timed out", results)
+			}
+			if !strings.Contains(stderr.String(), "web-1 | timed out after") {
+				t.Errorf("timeout is not reported in the output: %q", stderr.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,224 @@
+package executer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/adamkobi/xt/internal/instance"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/cli/safeexec"
+)
+
+//SSM is a constant describing the SSM Session Manager executer
+const SSM = "ssm"
+
+//ssmPollInterval is the time waited between checks of a command sent with SSM
+var ssmPollInterval = time.Second
+
+//newSSMClient creates the SSM client of an instance, it is replaced in tests
+var newSSMClient = func(inst *instance.XTInstance) (ssmiface.SSMAPI, error) {
+	sess, err := instanceSession(inst)
+	if err != nil {
+		return nil, err
+	}
+	return ssm.New(sess), nil
+}
+
+//instanceSession returns the AWS session inst was found with, or a session using the creds profile and region
+//of the provider that found inst when the provider did not set one
+func instanceSession(inst *instance.XTInstance) (*session.Session, error) {
+	if inst.Session != nil {
+		return inst.Session()
+	}
+	return session.NewSessionWithOptions(session.Options{
+		Config:            aws.Config{Region: aws.String(inst.Region)},
+		Profile:           inst.CredsProfile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+}
+
+//ssmCommandError describes a command sent with SSM that did not succeed
+type ssmCommandError struct {
+	CommandID string
+	Status    string
+	Code      int64
+}
+
+func (e *ssmCommandError) Error() string {
+	return fmt.Sprintf("command %s finished with status %s (exit code %d)", e.CommandID, e.Status, e.Code)
+}
+
+//ssmCommand runs a shell command on an instance with SSM SendCommand
+type ssmCommand struct {
+	inst   *instance.XTInstance
+	script string
+}
+
+//newSSM creates an executer opening an SSM session, or sending the remote command with SSM when one is set
+func newSSM(options *Options) (*Cmd, error) {
+	if err := requireAWS(options.Selected, "the ssm transport"); err != nil {
+		return nil, err
+	}
+
+	if len(options.RemoteCmd) > 0 {
+		return &Cmd{
+			Hostname: options.Selected.Name(),
+			remote:   &ssmCommand{inst: options.Selected, script: strings.Join(options.RemoteCmd, " ")},
+		}, nil
+	}
+
+	awsExe, err := lookPathAWS()
+	if err != nil {
+		return nil, err
+	}
+	env, err := awsEnv(options.Selected)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(awsExe, startSessionArgs(options.Selected)...)
+	cmd.Env = env
+	return &Cmd{
+		Exec:     cmd,
+		Hostname: options.Selected.Name(),
+	}, nil
+}
+
+//requireAWS checks inst was found by the aws provider, which feature requires
+func requireAWS(inst *instance.XTInstance, feature string) error {
+	if inst == nil {
+		return fmt.Errorf("instance must be selected")
+	}
+	if !strings.HasPrefix(inst.InstanceID, "i-") && !strings.HasPrefix(inst.InstanceID, "mi-") {
+		return fmt.Errorf("instance %s has no instance ID, %s requires instances found by the aws provider", inst.Name(), feature)
+	}
+	if inst.Region == "" {
+		return fmt.Errorf("instance %s has no region, %s requires instances found by the aws provider", inst.Name(), feature)
+	}
+	return nil
+}
+
+func lookPathAWS() (string, error) {
+	awsExe, err := safeexec.LookPath("aws")
+	if err != nil {
+		return "", fmt.Errorf("the ssm transport requires the aws CLI and the session manager plugin: %w", err)
+	}
+	return awsExe, nil
+}
+
+//startSessionArgs returns the aws CLI arguments opening an interactive SSM session with inst
+func startSessionArgs(inst *instance.XTInstance) []string {
+	return append([]string{"ssm", "start-session", "--target", inst.InstanceID}, awsArgs(inst)...)
+}
+
+//ssmProxyCommand returns an ssh ProxyCommand tunneling ssh through SSM, the ssh host must be the instance ID
+func ssmProxyCommand(awsExe string, inst *instance.XTInstance) string {
+	args := []string{shellQuote(awsExe), "ssm", "start-session", "--target", "%h",
+		"--document-name", "AWS-StartSSHSession", "--parameters", "portNumber=%p"}
+	for _, a := range awsArgs(inst) {
+		args = append(args, shellQuote(a))
+	}
+	return strings.Join(args, " ")
+}
+
+//awsArgs returns the aws CLI arguments of inst, the creds profile is only passed when awsEnv does not set credentials
+func awsArgs(inst *instance.XTInstance) []string {
+	args := []string{"--region", inst.Region}
+	if inst.Session == nil && inst.CredsProfile != "" {
+		args = append(args, "--profile", inst.CredsProfile)
+	}
+	return args
+}
+
+//awsEnv returns the environment of aws CLI commands reaching inst with the credentials of its session,
+//nil inherits the environment when inst has no session
+func awsEnv(inst *instance.XTInstance) ([]string, error) {
+	if inst.Session == nil {
+		return nil, nil
+	}
+	sess, err := inst.Session()
+	if err != nil {
+		return nil, err
+	}
+	creds, err := sess.Config.Credentials.Get()
+	if err != nil {
+		return nil, fmt.Errorf("reading the credentials of %s: %w", inst.Name(), err)
+	}
+	env := append(os.Environ(),
+		"AWS_ACCESS_KEY_ID="+creds.AccessKeyID,
+		"AWS_SECRET_ACCESS_KEY="+creds.SecretAccessKey,
+		"AWS_SESSION_TOKEN="+creds.SessionToken)
+	return env, nil
+}
+
+//args describes the command for debug output and errors
+func (c *ssmCommand) args() []string {
+	return []string{"ssm", "send-command", c.inst.InstanceID, c.script}
+}
+
+//run sends the command and writes its output once it finished, SSM can not run interactive commands
+func (c *ssmCommand) run(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer) error {
+	out, errOut, err := c.invoke(ctx)
+	_, _ = stdout.Write(out)
+	_, _ = stderr.Write(errOut)
+	return err
+}
+
+//invoke sends the command and waits for it to finish, returning its output.
+//SSM truncates the output it returns to 24000 characters, the command is cancelled once ctx is done.
+func (c *ssmCommand) invoke(ctx context.Context) (stdout, stderr []byte, err error) {
+	client, err := newSSMClient(c.inst)
+	if err != nil {
+		return nil, nil, err
+	}
+	sent, err := client.SendCommand(&ssm.SendCommandInput{
+		DocumentName: aws.String("AWS-RunShellScript"),
+		InstanceIds:  []*string{aws.String(c.inst.InstanceID)},
+		Parameters:   map[string][]*string{"commands": {aws.String(c.script)}},
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("sending command to %s: %w", c.inst.InstanceID, err)
+	}
+
+	input := &ssm.GetCommandInvocationInput{
+		CommandId:  sent.Command.CommandId,
+		InstanceId: aws.String(c.inst.InstanceID),
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			_, _ = client.CancelCommand(&ssm.CancelCommandInput{
+				CommandId:   input.CommandId,
+				InstanceIds: []*string{input.InstanceId},
+			})
+			return nil, nil, ctx.Err()
+		case <-time.After(ssmPollInterval):
+		}
+		out, err := client.GetCommandInvocation(input)
+		if err != nil {
+			//the invocation is not visible right after the command was sent
+			if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ssm.ErrCodeInvocationDoesNotExist {
+				continue
+			}
+			return nil, nil, fmt.Errorf("reading command %s on %s: %w", aws.StringValue(input.CommandId), c.inst.InstanceID, err)
+		}
+
+		switch status := aws.StringValue(out.Status); status {
+		case ssm.CommandInvocationStatusPending, ssm.CommandInvocationStatusInProgress, ssm.CommandInvocationStatusDelayed:
+			continue
+		case ssm.CommandInvocationStatusSuccess:
+			return []byte(aws.StringValue(out.StandardOutputContent)), []byte(aws.StringValue(out.StandardErrorContent)), nil
+		default:
+			return []byte(aws.StringValue(out.StandardOutputContent)), []byte(aws.StringValue(out.StandardErrorContent)),
+				&ssmCommandError{CommandID: aws.StringValue(input.CommandId), Status: status, Code: aws.Int64Value(out.ResponseCode)}
+		}
+	}
+}
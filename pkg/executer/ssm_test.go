@@ -0,0 +1,147 @@
+package executer
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/adamkobi/xt/internal/instance"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+)
+
+//fakeSSM returns the invocations listed in order, repeating the last one
+type fakeSSM struct {
+	ssmiface.SSMAPI
+	sent        *ssm.SendCommandInput
+	invocations []*ssm.GetCommandInvocationOutput
+	polls       int
+}
+
+func (f *fakeSSM) SendCommand(input *ssm.SendCommandInput) (*ssm.SendCommandOutput, error) {
+	f.sent = input
+	return &ssm.SendCommandOutput{Command: &ssm.Command{CommandId: aws.String("cmd-1")}}, nil
+}
+
+func (f *fakeSSM) GetCommandInvocation(input *ssm.GetCommandInvocationInput) (*ssm.GetCommandInvocationOutput, error) {
+	f.polls++
+	if f.polls == 1 {
+		return nil, awserr.New(ssm.ErrCodeInvocationDoesNotExist, "not yet", nil)
+	}
+	idx := f.polls - 2
+	if idx >= len(f.invocations) {
+		idx = len(f.invocations) - 1
+	}
+	return f.invocations[idx], nil
+}
+
+func invocation(status, stdout, stderr string, code int64) *ssm.GetCommandInvocationOutput {
+	return &ssm.GetCommandInvocationOutput{
+		Status:                aws.String(status),
+		StandardOutputContent: aws.String(stdout),
+		StandardErrorContent:  aws.String(stderr),
+		ResponseCode:          aws.Int64(code),
+	}
+}
+
+func TestSSMCommand(t *testing.T) {
+	ssmPollInterval = 0
+	inst := &instance.XTInstance{InstanceName: "web-1", InstanceID: "i-0001", Region: "us-east-1", CredsProfile: "prod"}
+	tests := []struct {
+		name        string
+		invocations []*ssm.GetCommandInvocationOutput
+		wantOut     string
+		wantErr     string
+	}{
+		{
+			"success",
+			[]*ssm.GetCommandInvocationOutput{invocation(ssm.CommandInvocationStatusInProgress, "", "", -1), invocation(ssm.CommandInvocationStatusSuccess, "up 3 days\n", "", 0)},
+			"up 3 days\n",
+			"",
+		},
+		{
+			"failure",
+			[]*ssm.GetCommandInvocationOutput{invocation(ssm.CommandInvocationStatusFailed, "", "no such file\n", 2)},
+			"",
+			"no such file\nssm: command cmd-1 finished with status Failed (exit code 2)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeSSM{invocations: tt.invocations}
+			newSSMClient = func(*instance.XTInstance) (ssmiface.SSMAPI, error) { return fake, nil }
+
+			e, err := New(&Options{Selected: inst, Binary: SSH, Transport: "ssm", RemoteCmd: []string{"uptime", "-p"}})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			out, err := e.Output()
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("got error %v, want %s", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(out) != tt.wantOut {
+				t.Errorf("got output %q, want %q", out, tt.wantOut)
+			}
+			if got := aws.StringValue(fake.sent.Parameters["commands"][0]); got != "uptime -p" {
+				t.Errorf("sent %q, want uptime -p", got)
+			}
+		})
+	}
+}
+
+func TestSSMArgs(t *testing.T) {
+	inst := &instance.XTInstance{InstanceID: "i-0001", Region: "eu-west-1", CredsProfile: "prod"}
+	want := []string{"ssm", "start-session", "--target", "i-0001", "--region", "eu-west-1", "--profile", "prod"}
+	if got := startSessionArgs(inst); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	proxy := ssmProxyCommand("/usr/local/bin/aws", inst)
+	wantProxy := "/usr/local/bin/aws ssm start-session --target %h --document-name AWS-StartSSHSession --parameters portNumber=%p --region eu-west-1 --profile prod"
+	if proxy != wantProxy {
+		t.Errorf("got %s, want %s", proxy, wantProxy)
+	}
+
+	if _, err := New(&Options{Selected: &instance.XTInstance{InstanceName: "web-1"}, Binary: SSM}); err == nil ||
+		!strings.Contains(err.Error(), "aws provider") {
+		t.Errorf("expected error for an instance not found by the aws provider, got %v", err)
+	}
+}
+
+func TestSSMInstanceSession(t *testing.T) {
+	sess := session.Must(session.NewSession(aws.NewConfig().
+		WithRegion("eu-west-1").
+		WithCredentials(credentials.NewStaticCredentials("ASIAROLE", "SECRET", "TOKEN"))))
+	inst := &instance.XTInstance{
+		InstanceID:   "i-0001",
+		Region:       "eu-west-1",
+		CredsProfile: "prod",
+		Session:      func() (*session.Session, error) { return sess, nil },
+	}
+
+	got, err := instanceSession(inst)
+	if err != nil || got != sess {
+		t.Fatalf("got session %v, %v, want the session of the instance", got, err)
+	}
+	want := []string{"ssm", "start-session", "--target", "i-0001", "--region", "eu-west-1"}
+	if args := startSessionArgs(inst); !reflect.DeepEqual(args, want) {
+		t.Errorf("got %q, want %q without the creds profile", args, want)
+	}
+	env, err := awsEnv(inst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"AWS_ACCESS_KEY_ID=ASIAROLE", "AWS_SECRET_ACCESS_KEY=SECRET", "AWS_SESSION_TOKEN=TOKEN"} {
+		if env[len(env)-3] != v && env[len(env)-2] != v && env[len(env)-1] != v {
+			t.Errorf("environment is missing %s", v)
+		}
+	}
+}
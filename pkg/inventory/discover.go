@@ -0,0 +1,185 @@
+package inventory
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/adamkobi/xt/internal/cache"
+	"github.com/adamkobi/xt/internal/instance"
+	"github.com/adamkobi/xt/pkg/provider"
+)
+
+//Failure describes a provider that failed to return instances
+type Failure struct {
+	Options *provider.Options
+	Err     error
+}
+
+func (f *Failure) Error() string {
+	return fmt.Sprintf("%s provider %s failed: %s", f.Options.Name, location(f.Options), f.Err)
+}
+
+func (f *Failure) Unwrap() error {
+	return f.Err
+}
+
+//location returns a human readable description of where a provider looks for instances
+func location(o *provider.Options) string {
+	switch {
+	case o.Region != "" && o.CredsProfile != "":
+		return fmt.Sprintf("%s/%s", o.CredsProfile, o.Region)
+	case o.Region != "":
+		return o.Region
+	case o.Settings["path"] != "":
+		return o.Settings["path"]
+	default:
+		return o.Name
+	}
+}
+
+//cacheKey returns the key provider results are cached by
+func cacheKey(profile string, o *provider.Options) cache.Key {
+	var roles []string
+	for _, r := range o.Roles {
+		roles = append(roles, r.ARN)
+	}
+	var q string
+	if o.Query != nil {
+		q = o.Query.String()
+	}
+	key := cache.Key{
+		Profile:       profile,
+		Provider:      o.Name,
+		Region:        o.Region,
+		CredsProfile:  o.CredsProfile,
+		VPC:           o.VPC,
+		Tag:           o.Tag,
+		SearchPattern: o.SearchPattern,
+		Query:         q,
+		Filters:       o.Filters,
+		States:        o.States,
+		MaxInstances:  o.MaxInstances,
+		Endpoint:      o.Endpoint,
+		Credentials:   credentialsID(o.AccessKeyID),
+		Roles:         roles,
+		Settings:      o.Settings,
+	}
+	if a := o.Accounts; a != nil {
+		key.Organization = a.Organization
+		key.AccountIDs = a.IDs
+		key.ExcludeAccounts = a.Exclude
+		key.AccountRole = a.RoleName
+	}
+	return key
+}
+
+//credentialsID returns a hash identifying the static credentials of accessKeyID so results of
+//different credentials are cached apart without writing the access key to disk
+func credentialsID(accessKeyID string) string {
+	if accessKeyID == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(accessKeyID))
+	return hex.EncodeToString(sum[:])
+}
+
+//discover queries all providers concurrently and merges the instances they return.
+//Results are read from the cache unless refresh is requested.
+//In strict mode the first failure is returned as error as soon as it happens, providers that did not
+//start their query yet are skipped and the results of queries still running are discarded.
+//Otherwise the failed providers are returned alongside the instances of the providers that answered,
+//including the instances of providers that failed to search only part of their accounts.
+//An error is always returned when no provider answered.
+func discover(providers []*provider.Options, opts *Options, c *cache.Cache) (instance.XTInstances, []*Failure, error) {
+	type result struct {
+		idx       int
+		instances instance.XTInstances
+		err       error
+	}
+	//buffered so providers still running after a strict failure do not block
+	done := make(chan result, len(providers))
+	stop := make(chan struct{})
+	defer close(stop)
+
+	for idx, p := range providers {
+		go func(idx int, p *provider.Options) {
+			instances, err := get(p, opts, c, stop)
+			done <- result{idx: idx, instances: instances, err: err}
+		}(idx, p)
+	}
+
+	results := make([]instance.XTInstances, len(providers))
+	errs := make([]error, len(providers))
+	for range providers {
+		r := <-done
+		if r.err != nil && opts.Strict {
+			return nil, nil, &Failure{Options: providers[r.idx], Err: r.err}
+		}
+		results[r.idx], errs[r.idx] = r.instances, r.err
+	}
+
+	var (
+		instances instance.XTInstances
+		failures  []*Failure
+		answered  int
+	)
+	for idx, p := range providers {
+		if errs[idx] != nil {
+			failures = append(failures, &Failure{Options: p, Err: errs[idx]})
+		}
+		if results[idx] != nil || errs[idx] == nil {
+			answered++
+		}
+		instances = append(instances, results[idx]...)
+	}
+
+	if len(providers) > 0 && answered == 0 {
+		return nil, nil, failures[0]
+	}
+	return instances, failures, nil
+}
+
+//errStopped is returned by providers skipped once strict discovery failed
+var errStopped = errors.New("discovery stopped")
+
+func stopped(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+//get returns the instances of p, the query is skipped once stop is closed
+func get(p *provider.Options, opts *Options, c *cache.Cache, stop <-chan struct{}) (instance.XTInstances, error) {
+	if stopped(stop) {
+		return nil, errStopped
+	}
+	key := cacheKey(opts.Profile, p)
+	if !opts.Refresh {
+		if instances, ok := c.Get(key); ok {
+			provider.SetSessions(p, instances)
+			return instances, nil
+		}
+	}
+
+	svc, err := provider.New(p)
+	if err != nil {
+		return nil, err
+	}
+	//creating a provider may assume roles and list accounts, check again before querying
+	if stopped(stop) {
+		return nil, errStopped
+	}
+	instances, err := svc.Get()
+	if err != nil {
+		//partial results are not cached so the failure is retried
+		return instances, err
+	}
+	// a failing cache must never fail discovery
+	_ = c.Set(key, instances)
+	return instances, nil
+}
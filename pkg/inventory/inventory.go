@@ -0,0 +1,236 @@
+package inventory
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/adamkobi/xt/internal/cache"
+	"github.com/adamkobi/xt/internal/config"
+	"github.com/adamkobi/xt/internal/instance"
+	"github.com/adamkobi/xt/pkg/iostreams"
+	"github.com/adamkobi/xt/pkg/provider"
+	"github.com/adamkobi/xt/pkg/query"
+	"github.com/spf13/pflag"
+)
+
+//AllStates disables filtering instances by state
+const AllStates = "all"
+
+//Options describes which instances to discover, they are shared by all commands
+type Options struct {
+	Profile       string
+	Tag           string
+	SearchPattern string
+	//Query replaces SearchPattern when searching by expression
+	Query   query.Expr
+	Filters map[string]string
+	States  []string
+	Strict  bool
+	Refresh bool
+	NoLogin bool
+	//Transport overrides the transport of the profile
+	Transport string
+}
+
+//ParseFlags reads the global discovery flags
+func (o *Options) ParseFlags(flags *pflag.FlagSet) error {
+	o.Profile, _ = flags.GetString("profile")
+	o.Tag, _ = flags.GetString("tag")
+	o.Strict, _ = flags.GetBool("strict")
+	o.Refresh, _ = flags.GetBool("refresh")
+	o.NoLogin, _ = flags.GetBool("no-login")
+	o.Transport, _ = flags.GetString("transport")
+	if o.Transport != "" {
+		if err := config.ValidateTransport(o.Transport); err != nil {
+			return err
+		}
+	}
+
+	o.States, _ = flags.GetStringSlice("state")
+	if len(o.States) == 1 && o.States[0] == AllStates {
+		o.States = nil
+	}
+
+	filters, _ := flags.GetStringArray("filter")
+	var err error
+	o.Filters, err = ParseFilters(filters)
+	return err
+}
+
+//instanceIDPattern matches EC2 instance IDs
+var instanceIDPattern = regexp.MustCompile(`^i-([0-9a-f]{8}|[0-9a-f]{17})$`)
+
+//ParseSearch reads the search argument of a command, either a name prefix, an instance ID, an IP address or a query
+func (o *Options) ParseSearch(search string) error {
+	switch {
+	case instanceIDPattern.MatchString(search):
+		search = "id=" + search
+	case net.ParseIP(search) != nil:
+		search = "ip=" + search
+	case !query.IsQuery(search):
+		o.SearchPattern = strings.TrimSuffix(search, "*")
+		return nil
+	}
+	expr, err := query.Parse(search)
+	if err != nil {
+		return fmt.Errorf("invalid query %q: %w", search, err)
+	}
+	o.Query = expr
+	o.SearchPattern = ""
+	return nil
+}
+
+//ParseFilters converts key=value pairs to filters
+func ParseFilters(pairs []string) (map[string]string, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	filters := make(map[string]string)
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid filter %q, expected key=value", pair)
+		}
+		filters[parts[0]] = parts[1]
+	}
+	return filters, nil
+}
+
+//mergeFilters returns profile filters overridden by the filters requested on command line
+func mergeFilters(profile, flags map[string]string) map[string]string {
+	if len(profile) == 0 && len(flags) == 0 {
+		return nil
+	}
+	filters := make(map[string]string)
+	for k, v := range profile {
+		filters[k] = v
+	}
+	for k, v := range flags {
+		filters[k] = v
+	}
+	return filters
+}
+
+//Service discovers the instances of a profile using all of its providers
+type Service struct {
+	IO       *iostreams.IOStreams
+	Config   func() (*config.Config, error)
+	CacheDir string
+}
+
+//New creates a new inventory service
+func New(io *iostreams.IOStreams, cfg func() (*config.Config, error)) *Service {
+	return &Service{
+		IO:       io,
+		Config:   cfg,
+		CacheDir: cache.DefaultDir(),
+	}
+}
+
+//Discover prints the profile message and returns the profile with the instances found by its providers.
+//Failed providers are printed as warnings unless running in strict mode.
+func (s *Service) Discover(opts *Options) (*config.ProfileOptions, instance.XTInstances, error) {
+	cfg, err := s.Config()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	profile, err := cfg.Profile(opts.Profile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cs := s.IO.ColorScheme()
+	if profile.DisplayMsg != "" {
+		fmt.Fprint(s.IO.ErrOut, cs.Red(profile.Message()))
+	}
+
+	ttl, err := profile.CacheDuration()
+	if err != nil {
+		return nil, nil, err
+	}
+	c := &cache.Cache{Dir: s.CacheDir, TTL: ttl}
+
+	providers, err := Providers(profile, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, p := range providers {
+		p.LoginOutput = s.IO.ErrOut
+		p.Warn = func(message string) {
+			fmt.Fprintf(s.IO.ErrOut, "%s %s\n", cs.WarningIcon(), message)
+		}
+	}
+	instances, failures, err := discover(providers, opts, c)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, f := range failures {
+		fmt.Fprintf(s.IO.ErrOut, "%s %s\n", cs.WarningIcon(), f)
+	}
+	if opts.Query != nil {
+		instances = query.Filter(opts.Query, instances)
+		if len(instances) == 0 {
+			return nil, nil, fmt.Errorf("no instances match %s", opts.Query)
+		}
+	}
+	return profile, instances, nil
+}
+
+//Providers returns the options of every provider in profile
+func Providers(profile *config.ProfileOptions, opts *Options) ([]*provider.Options, error) {
+	var providers []*provider.Options
+	for _, p := range profile.ProviderOptions {
+		id, secret, token, err := p.StaticCredentials()
+		if err != nil {
+			return nil, fmt.Errorf("%s provider static credentials: %w", p.Name, err)
+		}
+		var roles []provider.Role
+		for _, r := range p.Roles() {
+			roles = append(roles, provider.Role{
+				ARN:         r.RoleARN,
+				ExternalID:  r.ExternalID,
+				MFASerial:   r.MFASerial,
+				SessionName: r.SessionName,
+			})
+		}
+		var accounts *provider.Accounts
+		if a := p.Accounts; a != nil {
+			accounts = &provider.Accounts{
+				Organization: a.Organization,
+				IDs:          a.IDs,
+				Exclude:      a.Exclude,
+				RoleName:     a.RoleName,
+				ExternalID:   a.ExternalID,
+				SessionName:  a.SessionName,
+			}
+		}
+		providers = append(providers, &provider.Options{
+			Name:            p.Name,
+			VPC:             p.VPC,
+			Region:          p.Region,
+			CredsProfile:    p.CredsProfile,
+			AccessKeyID:     id,
+			SecretAccessKey: secret,
+			SessionToken:    token,
+			Roles:           roles,
+			Accounts:        accounts,
+			Tag:             opts.Tag,
+			SearchPattern:   opts.SearchPattern,
+			Query:           opts.Query,
+			Filters:         mergeFilters(p.Filters, opts.Filters),
+			States:          opts.States,
+			PageSize:        p.PageSize,
+			MaxInstances:    p.MaxInstances,
+			Endpoint:        p.Endpoint,
+			Insecure:        p.Insecure,
+			DisableSSL:      p.DisableSSL,
+			SigningRegion:   p.SigningRegion,
+			NoLogin:         opts.NoLogin,
+			Settings:        p.Settings,
+		})
+	}
+	return providers, nil
+}
@@ -0,0 +1,442 @@
+package inventory
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adamkobi/xt/internal/cache"
+	"github.com/adamkobi/xt/internal/config"
+	"github.com/adamkobi/xt/internal/instance"
+	"github.com/adamkobi/xt/pkg/iostreams"
+	"github.com/adamkobi/xt/pkg/provider"
+)
+
+//fakeBackend holds the instances returned by fake providers, keyed by region
+var fakeBackend = struct {
+	sync.Mutex
+	instances map[string]instance.XTInstances
+	errors    map[string]error
+	//partial regions return their instances with their error
+	partial map[string]bool
+	//delays slow down the queries of regions
+	delays  map[string]time.Duration
+	options []*provider.Options
+}{}
+
+type fakeProvider struct {
+	opts *provider.Options
+}
+
+func (p *fakeProvider) Get() (instance.XTInstances, error) {
+	fakeBackend.Lock()
+	delay := fakeBackend.delays[p.opts.Region]
+	fakeBackend.Unlock()
+	time.Sleep(delay)
+
+	fakeBackend.Lock()
+	defer fakeBackend.Unlock()
+	fakeBackend.options = append(fakeBackend.options, p.opts)
+	err := fakeBackend.errors[p.opts.Region]
+	if err != nil && !fakeBackend.partial[p.opts.Region] {
+		return nil, err
+	}
+	instances := instance.XTInstances{}
+	for _, inst := range fakeBackend.instances[p.opts.Region] {
+		if strings.HasPrefix(inst.InstanceName, p.opts.SearchPattern) {
+			instances = append(instances, inst)
+		}
+	}
+	return instances, err
+}
+
+func init() {
+	provider.Register("fake", func(opts *provider.Options) (provider.Provider, error) {
+		return &fakeProvider{opts: opts}, nil
+	})
+}
+
+func setupBackend(instances map[string]instance.XTInstances, errs map[string]error) {
+	fakeBackend.Lock()
+	defer fakeBackend.Unlock()
+	fakeBackend.instances = instances
+	fakeBackend.errors = errs
+	fakeBackend.partial = nil
+	fakeBackend.delays = nil
+	fakeBackend.options = nil
+}
+
+//setPartial makes regions return their instances with their error
+func setPartial(regions ...string) {
+	fakeBackend.Lock()
+	defer fakeBackend.Unlock()
+	fakeBackend.partial = make(map[string]bool)
+	for _, r := range regions {
+		fakeBackend.partial[r] = true
+	}
+}
+
+//setDelay slows down the queries of region
+func setDelay(region string, delay time.Duration) {
+	fakeBackend.Lock()
+	defer fakeBackend.Unlock()
+	if fakeBackend.delays == nil {
+		fakeBackend.delays = make(map[string]time.Duration)
+	}
+	fakeBackend.delays[region] = delay
+}
+
+func queried() []*provider.Options {
+	fakeBackend.Lock()
+	defer fakeBackend.Unlock()
+	return fakeBackend.options
+}
+
+func testService(t *testing.T, profile config.ProfileOptions) (*Service, *bytes.Buffer) {
+	t.Helper()
+	io, _, _, stderr := iostreams.Test()
+	cacheDir, err := ioutil.TempDir("", "xt-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(cacheDir) })
+
+	cfg := &config.Config{
+		ProfileOptions: map[string]config.ProfileOptions{"test": profile},
+	}
+	return &Service{
+		IO:       io,
+		Config:   func() (*config.Config, error) { return cfg, nil },
+		CacheDir: cacheDir,
+	}, stderr
+}
+
+func testProfile(regions ...string) config.ProfileOptions {
+	profile := config.ProfileOptions{
+		SSHOptions: config.SSHOptions{User: "user", Domain: ".example.com"},
+	}
+	for _, r := range regions {
+		profile.ProviderOptions = append(profile.ProviderOptions, config.ProviderOptions{
+			Name:    "fake",
+			Region:  r,
+			Filters: map[string]string{"env": "test"},
+		})
+	}
+	return profile
+}
+
+var testInstances = map[string]instance.XTInstances{
+	"us-east-1":  {{InstanceName: "web-1"}, {InstanceName: "db-1"}},
+	"eu-west-1":  {{InstanceName: "web-2"}},
+	"ap-south-1": {{InstanceName: "web-3"}},
+}
+
+func TestDiscover(t *testing.T) {
+	tests := []struct {
+		name         string
+		regions      []string
+		errs         map[string]error
+		partial      []string
+		strict       bool
+		want         []string
+		wantErr      bool
+		wantWarnings []string
+	}{
+		{
+			name:    "merges all providers",
+			regions: []string{"us-east-1", "eu-west-1", "ap-south-1"},
+			want:    []string{"web-1", "web-2", "web-3"},
+		},
+		{
+			name:         "continues when a provider fails",
+			regions:      []string{"us-east-1", "eu-west-1", "ap-south-1"},
+			errs:         map[string]error{"eu-west-1": errors.New("region unavailable")},
+			want:         []string{"web-1", "web-3"},
+			wantWarnings: []string{"fake provider eu-west-1 failed: region unavailable"},
+		},
+		{
+			name:         "keeps the instances of partially failed providers",
+			regions:      []string{"us-east-1", "eu-west-1"},
+			errs:         map[string]error{"eu-west-1": errors.New("accounts 222222222222 failed")},
+			partial:      []string{"eu-west-1"},
+			want:         []string{"web-1", "web-2"},
+			wantWarnings: []string{"fake provider eu-west-1 failed: accounts 222222222222 failed"},
+		},
+		{
+			name:    "strict fails when a provider partially fails",
+			regions: []string{"us-east-1", "eu-west-1"},
+			errs:    map[string]error{"eu-west-1": errors.New("accounts 222222222222 failed")},
+			partial: []string{"eu-west-1"},
+			strict:  true,
+			wantErr: true,
+		},
+		{
+			name:    "strict fails when a provider fails",
+			regions: []string{"us-east-1", "eu-west-1"},
+			errs:    map[string]error{"eu-west-1": errors.New("region unavailable")},
+			strict:  true,
+			wantErr: true,
+		},
+		{
+			name:    "fails when all providers fail",
+			regions: []string{"us-east-1", "eu-west-1"},
+			errs: map[string]error{
+				"us-east-1": errors.New("region unavailable"),
+				"eu-west-1": errors.New("region unavailable"),
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupBackend(testInstances, tt.errs)
+			setPartial(tt.partial...)
+			svc, stderr := testService(t, testProfile(tt.regions...))
+
+			_, instances, err := svc.Discover(&Options{
+				Profile:       "test",
+				Tag:           "Name",
+				SearchPattern: "web",
+				Strict:        tt.strict,
+			})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := instances.Names(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			for _, w := range tt.wantWarnings {
+				if !strings.Contains(stderr.String(), w) {
+					t.Errorf("expected warning %q, got %q", w, stderr.String())
+				}
+			}
+		})
+	}
+}
+
+func TestDiscoverStrictFailFast(t *testing.T) {
+	setupBackend(testInstances, map[string]error{"eu-west-1": errors.New("region unavailable")})
+	setDelay("us-east-1", 5*time.Second)
+	svc, _ := testService(t, testProfile("us-east-1", "eu-west-1"))
+
+	start := time.Now()
+	_, _, err := svc.Discover(&Options{Profile: "test", Tag: "Name", SearchPattern: "web", Strict: true})
+	var failure *Failure
+	if !errors.As(err, &failure) || failure.Options.Region != "eu-west-1" {
+		t.Fatalf("got error %v, want the failure of eu-west-1", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("strict discovery took %s, want it to return on the first failure", elapsed)
+	}
+}
+
+func TestDiscoverQuery(t *testing.T) {
+	setupBackend(testInstances, nil)
+	svc, _ := testService(t, testProfile("us-east-1", "eu-west-1", "ap-south-1"))
+
+	opts := &Options{Profile: "test", Tag: "Name"}
+	if err := opts.ParseSearch("name=web-* AND NOT (name=web-2 OR name=db-*)"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, instances, err := svc.Discover(opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, want := instances.Names(), []string{"web-1", "web-3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if err := opts.ParseSearch("name=mail-*"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, _, err := svc.Discover(opts); err == nil {
+		t.Error("expected error when no instance matches the query")
+	}
+}
+
+func TestParseSearch(t *testing.T) {
+	opts := &Options{}
+	if err := opts.ParseSearch("web*"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if opts.SearchPattern != "web" || opts.Query != nil {
+		t.Errorf("expected name prefix search, got pattern %q and query %v", opts.SearchPattern, opts.Query)
+	}
+	if err := opts.ParseSearch("role=web AND"); err == nil {
+		t.Error("expected error for invalid query")
+	}
+
+	tests := []struct {
+		search string
+		want   string
+	}{
+		{"i-0abc1234", "id=i-0abc1234"},
+		{"i-0123456789abcdef0", "id=i-0123456789abcdef0"},
+		{"10.0.1.10", "ip=10.0.1.10"},
+		{"2001:db8::1", "ip=2001:db8::1"},
+	}
+	for _, tt := range tests {
+		opts := &Options{}
+		if err := opts.ParseSearch(tt.search); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if opts.Query == nil || opts.Query.String() != tt.want {
+			t.Errorf("ParseSearch(%q) got query %v, want %s", tt.search, opts.Query, tt.want)
+		}
+	}
+}
+
+func TestDiscoverProviderOptions(t *testing.T) {
+	setupBackend(testInstances, nil)
+	profile := testProfile("us-east-1")
+	profile.ProviderOptions[0].VPC = "vpc-1"
+	profile.ProviderOptions[0].CredsProfile = "dev"
+	profile.ProviderOptions[0].Settings = map[string]string{"key": "value"}
+	svc, _ := testService(t, profile)
+
+	opts := &Options{
+		Profile:       "test",
+		Tag:           "role",
+		SearchPattern: "web",
+		Filters:       map[string]string{"env": "prod", "availability-zone": "us-east-1a"},
+	}
+	if _, _, err := svc.Discover(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got := queried()
+	if len(got) != 1 {
+		t.Fatalf("expected 1 provider query, got %d", len(got))
+	}
+	if got[0].Warn == nil {
+		t.Error("expected providers to receive a warning func")
+	}
+	got[0].Warn = nil
+	want := &provider.Options{
+		Name:          "fake",
+		VPC:           "vpc-1",
+		Region:        "us-east-1",
+		CredsProfile:  "dev",
+		Tag:           "role",
+		SearchPattern: "web",
+		Filters:       map[string]string{"env": "prod", "availability-zone": "us-east-1a"},
+		Settings:      map[string]string{"key": "value"},
+		LoginOutput:   svc.IO.ErrOut,
+	}
+	if !reflect.DeepEqual(got[0], want) {
+		t.Errorf("got %+v, want %+v", got[0], want)
+	}
+}
+
+func TestProvidersCredentials(t *testing.T) {
+	os.Setenv("XT_TEST_KEY_ID", "AKIDTEST")
+	os.Setenv("XT_TEST_SECRET", "SECRETTEST")
+	defer os.Unsetenv("XT_TEST_KEY_ID")
+	defer os.Unsetenv("XT_TEST_SECRET")
+
+	profile := testProfile("us-east-1")
+	p := &profile.ProviderOptions[0]
+	p.AccessKeyIDEnv = "XT_TEST_KEY_ID"
+	p.SecretAccessKeyEnv = "XT_TEST_SECRET"
+	p.RoleChain = []config.RoleOptions{{RoleARN: "arn:aws:iam::111111111111:role/hub"}}
+	p.RoleARN = "arn:aws:iam::222222222222:role/spoke"
+	p.ExternalID = "ext"
+
+	providers, err := Providers(&profile, &Options{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got := providers[0]
+	if got.AccessKeyID != "AKIDTEST" || got.SecretAccessKey != "SECRETTEST" {
+		t.Errorf("got credentials %s/%s from environment", got.AccessKeyID, got.SecretAccessKey)
+	}
+	wantRoles := []provider.Role{
+		{ARN: "arn:aws:iam::111111111111:role/hub"},
+		{ARN: "arn:aws:iam::222222222222:role/spoke", ExternalID: "ext"},
+	}
+	if !reflect.DeepEqual(got.Roles, wantRoles) {
+		t.Errorf("got roles %+v, want %+v", got.Roles, wantRoles)
+	}
+
+	p.SecretAccessKeyEnv = "XT_TEST_MISSING"
+	if _, err := Providers(&profile, &Options{}); err == nil || !strings.Contains(err.Error(), "XT_TEST_MISSING") {
+		t.Errorf("expected missing environment variable error, got %v", err)
+	}
+}
+
+func TestParseFilters(t *testing.T) {
+	got, err := ParseFilters([]string{"env=prod", "tag:team=a=b"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := map[string]string{"env": "prod", "tag:team": "a=b"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if _, err := ParseFilters([]string{"env"}); err == nil {
+		t.Error("expected error for filter without value")
+	}
+}
+
+func TestDiscoverCache(t *testing.T) {
+	setupBackend(testInstances, nil)
+	profile := testProfile("us-east-1")
+	profile.CacheTTL = "1h"
+	svc, _ := testService(t, profile)
+	opts := &Options{Profile: "test", Tag: "Name", SearchPattern: "web"}
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := svc.Discover(opts); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if n := len(queried()); n != 1 {
+		t.Errorf("expected cached results on second discovery, provider queried %d times", n)
+	}
+
+	opts.Refresh = true
+	if _, _, err := svc.Discover(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := len(queried()); n != 2 {
+		t.Errorf("expected refresh to query provider, provider queried %d times", n)
+	}
+}
+
+func TestCacheKeyCredentials(t *testing.T) {
+	key := func(accessKeyID string) cache.Key {
+		return cacheKey("test", &provider.Options{Name: "aws", Region: "us-east-1", AccessKeyID: accessKeyID})
+	}
+	first, second := key("AKIDFIRST"), key("AKIDSECOND")
+	if reflect.DeepEqual(first, second) {
+		t.Error("got the same key for different credentials")
+	}
+	if !reflect.DeepEqual(first, key("AKIDFIRST")) {
+		t.Error("got different keys for the same credentials")
+	}
+	data, err := json.Marshal(first)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Contains(string(data), "AKIDFIRST") {
+		t.Errorf("cache key %s contains the access key", data)
+	}
+	if got := key(""); got.Credentials != "" {
+		t.Errorf("got credentials %q without static credentials, want none", got.Credentials)
+	}
+}
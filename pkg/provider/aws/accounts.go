@@ -0,0 +1,197 @@
+package aws
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/adamkobi/xt/internal/instance"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/organizations"
+)
+
+//Accounts selects the accounts instances are discovered in, RoleName is assumed in each of them
+type Accounts struct {
+	//Organization lists the active member accounts of the organization
+	Organization bool
+	//IDs are searched in addition to the organization accounts
+	IDs []string
+	//Exclude are never searched
+	Exclude     []string
+	RoleName    string
+	ExternalID  string
+	SessionName string
+}
+
+type account struct {
+	ID string
+	//Name is the organization account name, used when the account has no alias
+	Name string
+}
+
+func (a *Accounts) validate() error {
+	if a.RoleName == "" {
+		return fmt.Errorf(notSetError, "profile.provider.accounts.role-name")
+	}
+	if !a.Organization && len(a.IDs) == 0 {
+		return fmt.Errorf("profile.provider.accounts must set organization or ids")
+	}
+	return nil
+}
+
+//listAccounts returns the accounts to search sorted by ID
+func listAccounts(sess *session.Session, opts *Accounts, backend *Backend) ([]account, error) {
+	accounts := make(map[string]account)
+	for _, id := range opts.IDs {
+		accounts[id] = account{ID: id}
+	}
+
+	if opts.Organization {
+		input := &organizations.ListAccountsInput{}
+		err := backend.Organizations(sess).ListAccountsPages(input, func(page *organizations.ListAccountsOutput, last bool) bool {
+			for _, a := range page.Accounts {
+				if aws.StringValue(a.Status) != organizations.AccountStatusActive {
+					continue
+				}
+				id := aws.StringValue(a.Id)
+				accounts[id] = account{ID: id, Name: aws.StringValue(a.Name)}
+			}
+			return true
+		})
+		if err != nil {
+			return nil, fmt.Errorf("listing organization accounts: %w", err)
+		}
+	}
+
+	for _, id := range opts.Exclude {
+		delete(accounts, id)
+	}
+
+	list := make([]account, 0, len(accounts))
+	for _, a := range accounts {
+		list = append(list, a)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list, nil
+}
+
+//roleARN returns the ARN of the role assumed in account
+func (a *Accounts) roleARN(id string) string {
+	return fmt.Sprintf("arn:aws:iam::%s:role/%s", id, a.RoleName)
+}
+
+//AccountsError describes the accounts instances could not be discovered in,
+//it is returned with the instances of the other accounts
+type AccountsError struct {
+	//Errors are keyed by account ID
+	Errors map[string]error
+}
+
+//IDs returns the IDs of the failed accounts in order
+func (e *AccountsError) IDs() []string {
+	var ids []string
+	for id := range e.Errors {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (e *AccountsError) Error() string {
+	ids := e.IDs()
+	var msgs []string
+	for _, id := range ids {
+		msgs = append(msgs, e.Errors[id].Error())
+	}
+	return fmt.Sprintf("accounts %s failed: %s", strings.Join(ids, ", "), strings.Join(msgs, "; "))
+}
+
+//Unwrap returns the error of the first failed account
+func (e *AccountsError) Unwrap() error {
+	return e.Errors[e.IDs()[0]]
+}
+
+//maxAccountSearches limits the accounts searched at once, organizations may have hundreds of accounts
+const maxAccountSearches = 10
+
+//getAccounts discovers instances in all accounts concurrently, up to maxAccountSearches at once.
+//When only some accounts fail the instances of the other accounts are returned with an *AccountsError.
+func (p *Provider) getAccounts() (instance.XTInstances, error) {
+	results := make([]instance.XTInstances, len(p.accounts))
+	errs := make([]error, len(p.accounts))
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, maxAccountSearches)
+	for idx, a := range p.accounts {
+		wg.Add(1)
+		go func(idx int, a account) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			results[idx], errs[idx] = p.getAccount(a)
+		}(idx, a)
+	}
+	wg.Wait()
+
+	instances := instance.XTInstances{}
+	failed := &AccountsError{Errors: make(map[string]error)}
+	for idx, a := range p.accounts {
+		if errs[idx] != nil {
+			failed.Errors[a.ID] = errs[idx]
+			continue
+		}
+		instances = append(instances, results[idx]...)
+	}
+	if max := p.Options.MaxInstances; max > 0 && len(instances) > max {
+		p.Options.warn("%d instances match across %d accounts, showing the first %d in account ID order, narrow the search or raise max-instances",
+			len(instances), len(p.accounts)-len(failed.Errors), max)
+		instances = instances[:max]
+	}
+
+	switch len(failed.Errors) {
+	case 0:
+		return instances, nil
+	case len(p.accounts):
+		return nil, failed
+	default:
+		return instances, failed
+	}
+}
+
+func (p *Provider) getAccount(a account) (instance.XTInstances, error) {
+	sess, err := p.sessions.account(a.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	instances, truncated, err := p.describe(p.backend.EC2(sess, p.Options.config()))
+	if truncated {
+		p.Options.warn("account %s: more than %d instances match, showing the first %d, narrow the search or raise max-instances",
+			a.ID, p.Options.MaxInstances, p.Options.MaxInstances)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("account %s: %w", a.ID, err)
+	}
+
+	alias := accountAlias(sess, p.backend)
+	if alias == "" {
+		alias = a.Name
+	}
+	for idx := range instances {
+		instances[idx].AccountID = a.ID
+		instances[idx].AccountAlias = alias
+	}
+	return instances, nil
+}
+
+//accountAlias returns the IAM alias of the account of sess, aliases are optional so errors are ignored
+func accountAlias(sess *session.Session, backend *Backend) string {
+	res, err := backend.IAM(sess).ListAccountAliases(&iam.ListAccountAliasesInput{})
+	if err != nil || len(res.AccountAliases) == 0 {
+		return ""
+	}
+	return aws.StringValue(res.AccountAliases[0])
+}
@@ -1,18 +1,40 @@
 package aws
 
 import (
-	"os/exec"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/adamkobi/xt/internal/instance"
+	"github.com/adamkobi/xt/pkg/query"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/iam/iamiface"
+	"github.com/aws/aws-sdk-go/service/organizations"
+	"github.com/aws/aws-sdk-go/service/organizations/organizationsiface"
 )
 
 //Provider describes AWS configs
 type Provider struct {
-	Client  *ec2.EC2
+	Client  ec2iface.EC2API
 	Options Options
+
+	//accounts are searched instead of Client when discovering across accounts
+	accounts []account
+	backend  *Backend
+	//sessions are shared with the instances found
+	sessions *sessions
 }
 
 //Options is all the options AWSProvider can receive
@@ -22,100 +44,411 @@ type Options struct {
 	CredsProfile    string
 	AccessKeyID     string
 	SecretAccessKey string
-	Tag             string
-	SearchPattern   string
-	Filters         map[string]string
+	SessionToken    string
+	//Roles are assumed in order, each using the credentials of the previous one
+	Roles         []Role
+	Tag           string
+	SearchPattern string
+	//Query terms EC2 can evaluate are pushed down as filters
+	Query        query.Expr
+	Filters      map[string]string
+	States       []string
+	PageSize     int64
+	MaxInstances int
+	//Endpoint overrides the URL of all AWS APIs, e.g. for LocalStack or EC2 compatible clouds
+	Endpoint string
+	//Insecure skips TLS certificate verification of the AWS APIs
+	Insecure bool
+	//DisableSSL sends requests over http, endpoints may then be set without a scheme
+	DisableSSL bool
+	//SigningRegion signs requests to Endpoint for this region instead of Region
+	SigningRegion string
+	//NoLogin fails instead of logging in when sso credentials expired
+	NoLogin bool
+	//LoginOutput receives the output of sso logins
+	LoginOutput io.Writer
+	//Warn receives warnings about the search, such as results capped by MaxInstances
+	Warn func(message string)
+	//Accounts discovers instances in several accounts instead of the account of the credentials
+	Accounts *Accounts
+}
+
+//Role describes a role to assume
+type Role struct {
+	ARN         string
+	ExternalID  string
+	MFASerial   string
+	SessionName string
 }
 
 //ErrorNotFound is returned when no key exists for equivelent in EC2Instance struct
 const ErrorNotFound = "not found"
 
+const notSetError = "%s must be set"
+
+//DescribeInstances page size limits
+const (
+	minPageSize = 5
+	maxPageSize = 1000
+)
+
+//Backend creates the sessions and clients used by the provider, it can be replaced to run without AWS
+type Backend struct {
+	//Session creates the session EC2 clients are created from
+	Session func(opts *Options) (*session.Session, error)
+	//Login is called to refresh expired sso credentials, at most once per creds profile
+	Login func(opts *Options) error
+	//EC2 creates an EC2 client
+	EC2 func(sess *session.Session, cfg *aws.Config) ec2iface.EC2API
+	//MFAToken reads the MFA code of roles requiring MFA, calls are serialized
+	MFAToken func() (string, error)
+	//Organizations creates an Organizations client used to list member accounts
+	Organizations func(sess *session.Session) organizationsiface.OrganizationsAPI
+	//IAM creates an IAM client used to read account aliases
+	IAM func(sess *session.Session) iamiface.IAMAPI
+
+	loginMu sync.Mutex
+	logins  map[string]error
+
+	tokenMu  sync.Mutex
+	mfaMu    sync.Mutex
+	mfaRoles map[string]*mfaRole
+}
+
+//DefaultBackend uses static credentials or the shared AWS config files and the aws cli for sso logins
+var DefaultBackend = &Backend{
+	Session:  defaultSession,
+	Login:    ssoLogin,
+	EC2:      newEC2Client,
+	MFAToken: stscreds.StdinTokenProvider,
+	Organizations: func(sess *session.Session) organizationsiface.OrganizationsAPI {
+		return organizations.New(sess)
+	},
+	IAM: func(sess *session.Session) iamiface.IAMAPI {
+		return iam.New(sess)
+	},
+}
+
 //New returns AWS provider configs
 func New(opts *Options) (*Provider, error) {
-	client, err := newEC2(opts)
+	return NewWithBackend(opts, DefaultBackend)
+}
+
+//NewWithBackend returns AWS provider configs using backend to create the EC2 client
+func NewWithBackend(opts *Options, backend *Backend) (*Provider, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	sessions := newSessions(opts, backend)
+	sess, err := sessions.get()
 	if err != nil {
 		return nil, err
 	}
 
+	if opts.Accounts != nil {
+		accounts, err := listAccounts(sess, opts.Accounts, backend)
+		if err != nil {
+			return nil, err
+		}
+		return &Provider{
+			Options:  *opts,
+			accounts: accounts,
+			backend:  backend,
+			sessions: sessions,
+		}, nil
+	}
+
 	return &Provider{
-		Client: client,
-		Options: Options{
-			VPC:             opts.VPC,
-			Region:          opts.Region,
-			CredsProfile:    opts.CredsProfile,
-			AccessKeyID:     opts.AccessKeyID,
-			SecretAccessKey: opts.SecretAccessKey,
-			SearchPattern:   opts.SearchPattern,
-			Tag:             opts.Tag,
-			Filters:         opts.Filters,
-		},
+		Client:   backend.EC2(sess, opts.config()),
+		Options:  *opts,
+		sessions: sessions,
 	}, nil
 }
 
-func newEC2(opts *Options) (*ec2.EC2, error) {
-	sess, err := session.NewSessionWithOptions(session.Options{
-		SharedConfigState: session.SharedConfigEnable,
-		Profile:           opts.CredsProfile,
-	})
+func (o *Options) validate() error {
+	if o.Region == "" {
+		return fmt.Errorf(notSetError, "profile.provider.region")
+	}
+	if o.CredsProfile == "" && o.AccessKeyID == "" {
+		return fmt.Errorf(notSetError, "profile.provider.creds-profile")
+	}
+	if o.AccessKeyID != "" && o.SecretAccessKey == "" {
+		return fmt.Errorf("static credentials require a secret access key")
+	}
+	for _, r := range o.Roles {
+		if r.ARN == "" {
+			return fmt.Errorf(notSetError, "profile.provider.role-arn")
+		}
+	}
+	if o.VPC == "" && o.Accounts == nil {
+		return fmt.Errorf(notSetError, "profile.provider.vpc-id")
+	}
+	if o.Accounts != nil {
+		if err := o.Accounts.validate(); err != nil {
+			return err
+		}
+	}
+	if o.PageSize != 0 && (o.PageSize < minPageSize || o.PageSize > maxPageSize) {
+		return fmt.Errorf("profile.provider.page-size must be between %d and %d", minPageSize, maxPageSize)
+	}
+	if o.Endpoint != "" {
+		endpoint := o.Endpoint
+		if o.DisableSSL {
+			endpoint = endpoints.AddScheme(endpoint, true)
+		}
+		u, err := url.Parse(endpoint)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("profile.provider.endpoint %q must be an absolute URL", o.Endpoint)
+		}
+	}
+	if o.SigningRegion != "" && o.Endpoint == "" {
+		return fmt.Errorf("profile.provider.signing-region requires profile.provider.endpoint")
+	}
+	return nil
+}
 
+//newSession returns a session using the credentials of the provider, after assuming its roles.
+//The endpoint options apply to the session so STS, Organizations and IAM use them like EC2.
+func newSession(opts *Options, backend *Backend) (*session.Session, error) {
+	sess, err := backend.Session(opts)
 	if err != nil {
+		return nil, fmt.Errorf("creating session: %w", err)
+	}
+	sess = sess.Copy(opts.config())
+
+	if err := baseCredentials(sess, opts, backend); err != nil {
 		return nil, err
 	}
 
-	_, err = sess.Config.Credentials.Get()
-	if err != nil {
-		if err := ssoLogin(opts); err != nil {
-			return nil, err
+	return assumeRoles(sess, opts, backend)
+}
+
+//assumeRoles returns a session using the credentials of the last role in the chain
+func assumeRoles(sess *session.Session, opts *Options, backend *Backend) (*session.Session, error) {
+	chain := fmt.Sprintf("%s/%s/%s", opts.CredsProfile, opts.AccessKeyID, opts.Endpoint)
+	for idx, r := range opts.Roles {
+		chain += fmt.Sprintf("|%s/%s/%s/%s", r.ARN, r.ExternalID, r.MFASerial, r.SessionName)
+		var next *session.Session
+		var err error
+		if r.MFASerial != "" {
+			next, err = backend.assumeMFARole(sess, r, chain)
+		} else {
+			next, err = assumeRole(sess, r, backend)
 		}
+		if err != nil {
+			return nil, fmt.Errorf("assuming role %s (step %d of %d): %w", r.ARN, idx+1, len(opts.Roles), err)
+		}
+		sess = next
 	}
+	return sess, nil
+}
 
-	return ec2.New(sess, aws.NewConfig().WithRegion(opts.Region)), nil
+//assumeRole returns a session using the credentials of role
+func assumeRole(sess *session.Session, r Role, backend *Backend) (*session.Session, error) {
+	creds := stscreds.NewCredentials(sess, r.ARN, func(p *stscreds.AssumeRoleProvider) {
+		if r.ExternalID != "" {
+			p.ExternalID = aws.String(r.ExternalID)
+		}
+		if r.MFASerial != "" {
+			p.SerialNumber = aws.String(r.MFASerial)
+			p.TokenProvider = backend.mfaToken
+		}
+		if r.SessionName != "" {
+			p.RoleSessionName = r.SessionName
+		}
+	})
+	if _, err := creds.Get(); err != nil {
+		return nil, err
+	}
+	return sess.Copy(&aws.Config{Credentials: creds}), nil
 }
 
-func ssoLogin(opts *Options) error {
-	binary := "aws"
-	if _, err := exec.LookPath(binary); err != nil {
-		return err
+//warn passes a warning to Warn when it is set
+func (o *Options) warn(format string, a ...interface{}) {
+	if o.Warn != nil {
+		o.Warn(fmt.Sprintf(format, a...))
 	}
+}
 
-	args := []string{"sso", "login", "--profile", opts.CredsProfile}
-	cmd := exec.Command(binary, args...)
-	if err := cmd.Run(); err != nil {
-		return err
+//config returns the config of the sessions and clients of opts
+func (o *Options) config() *aws.Config {
+	cfg := aws.NewConfig().WithRegion(o.Region)
+	if o.DisableSSL {
+		cfg = cfg.WithDisableSSL(true)
 	}
-	return nil
+	if o.Endpoint != "" {
+		resolved := endpoints.ResolvedEndpoint{
+			URL:           endpoints.AddScheme(o.Endpoint, o.DisableSSL),
+			SigningRegion: o.SigningRegion,
+		}
+		cfg = cfg.WithEndpointResolver(endpoints.ResolverFunc(
+			func(service, region string, opts ...func(*endpoints.Options)) (endpoints.ResolvedEndpoint, error) {
+				endpoint := resolved
+				if endpoint.SigningRegion == "" {
+					endpoint.SigningRegion = region
+				}
+				return endpoint, nil
+			}))
+	}
+	if o.Insecure {
+		cfg = cfg.WithHTTPClient(&http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+		})
+	}
+	return cfg
+}
+
+//sessionConfig returns the config sessions are created with. Every session gets its own http client,
+//sessions loading a custom CA bundle set it on the transport of their client and must not share the default one.
+func (o *Options) sessionConfig() *aws.Config {
+	cfg := o.config()
+	if cfg.HTTPClient == nil {
+		cfg = cfg.WithHTTPClient(&http.Client{})
+	}
+	return cfg
 }
 
-//Get will filter all instances according to tag
+func defaultSession(opts *Options) (*session.Session, error) {
+	//roles assumed by the shared config use the endpoint too
+	cfg := opts.sessionConfig()
+	if opts.AccessKeyID != "" {
+		cfg = cfg.WithCredentials(credentials.NewStaticCredentials(opts.AccessKeyID, opts.SecretAccessKey, opts.SessionToken))
+		return session.NewSession(cfg)
+	}
+	return session.NewSessionWithOptions(session.Options{
+		Config:            *cfg,
+		SharedConfigState: session.SharedConfigEnable,
+		Profile:           opts.CredsProfile,
+	})
+}
+
+func newEC2Client(sess *session.Session, cfg *aws.Config) ec2iface.EC2API {
+	return ec2.New(sess, cfg)
+}
+
+//Get will filter all instances according to tag, reading all result pages up to MaxInstances
 func (p *Provider) Get() (instance.XTInstances, error) {
-	filters := []*ec2.Filter{
-		{
-			Name:   aws.String("vpc-id"),
-			Values: []*string{aws.String(p.Options.VPC)},
-		},
-		{
+	var (
+		instances instance.XTInstances
+		err       error
+	)
+	if p.accounts != nil {
+		instances, err = p.getAccounts()
+	} else {
+		var truncated bool
+		instances, truncated, err = p.describe(p.Client)
+		if truncated {
+			p.Options.warn("%s: more than %d instances match, showing the first %d, narrow the search or raise max-instances",
+				p.Options.Region, p.Options.MaxInstances, p.Options.MaxInstances)
+		}
+	}
+	if p.sessions != nil {
+		p.sessions.set(instances)
+	}
+	return instances, err
+}
+
+//describe returns the instances client finds, reading all result pages up to MaxInstances,
+//truncated reports whether more instances matched
+func (p *Provider) describe(client ec2iface.EC2API) (instances instance.XTInstances, truncated bool, err error) {
+	params := &ec2.DescribeInstancesInput{
+		Filters: p.filters(),
+	}
+	if p.Options.PageSize > 0 {
+		params.MaxResults = aws.Int64(p.Options.PageSize)
+	}
+
+	for {
+		res, err := client.DescribeInstances(params)
+		if err != nil {
+			return nil, false, err
+		}
+		found := parseOutput(res, p.Options.Tag)
+		for idx := range found {
+			found[idx].Region = p.Options.Region
+			found[idx].CredsProfile = p.Options.CredsProfile
+		}
+		instances = append(instances, found...)
+
+		more := aws.StringValue(res.NextToken) != ""
+		if max := p.Options.MaxInstances; max > 0 && len(instances) >= max {
+			return instances[:max], more || len(instances) > max, nil
+		}
+		if !more {
+			return instances, false, nil
+		}
+		params.NextToken = res.NextToken
+	}
+}
+
+func (p *Provider) filters() []*ec2.Filter {
+	var filters []*ec2.Filter
+	//queries search all instances, the search tag is only required when searching by name prefix
+	if p.Options.Query == nil || p.Options.SearchPattern != "" {
+		filters = append(filters, &ec2.Filter{
 			Name:   aws.String("tag:" + p.Options.Tag),
 			Values: []*string{aws.String(p.Options.SearchPattern + "*")},
-		},
+		})
 	}
-	for tagKey, tagValue := range p.Options.Filters {
-		tag := "tag:" + tagKey
+	if p.Options.VPC != "" {
+		filters = append([]*ec2.Filter{{
+			Name:   aws.String("vpc-id"),
+			Values: []*string{aws.String(p.Options.VPC)},
+		}}, filters...)
+	}
+	names := make(map[string]bool)
+	for key, value := range p.Options.Filters {
+		names[filterName(key)] = true
 		filters = append(filters, &ec2.Filter{
-			Name:   aws.String(tag),
-			Values: []*string{aws.String(tagValue)},
+			Name:   aws.String(filterName(key)),
+			Values: []*string{aws.String(value)},
 		})
 	}
-
-	params := &ec2.DescribeInstancesInput{
-		Filters: filters,
+	if p.Options.Query != nil {
+		for name, value := range query.EC2Filters(p.Options.Query) {
+			if names[name] {
+				continue
+			}
+			names[name] = true
+			filters = append(filters, &ec2.Filter{
+				Name:   aws.String(name),
+				Values: []*string{aws.String(value)},
+			})
+		}
 	}
 
-	res, err := p.Client.DescribeInstances(params)
-	if err != nil {
-		return nil, err
+	//EC2 ANDs filters, a state searched by filter or query replaces the states searched by default
+	if len(p.Options.States) > 0 && !names["instance-state-name"] {
+		filters = append(filters, &ec2.Filter{
+			Name:   aws.String("instance-state-name"),
+			Values: aws.StringSlice(p.Options.States),
+		})
 	}
 
-	return parseOutput(res, p.Options.Tag), nil
+	return filters
+}
+
+//instanceFilters are the EC2 DescribeInstances filters that are not tags
+var instanceFilters = map[string]bool{
+	"affinity": true, "architecture": true, "availability-zone": true, "dns-name": true,
+	"host-id": true, "hypervisor": true, "iam-instance-profile.arn": true, "image-id": true,
+	"instance-id": true, "instance-lifecycle": true, "instance-state-code": true,
+	"instance-state-name": true, "instance-type": true, "ip-address": true, "key-name": true,
+	"launch-time": true, "owner-id": true, "placement-group-name": true, "platform": true,
+	"private-dns-name": true, "private-ip-address": true, "reservation-id": true,
+	"root-device-type": true, "subnet-id": true, "tenancy": true, "vpc-id": true,
+}
+
+//filterName returns the EC2 filter name of key, keys that are not EC2 instance filters are treated as tags
+func filterName(key string) string {
+	if instanceFilters[key] || strings.HasPrefix(key, "tag:") || strings.HasPrefix(key, "tag-") {
+		return key
+	}
+	return "tag:" + key
 }
 
 func parseOutput(ec2 *ec2.DescribeInstancesOutput, searchTag string) instance.XTInstances {
@@ -123,22 +456,29 @@ func parseOutput(ec2 *ec2.DescribeInstancesOutput, searchTag string) instance.XT
 	for idx := range ec2.Reservations {
 		for _, inst := range ec2.Reservations[idx].Instances {
 			var name string
+			tags := make(map[string]string)
 			for _, tag := range inst.Tags {
-				if *tag.Key == searchTag {
-					name = *tag.Value
+				key, value := aws.StringValue(tag.Key), aws.StringValue(tag.Value)
+				if key == searchTag {
+					name = value
 				}
+				tags[key] = value
 			}
 			instance := instance.XTInstance{
 				InstanceName:      name,
 				InstanceID:        getValue(inst.InstanceId),
 				ImageID:           getValue(inst.ImageId),
 				InstanceType:      getValue(inst.InstanceType),
+				State:             getState(inst.State),
 				PrivateIPAddress:  getValue(inst.PrivateIpAddress),
 				PublicIPAddress:   getValue(inst.PublicIpAddress),
+				PrivateDNSName:    getValue(inst.PrivateDnsName),
+				PublicDNSName:     getValue(inst.PublicDnsName),
 				SubnetID:          getValue(inst.SubnetId),
-				AvailabilityZone:  getValue(inst.Placement.AvailabilityZone),
+				AvailabilityZone:  getAvailabilityZone(inst.Placement),
 				InstanceLifecycle: getValue(inst.InstanceLifecycle),
-				LaunchTime:        inst.LaunchTime.String(),
+				LaunchTime:        getTime(inst.LaunchTime),
+				Tags:              tags,
 			}
 			instances = append(instances, instance)
 		}
@@ -146,6 +486,27 @@ func parseOutput(ec2 *ec2.DescribeInstancesOutput, searchTag string) instance.XT
 	return instances
 }
 
+func getAvailabilityZone(placement *ec2.Placement) string {
+	if placement == nil {
+		return ErrorNotFound
+	}
+	return getValue(placement.AvailabilityZone)
+}
+
+func getTime(t *time.Time) string {
+	if t == nil {
+		return ErrorNotFound
+	}
+	return t.String()
+}
+
+func getState(state *ec2.InstanceState) string {
+	if state == nil {
+		return ErrorNotFound
+	}
+	return getValue(state.Name)
+}
+
 func getValue(val *string) string {
 	if val != nil {
 		return *val
@@ -0,0 +1,1185 @@
+package aws
+
+import (
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adamkobi/xt/internal/instance"
+	"github.com/adamkobi/xt/pkg/provider/aws/awstest"
+	"github.com/adamkobi/xt/pkg/query"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/ssocreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/organizations"
+)
+
+//mockEC2 serves DescribeInstances from a fixed list of pages using page indexes as NextToken
+type mockEC2 struct {
+	ec2iface.EC2API
+	pages  []*ec2.DescribeInstancesOutput
+	inputs []ec2.DescribeInstancesInput
+}
+
+func (m *mockEC2) DescribeInstances(in *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+	m.inputs = append(m.inputs, *in)
+	idx := 0
+	if token := aws.StringValue(in.NextToken); token != "" {
+		var err error
+		if idx, err = strconv.Atoi(token); err != nil || idx >= len(m.pages) {
+			return nil, fmt.Errorf("invalid token %s", token)
+		}
+	}
+	page := *m.pages[idx]
+	if idx < len(m.pages)-1 {
+		page.NextToken = aws.String(strconv.Itoa(idx + 1))
+	}
+	return &page, nil
+}
+
+func newMockEC2(pages, perPage int) *mockEC2 {
+	m := &mockEC2{}
+	launchTime := time.Date(2021, 2, 16, 20, 3, 0, 0, time.UTC)
+	for p := 0; p < pages; p++ {
+		var instances []*ec2.Instance
+		for i := 0; i < perPage; i++ {
+			instances = append(instances, &ec2.Instance{
+				InstanceId: aws.String(fmt.Sprintf("i-%d%d", p, i)),
+				LaunchTime: &launchTime,
+				Placement:  &ec2.Placement{AvailabilityZone: aws.String("us-east-1a")},
+				Tags: []*ec2.Tag{
+					{Key: aws.String("Name"), Value: aws.String(fmt.Sprintf("web-%d-%d", p, i))},
+				},
+			})
+		}
+		m.pages = append(m.pages, &ec2.DescribeInstancesOutput{
+			Reservations: []*ec2.Reservation{{Instances: instances}},
+		})
+	}
+	return m
+}
+
+func TestGetPagination(t *testing.T) {
+	tests := []struct {
+		name         string
+		pages        int
+		perPage      int
+		pageSize     int64
+		maxInstances int
+		wantCount    int
+		wantCalls    int
+		wantWarning  bool
+	}{
+		{
+			name:      "single page",
+			pages:     1,
+			perPage:   3,
+			wantCount: 3,
+			wantCalls: 1,
+		},
+		{
+			name:      "reads all pages",
+			pages:     4,
+			perPage:   5,
+			pageSize:  5,
+			wantCount: 20,
+			wantCalls: 4,
+		},
+		{
+			name:         "stops at max instances",
+			pages:        4,
+			perPage:      5,
+			pageSize:     5,
+			maxInstances: 7,
+			wantCount:    7,
+			wantCalls:    2,
+			wantWarning:  true,
+		},
+		{
+			name:         "max instances of all instances",
+			pages:        2,
+			perPage:      5,
+			pageSize:     5,
+			maxInstances: 10,
+			wantCount:    10,
+			wantCalls:    2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newMockEC2(tt.pages, tt.perPage)
+			var warnings []string
+			p := &Provider{
+				Client: client,
+				Options: Options{
+					VPC:          "vpc-1",
+					Tag:          "Name",
+					PageSize:     tt.pageSize,
+					MaxInstances: tt.maxInstances,
+					Warn:         func(message string) { warnings = append(warnings, message) },
+				},
+			}
+
+			instances, err := p.Get()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(instances) != tt.wantCount {
+				t.Errorf("got %d instances, want %d", len(instances), tt.wantCount)
+			}
+			if got := len(warnings) > 0; got != tt.wantWarning {
+				t.Errorf("got warnings %q, want a warning %v", warnings, tt.wantWarning)
+			}
+			if len(client.inputs) != tt.wantCalls {
+				t.Errorf("got %d DescribeInstances calls, want %d", len(client.inputs), tt.wantCalls)
+			}
+			for _, in := range client.inputs {
+				if tt.pageSize == 0 && in.MaxResults != nil {
+					t.Errorf("expected no MaxResults, got %d", *in.MaxResults)
+				}
+				if tt.pageSize != 0 && aws.Int64Value(in.MaxResults) != tt.pageSize {
+					t.Errorf("got MaxResults %d, want %d", aws.Int64Value(in.MaxResults), tt.pageSize)
+				}
+			}
+			if tt.wantCalls > 1 {
+				var tokens []string
+				for _, in := range client.inputs[1:] {
+					tokens = append(tokens, aws.StringValue(in.NextToken))
+				}
+				var want []string
+				for i := 1; i < tt.wantCalls; i++ {
+					want = append(want, strconv.Itoa(i))
+				}
+				if !reflect.DeepEqual(tokens, want) {
+					t.Errorf("got tokens %v, want %v", tokens, want)
+				}
+			}
+		})
+	}
+}
+
+func TestValidatePageSize(t *testing.T) {
+	opts := &Options{VPC: "vpc-1", Region: "us-east-1", CredsProfile: "dev", PageSize: 2}
+	if err := opts.validate(); err == nil {
+		t.Error("expected error for page size below minimum")
+	}
+	opts.PageSize = 100
+	if err := opts.validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func testInstance(id, name, az, state string, tags ...string) *ec2.Instance {
+	launchTime := time.Date(2021, 2, 16, 20, 3, 0, 0, time.UTC)
+	inst := &ec2.Instance{
+		InstanceId:       aws.String(id),
+		ImageId:          aws.String("ami-1"),
+		InstanceType:     aws.String("t3.micro"),
+		PrivateIpAddress: aws.String("10.0.0.1"),
+		SubnetId:         aws.String("subnet-1"),
+		VpcId:            aws.String("vpc-1"),
+		LaunchTime:       &launchTime,
+		Placement:        &ec2.Placement{AvailabilityZone: aws.String(az)},
+		State:            &ec2.InstanceState{Name: aws.String(state)},
+		Tags:             []*ec2.Tag{{Key: aws.String("Name"), Value: aws.String(name)}},
+	}
+	for i := 0; i+1 < len(tags); i += 2 {
+		inst.Tags = append(inst.Tags, &ec2.Tag{Key: aws.String(tags[i]), Value: aws.String(tags[i+1])})
+	}
+	return inst
+}
+
+//testBackend creates clients for the fake EC2 server and counts logins
+func testBackend(server *awstest.Server, creds *credentials.Credentials, logins *int, loginErr error) *Backend {
+	return &Backend{
+		Session: func(opts *Options) (*session.Session, error) {
+			cfg := server.Config(opts.Region)
+			if creds != nil {
+				cfg.Credentials = creds
+			}
+			return session.NewSession(cfg)
+		},
+		Login: func(opts *Options) error {
+			*logins++
+			return loginErr
+		},
+		EC2: newEC2Client,
+	}
+}
+
+//mustQuery parses a query of a test case
+func mustQuery(input string) query.Expr {
+	expr, err := query.Parse(input)
+	if err != nil {
+		panic(err)
+	}
+	return expr
+}
+
+func TestGetFilters(t *testing.T) {
+	server := awstest.NewServer([]*ec2.Instance{
+		testInstance("i-1", "web-1", "us-east-1a", "running", "role", "frontend"),
+		testInstance("i-2", "web-2", "us-east-1b", "running", "role", "backend"),
+		testInstance("i-3", "web-3", "us-east-1a", "stopped", "role", "frontend"),
+		testInstance("i-4", "db-1", "us-east-1a", "running", "role", "db"),
+	})
+	defer server.Close()
+
+	tests := []struct {
+		name string
+		opts Options
+		want []string
+	}{
+		{
+			name: "search pattern prefix",
+			opts: Options{Tag: "Name", SearchPattern: "web"},
+			want: []string{"web-1", "web-2", "web-3"},
+		},
+		{
+			name: "search by custom tag",
+			opts: Options{Tag: "role", SearchPattern: "front"},
+			want: []string{"frontend", "frontend"},
+		},
+		{
+			name: "tag filter",
+			opts: Options{Tag: "Name", Filters: map[string]string{"role": "backend"}},
+			want: []string{"web-2"},
+		},
+		{
+			name: "ec2 filter",
+			opts: Options{Tag: "Name", Filters: map[string]string{"availability-zone": "us-east-1a"}},
+			want: []string{"db-1", "web-1", "web-3"},
+		},
+		{
+			name: "states",
+			opts: Options{Tag: "Name", SearchPattern: "web", States: []string{"running"}},
+			want: []string{"web-1", "web-2"},
+		},
+		{
+			name: "state filter replaces states",
+			opts: Options{Tag: "Name", SearchPattern: "web", States: []string{"running"}, Filters: map[string]string{"instance-state-name": "stopped"}},
+			want: []string{"web-3"},
+		},
+		{
+			name: "state query replaces states",
+			opts: Options{Tag: "Name", Query: mustQuery("state=stopped"), States: []string{"running"}},
+			want: []string{"web-3"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			opts.VPC = "vpc-1"
+			opts.Region = "us-east-1"
+			opts.CredsProfile = "test"
+
+			var logins int
+			p, err := NewWithBackend(&opts, testBackend(server, nil, &logins, nil))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			instances, err := p.Get()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := instances.Names(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if logins != 0 {
+				t.Errorf("expected no login with valid credentials, got %d", logins)
+			}
+		})
+	}
+}
+
+func TestParseOutput(t *testing.T) {
+	launchTime := time.Date(2021, 2, 16, 20, 3, 0, 0, time.UTC)
+	output := &ec2.DescribeInstancesOutput{
+		Reservations: []*ec2.Reservation{
+			{
+				Instances: []*ec2.Instance{
+					{
+						InstanceId:       aws.String("i-1"),
+						InstanceType:     aws.String("t3.micro"),
+						PrivateIpAddress: aws.String("10.0.0.1"),
+						LaunchTime:       &launchTime,
+						Placement:        &ec2.Placement{AvailabilityZone: aws.String("us-east-1a")},
+						State:            &ec2.InstanceState{Name: aws.String("running")},
+						Tags: []*ec2.Tag{
+							{Key: aws.String("Name"), Value: aws.String("web-1")},
+							{Key: aws.String("role"), Value: aws.String("frontend")},
+						},
+					},
+				},
+			},
+			{
+				Instances: []*ec2.Instance{
+					{InstanceId: aws.String("i-2")},
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		searchTag string
+		want      instance.XTInstances
+	}{
+		{
+			name:      "name from search tag",
+			searchTag: "role",
+			want: instance.XTInstances{
+				{
+					InstanceName:      "frontend",
+					InstanceID:        "i-1",
+					ImageID:           ErrorNotFound,
+					InstanceType:      "t3.micro",
+					State:             "running",
+					PrivateIPAddress:  "10.0.0.1",
+					PublicIPAddress:   ErrorNotFound,
+					PrivateDNSName:    ErrorNotFound,
+					PublicDNSName:     ErrorNotFound,
+					SubnetID:          ErrorNotFound,
+					AvailabilityZone:  "us-east-1a",
+					InstanceLifecycle: ErrorNotFound,
+					LaunchTime:        launchTime.String(),
+					Tags:              map[string]string{"Name": "web-1", "role": "frontend"},
+				},
+				{
+					InstanceID:        "i-2",
+					ImageID:           ErrorNotFound,
+					InstanceType:      ErrorNotFound,
+					State:             ErrorNotFound,
+					PrivateIPAddress:  ErrorNotFound,
+					PublicIPAddress:   ErrorNotFound,
+					PrivateDNSName:    ErrorNotFound,
+					PublicDNSName:     ErrorNotFound,
+					SubnetID:          ErrorNotFound,
+					AvailabilityZone:  ErrorNotFound,
+					InstanceLifecycle: ErrorNotFound,
+					LaunchTime:        ErrorNotFound,
+					Tags:              map[string]string{},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseOutput(output, tt.searchTag)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+//expiredProvider fails to retrieve credentials with err until refreshed
+type expiredProvider struct {
+	expired *bool
+	err     error
+}
+
+func (p *expiredProvider) Retrieve() (credentials.Value, error) {
+	if *p.expired {
+		return credentials.Value{}, p.err
+	}
+	return credentials.Value{AccessKeyID: "AKIDTEST", SecretAccessKey: "SECRETTEST"}, nil
+}
+
+func (p *expiredProvider) IsExpired() bool {
+	return *p.expired
+}
+
+func TestSSOFallback(t *testing.T) {
+	server := awstest.NewServer([]*ec2.Instance{
+		testInstance("i-1", "web-1", "us-east-1a", "running"),
+	})
+	defer server.Close()
+
+	ssoExpired := awserr.New(ssocreds.ErrCodeSSOProviderInvalidToken, "the SSO session has expired or is invalid", nil)
+
+	tests := []struct {
+		name       string
+		expired    bool
+		err        error
+		noLogin    bool
+		loginErr   error
+		loginFixes bool
+		attempts   int
+		wantLogins int
+		wantErr    string
+	}{
+		{
+			name:       "valid credentials",
+			wantLogins: 0,
+		},
+		{
+			name:       "expired sso session triggers login",
+			expired:    true,
+			err:        ssoExpired,
+			loginFixes: true,
+			wantLogins: 1,
+		},
+		{
+			name:       "failed login runs once per profile",
+			expired:    true,
+			err:        ssoExpired,
+			loginErr:   errors.New("login failed"),
+			attempts:   2,
+			wantLogins: 1,
+			wantErr:    "sso login failed: login failed",
+		},
+		{
+			name:       "login disabled",
+			expired:    true,
+			err:        ssoExpired,
+			noLogin:    true,
+			wantLogins: 0,
+			wantErr:    "login disabled",
+		},
+		{
+			name:       "missing credentials do not trigger login",
+			expired:    true,
+			err:        awserr.New("NoCredentialProviders", "no valid providers in chain", nil),
+			wantLogins: 0,
+			wantErr:    "no credentials found",
+		},
+		{
+			name:       "credentials still invalid after login",
+			expired:    true,
+			err:        ssoExpired,
+			wantLogins: 1,
+			wantErr:    "still invalid after sso login",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expired := tt.expired
+			creds := credentials.NewCredentials(&expiredProvider{expired: &expired, err: tt.err})
+			var logins int
+			backend := testBackend(server, creds, &logins, tt.loginErr)
+			login := backend.Login
+			backend.Login = func(opts *Options) error {
+				if err := login(opts); err != nil {
+					return err
+				}
+				if tt.loginFixes {
+					expired = false
+				}
+				return nil
+			}
+
+			attempts := tt.attempts
+			if attempts == 0 {
+				attempts = 1
+			}
+			var (
+				p   *Provider
+				err error
+			)
+			for i := 0; i < attempts; i++ {
+				opts := &Options{VPC: "vpc-1", Region: "us-east-1", CredsProfile: "test", Tag: "Name", NoLogin: tt.noLogin}
+				p, err = NewWithBackend(opts, backend)
+			}
+			if logins != tt.wantLogins {
+				t.Errorf("got %d logins, want %d", logins, tt.wantLogins)
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			instances, err := p.Get()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := instances.Names(); !reflect.DeepEqual(got, []string{"web-1"}) {
+				t.Errorf("got %v, want [web-1]", got)
+			}
+		})
+	}
+}
+
+func TestEndpoint(t *testing.T) {
+	instances := []*ec2.Instance{testInstance("i-1", "web-1", "us-east-1a", "running")}
+	plain := awstest.NewServer(instances)
+	defer plain.Close()
+	tlsServer := awstest.NewTLSServer(instances)
+	defer tlsServer.Close()
+
+	tests := []struct {
+		name     string
+		endpoint string
+		insecure bool
+		wantErr  bool
+	}{
+		{
+			name:     "http endpoint",
+			endpoint: plain.URL,
+		},
+		{
+			name:     "self signed endpoint",
+			endpoint: tlsServer.URL,
+			wantErr:  true,
+		},
+		{
+			name:     "insecure self signed endpoint",
+			endpoint: tlsServer.URL,
+			insecure: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := &Backend{
+				Session: func(opts *Options) (*session.Session, error) {
+					return session.NewSession(aws.NewConfig().
+						WithHTTPClient(&http.Client{}).
+						WithCredentials(credentials.NewStaticCredentials("AKIDTEST", "SECRETTEST", "")))
+				},
+				Login: func(opts *Options) error { return nil },
+				EC2:   newEC2Client,
+			}
+			opts := &Options{
+				VPC:          "vpc-1",
+				Region:       "us-east-1",
+				CredsProfile: "test",
+				Tag:          "Name",
+				Endpoint:     tt.endpoint,
+				Insecure:     tt.insecure,
+			}
+			p, err := NewWithBackend(opts, backend)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			//avoid retrying certificate errors
+			p.Client.(*ec2.EC2).Config.MaxRetries = aws.Int(0)
+			instances, err := p.Get()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := instances.Names(); !reflect.DeepEqual(got, []string{"web-1"}) {
+				t.Errorf("got %v, want [web-1]", got)
+			}
+		})
+	}
+}
+
+func TestDefaultSessionCABundle(t *testing.T) {
+	server := awstest.NewTLSServer([]*ec2.Instance{testInstance("i-1", "web-1", "us-east-1a", "running")})
+	defer server.Close()
+	bundle, err := ioutil.TempFile("", "xt-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(bundle.Name())
+	_ = pem.Encode(bundle, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	bundle.Close()
+	caBundle, set := os.LookupEnv("AWS_CA_BUNDLE")
+	os.Setenv("AWS_CA_BUNDLE", bundle.Name())
+	defer func() {
+		if set {
+			os.Setenv("AWS_CA_BUNDLE", caBundle)
+		} else {
+			os.Unsetenv("AWS_CA_BUNDLE")
+		}
+	}()
+
+	//providers are created at once, each trusting the bundle through its own http client
+	var wg sync.WaitGroup
+	errs := make([]error, 3)
+	for idx := range errs {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			p, err := New(&Options{
+				VPC:             "vpc-1",
+				Region:          "us-east-1",
+				AccessKeyID:     "AKIDTEST",
+				SecretAccessKey: "SECRETTEST",
+				Tag:             "Name",
+				Endpoint:        server.URL,
+			})
+			if err == nil {
+				_, err = p.Get()
+			}
+			errs[idx] = err
+		}(idx)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if http.DefaultClient.Transport != nil {
+		t.Error("the CA bundle was loaded into the default http client")
+	}
+}
+
+func TestSessionEndpoint(t *testing.T) {
+	server := awstest.NewServer([]*ec2.Instance{testInstance("i-1", "web-1", "us-east-1a", "running")})
+	defer server.Close()
+
+	tests := []struct {
+		name          string
+		endpoint      string
+		disableSSL    bool
+		signingRegion string
+		wantRegion    string
+	}{
+		{
+			name:       "roles assumed through the endpoint",
+			endpoint:   server.URL,
+			wantRegion: "us-east-1",
+		},
+		{
+			name:          "signing region",
+			endpoint:      server.URL,
+			signingRegion: "eu-central-1",
+			wantRegion:    "eu-central-1",
+		},
+		{
+			name:       "endpoint without scheme and ssl disabled",
+			endpoint:   strings.TrimPrefix(server.URL, "http://"),
+			disableSSL: true,
+			wantRegion: "us-east-1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(server.RoleRequests())
+			//the backend session does not know the endpoint, the provider options set it for every client
+			backend := &Backend{
+				Session: func(opts *Options) (*session.Session, error) {
+					return session.NewSession(aws.NewConfig().
+						WithHTTPClient(&http.Client{}).
+						WithRegion(opts.Region).
+						WithCredentials(credentials.NewStaticCredentials("AKIDTEST", "SECRETTEST", "")))
+				},
+				Login: func(opts *Options) error { return errors.New("unexpected login") },
+				EC2:   newEC2Client,
+			}
+			opts := &Options{
+				VPC:             "vpc-1",
+				Region:          "us-east-1",
+				AccessKeyID:     "AKIDTEST",
+				SecretAccessKey: "SECRETTEST",
+				Tag:             "Name",
+				Roles:           []Role{{ARN: "arn:aws:iam::111111111111:role/xt", SessionName: "xt"}},
+				Endpoint:        tt.endpoint,
+				DisableSSL:      tt.disableSSL,
+				SigningRegion:   tt.signingRegion,
+			}
+			p, err := NewWithBackend(opts, backend)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if _, err := p.Get(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := len(server.RoleRequests()) - before; got != 1 {
+				t.Errorf("got %d AssumeRole calls to the endpoint, want 1", got)
+			}
+			requests := server.Requests()
+			if got := requests[len(requests)-1].SigningRegion; got != tt.wantRegion {
+				t.Errorf("got signing region %s, want %s", got, tt.wantRegion)
+			}
+		})
+	}
+}
+
+func TestValidateEndpoint(t *testing.T) {
+	opts := &Options{VPC: "vpc-1", Region: "us-east-1", CredsProfile: "test", Endpoint: "localhost"}
+	if err := opts.validate(); err == nil {
+		t.Error("expected error for endpoint without scheme")
+	}
+	opts.Endpoint = "http://localhost:4566"
+	if err := opts.validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	opts.Endpoint, opts.DisableSSL = "localhost:4566", true
+	if err := opts.validate(); err != nil {
+		t.Errorf("unexpected error for endpoint without scheme and ssl disabled: %v", err)
+	}
+	opts.Endpoint, opts.SigningRegion = "", "eu-central-1"
+	if err := opts.validate(); err == nil {
+		t.Error("expected error for signing region without endpoint")
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      Options
+		wantRoles []awstest.RoleRequest
+		wantKey   string
+		wantErr   string
+	}{
+		{
+			name:    "static credentials",
+			opts:    Options{AccessKeyID: "AKIDSTATIC", SecretAccessKey: "SECRET"},
+			wantKey: "AKIDSTATIC",
+		},
+		{
+			name: "single role",
+			opts: Options{
+				AccessKeyID:     "AKIDSTATIC",
+				SecretAccessKey: "SECRET",
+				Roles: []Role{
+					{ARN: "arn:aws:iam::111111111111:role/xt", ExternalID: "ext", SessionName: "xt"},
+				},
+			},
+			wantRoles: []awstest.RoleRequest{
+				{RoleARN: "arn:aws:iam::111111111111:role/xt", ExternalID: "ext", SessionName: "xt", AccessKeyID: "AKIDSTATIC"},
+			},
+			wantKey: "ASIATEST1",
+		},
+		{
+			name: "role chain with mfa",
+			opts: Options{
+				AccessKeyID:     "AKIDSTATIC",
+				SecretAccessKey: "SECRET",
+				Roles: []Role{
+					{ARN: "arn:aws:iam::111111111111:role/hub", MFASerial: "arn:aws:iam::111111111111:mfa/me", SessionName: "hub"},
+					{ARN: "arn:aws:iam::222222222222:role/spoke", SessionName: "spoke"},
+				},
+			},
+			wantRoles: []awstest.RoleRequest{
+				{RoleARN: "arn:aws:iam::111111111111:role/hub", SerialNumber: "arn:aws:iam::111111111111:mfa/me", TokenCode: "123456", SessionName: "hub", AccessKeyID: "AKIDSTATIC"},
+				{RoleARN: "arn:aws:iam::222222222222:role/spoke", SessionName: "spoke", AccessKeyID: "ASIATEST1"},
+			},
+			wantKey: "ASIATEST2",
+		},
+		{
+			name: "denied role names the failed step",
+			opts: Options{
+				AccessKeyID:     "AKIDSTATIC",
+				SecretAccessKey: "SECRET",
+				Roles: []Role{
+					{ARN: "arn:aws:iam::111111111111:role/hub", SessionName: "hub"},
+					{ARN: "arn:aws:iam::222222222222:role/denied", SessionName: "spoke"},
+				},
+			},
+			wantErr: "assuming role arn:aws:iam::222222222222:role/denied (step 2 of 2)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := awstest.NewServer([]*ec2.Instance{
+				testInstance("i-1", "web-1", "us-east-1a", "running"),
+			})
+			defer server.Close()
+			server.DenyRole("arn:aws:iam::222222222222:role/denied")
+
+			backend := &Backend{
+				Session: func(opts *Options) (*session.Session, error) {
+					cfg := server.Config(opts.Region).
+						WithCredentials(credentials.NewStaticCredentials(opts.AccessKeyID, opts.SecretAccessKey, ""))
+					return session.NewSession(cfg)
+				},
+				Login:    func(opts *Options) error { return errors.New("unexpected login") },
+				EC2:      newEC2Client,
+				MFAToken: func() (string, error) { return "123456", nil },
+			}
+			opts := tt.opts
+			opts.VPC = "vpc-1"
+			opts.Region = "us-east-1"
+			opts.Tag = "Name"
+
+			p, err := NewWithBackend(&opts, backend)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if _, err := p.Get(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := server.RoleRequests(); (len(got) > 0 || len(tt.wantRoles) > 0) && !reflect.DeepEqual(got, tt.wantRoles) {
+				t.Errorf("got roles %+v, want %+v", got, tt.wantRoles)
+			}
+			requests := server.Requests()
+			if got := requests[len(requests)-1].AccessKeyID; got != tt.wantKey {
+				t.Errorf("got EC2 access key %s, want %s", got, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestMFARoles(t *testing.T) {
+	server := awstest.NewServer([]*ec2.Instance{
+		testInstance("i-1", "web-1", "us-east-1a", "running"),
+	})
+	defer server.Close()
+
+	var (
+		mu                sync.Mutex
+		prompts, inFlight int
+	)
+	backend := &Backend{
+		Session: func(opts *Options) (*session.Session, error) {
+			cfg := server.Config(opts.Region).
+				WithCredentials(credentials.NewStaticCredentials(opts.AccessKeyID, opts.SecretAccessKey, ""))
+			return session.NewSession(cfg)
+		},
+		Login: func(opts *Options) error { return errors.New("unexpected login") },
+		EC2:   newEC2Client,
+		//every prompt reads a new code, like a user waiting for the next code of the device
+		MFAToken: func() (string, error) {
+			mu.Lock()
+			prompts++
+			inFlight++
+			code, concurrent := fmt.Sprintf("%06d", prompts), inFlight > 1
+			mu.Unlock()
+			time.Sleep(20 * time.Millisecond)
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+			if concurrent {
+				return "", errors.New("concurrent MFA prompts")
+			}
+			return code, nil
+		},
+	}
+
+	//providers of different regions assume the same chain at once, another chain uses the same MFA device
+	hubs := []string{"hub", "hub", "hub", "hub", "other"}
+	var wg sync.WaitGroup
+	errs := make([]error, len(hubs))
+	for idx, hub := range hubs {
+		wg.Add(1)
+		go func(idx int, hub string) {
+			defer wg.Done()
+			_, errs[idx] = NewWithBackend(&Options{
+				Region:          fmt.Sprintf("us-east-%d", idx+1),
+				AccessKeyID:     "AKIDSTATIC",
+				SecretAccessKey: "SECRET",
+				VPC:             "vpc-1",
+				Tag:             "Name",
+				Roles: []Role{
+					{ARN: "arn:aws:iam::111111111111:role/" + hub, MFASerial: "arn:aws:iam::111111111111:mfa/me"},
+				},
+			}, backend)
+		}(idx, hub)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if prompts != 2 {
+		t.Errorf("got %d MFA prompts, want one per chain", prompts)
+	}
+	if got := len(server.RoleRequests()); got != 2 {
+		t.Errorf("got %d AssumeRole calls, want the credentials of a chain shared by its providers", got)
+	}
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want CredentialsReason
+	}{
+		{"sso token", awserr.New(ssocreds.ErrCodeSSOProviderInvalidToken, "expired", nil), ReasonSSOExpired},
+		{"wrapped sso token", awserr.New("SharedConfigErr", "failed", awserr.New(ssocreds.ErrCodeSSOProviderInvalidToken, "expired", nil)), ReasonSSOExpired},
+		{"no providers", awserr.New("NoCredentialProviders", "no valid providers in chain", nil), ReasonMissing},
+		{"expired token", fmt.Errorf("loading: %w", awserr.New("ExpiredToken", "expired", nil)), ReasonExpired},
+		{"plain error", errors.New("boom"), ReasonUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classify(tt.err); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAccounts(t *testing.T) {
+	tests := []struct {
+		name         string
+		accounts     Accounts
+		denied       []string
+		maxInstances int
+		want         []string
+		wantErr      string
+		wantWarning  bool
+	}{
+		{
+			name:     "organization accounts",
+			accounts: Accounts{Organization: true, RoleName: "xt"},
+			want:     []string{"web-a 111111111111 prod", "web-b 222222222222 staging"},
+		},
+		{
+			name:     "configured account ids",
+			accounts: Accounts{IDs: []string{"222222222222"}, RoleName: "xt"},
+			want:     []string{"web-b 222222222222 "},
+		},
+		{
+			name:     "excluded accounts",
+			accounts: Accounts{Organization: true, Exclude: []string{"111111111111"}, RoleName: "xt"},
+			want:     []string{"web-b 222222222222 staging"},
+		},
+		{
+			name:     "denied role returns the other accounts",
+			accounts: Accounts{Organization: true, RoleName: "xt"},
+			denied:   []string{"arn:aws:iam::222222222222:role/xt"},
+			want:     []string{"web-a 111111111111 prod"},
+			wantErr:  "accounts 222222222222 failed: assuming role xt in account 222222222222",
+		},
+		{
+			name:     "all roles denied",
+			accounts: Accounts{Organization: true, RoleName: "xt"},
+			denied:   []string{"arn:aws:iam::111111111111:role/xt", "arn:aws:iam::222222222222:role/xt"},
+			wantErr:  "accounts 111111111111, 222222222222 failed",
+		},
+		{
+			name:         "max instances across accounts",
+			accounts:     Accounts{Organization: true, RoleName: "xt"},
+			maxInstances: 1,
+			want:         []string{"web-a 111111111111 prod"},
+			wantWarning:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := awstest.NewServer(nil)
+			defer server.Close()
+			server.SetAccounts([]*organizations.Account{
+				{Id: aws.String("111111111111"), Name: aws.String("production"), Status: aws.String("ACTIVE")},
+				{Id: aws.String("222222222222"), Name: aws.String("staging"), Status: aws.String("ACTIVE")},
+				{Id: aws.String("333333333333"), Name: aws.String("closed"), Status: aws.String("SUSPENDED")},
+			})
+			server.SetAccountInstances("111111111111", []*ec2.Instance{testInstance("i-1", "web-a", "us-east-1a", "running")})
+			server.SetAccountInstances("222222222222", []*ec2.Instance{testInstance("i-2", "web-b", "us-east-1a", "running")})
+			server.SetAccountAlias("111111111111", "prod")
+			for _, arn := range tt.denied {
+				server.DenyRole(arn)
+			}
+
+			var logins int
+			backend := testBackend(server, nil, &logins, nil)
+			backend.Organizations = DefaultBackend.Organizations
+			backend.IAM = DefaultBackend.IAM
+			accounts := tt.accounts
+			var warnings []string
+			opts := &Options{
+				Region:       "us-east-1",
+				CredsProfile: "test",
+				Tag:          "Name",
+				Accounts:     &accounts,
+				MaxInstances: tt.maxInstances,
+				Warn:         func(message string) { warnings = append(warnings, message) },
+			}
+
+			p, err := NewWithBackend(opts, backend)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			instances, err := p.Get()
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("got error %v, want %q", err, tt.wantErr)
+			}
+			if got := len(warnings) > 0; got != tt.wantWarning {
+				t.Errorf("got warnings %q, want a warning %v", warnings, tt.wantWarning)
+			}
+			var got []string
+			for _, inst := range instances {
+				got = append(got, fmt.Sprintf("%s %s %s", inst.InstanceName, inst.AccountID, inst.AccountAlias))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAccountsConcurrency(t *testing.T) {
+	server := awstest.NewServer(nil)
+	defer server.Close()
+	var ids []string
+	for idx := 0; idx < 3*maxAccountSearches; idx++ {
+		id := fmt.Sprintf("%012d", idx+1)
+		ids = append(ids, id)
+		server.SetAccountInstances(id, []*ec2.Instance{testInstance("i-"+id, "web-"+id, "us-east-1a", "running")})
+	}
+	server.SetDelay(20 * time.Millisecond)
+
+	var logins int
+	backend := testBackend(server, nil, &logins, nil)
+	backend.IAM = DefaultBackend.IAM
+	p, err := NewWithBackend(&Options{
+		Region:       "us-east-1",
+		CredsProfile: "test",
+		Tag:          "Name",
+		Accounts:     &Accounts{IDs: ids, RoleName: "xt"},
+	}, backend)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	instances, err := p.Get()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(instances) != len(ids) {
+		t.Errorf("got %d instances, want one per account", len(instances))
+	}
+	for _, action := range []string{"AssumeRole", "DescribeInstances"} {
+		if peak := server.PeakRequests(action); peak < 2 || peak > maxAccountSearches {
+			t.Errorf("got %d %s calls at once, want accounts searched concurrently up to %d at once", peak, action, maxAccountSearches)
+		}
+	}
+}
+
+func TestQueryPushdown(t *testing.T) {
+	server := awstest.NewServer([]*ec2.Instance{
+		testInstance("i-1", "web-1", "us-east-1a", "running", "role", "frontend"),
+		testInstance("i-2", "web-2", "us-east-1b", "running", "role", "frontend"),
+		testInstance("i-3", "web-3", "us-east-1a", "stopped", "role", "frontend"),
+	})
+	defer server.Close()
+
+	expr, err := query.Parse("role=frontend AND az=us-east-1a AND NOT state=stopped AND ip=10.0.0.0/8")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	opts := &Options{VPC: "vpc-1", Region: "us-east-1", CredsProfile: "test", Tag: "Name", Query: expr}
+	var logins int
+	p, err := NewWithBackend(opts, testBackend(server, nil, &logins, nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	instances, err := p.Get()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	//only the terms EC2 evaluates are pushed down, the rest is left to the caller
+	if got := instances.Names(); !reflect.DeepEqual(got, []string{"web-1", "web-3"}) {
+		t.Errorf("got %v, want [web-1 web-3]", got)
+	}
+	want := map[string][]string{
+		"vpc-id":            {"vpc-1"},
+		"tag:role":          {"frontend"},
+		"availability-zone": {"us-east-1a"},
+	}
+	if got := server.Requests()[0].Filters; !reflect.DeepEqual(got, want) {
+		t.Errorf("got filters %v, want %v", got, want)
+	}
+}
+
+func TestInstanceSessions(t *testing.T) {
+	server := awstest.NewServer(nil)
+	defer server.Close()
+	server.SetAccountInstances("333333333333", []*ec2.Instance{testInstance("i-1", "web-1", "us-east-1a", "running")})
+
+	backend := &Backend{
+		Session: func(opts *Options) (*session.Session, error) {
+			cfg := server.Config(opts.Region).
+				WithCredentials(credentials.NewStaticCredentials(opts.AccessKeyID, opts.SecretAccessKey, ""))
+			return session.NewSession(cfg)
+		},
+		Login:    func(opts *Options) error { return errors.New("unexpected login") },
+		EC2:      newEC2Client,
+		IAM:      DefaultBackend.IAM,
+		MFAToken: func() (string, error) { return "123456", nil },
+	}
+	opts := &Options{
+		Region:          "us-east-1",
+		AccessKeyID:     "AKIDSTATIC",
+		SecretAccessKey: "SECRET",
+		Tag:             "Name",
+		Roles: []Role{
+			{ARN: "arn:aws:iam::111111111111:role/hub", MFASerial: "arn:aws:iam::111111111111:mfa/me", SessionName: "hub"},
+			{ARN: "arn:aws:iam::222222222222:role/spoke", SessionName: "spoke"},
+		},
+		Accounts: &Accounts{IDs: []string{"333333333333"}, RoleName: "xt"},
+	}
+	p, err := NewWithBackend(opts, backend)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	instances, err := p.Get()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cached := append(instance.XTInstances{}, instances...)
+	SetSessionsWithBackend(opts, backend, cached)
+
+	//keys are issued in order: hub, spoke and account roles for discovery, then spoke and account roles for the
+	//cached instances, which share the credentials of the MFA hub role instead of using its code again
+	for _, tt := range []struct {
+		name      string
+		instances instance.XTInstances
+		wantKey   string
+	}{
+		{"discovered", instances, "ASIATEST3"},
+		{"cached", cached, "ASIATEST5"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if len(tt.instances) != 1 {
+				t.Fatalf("got %d instances, want 1", len(tt.instances))
+			}
+			inst := tt.instances[0]
+			if inst.Session == nil {
+				t.Fatal("instance has no session")
+			}
+			sess, err := inst.Session()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			creds, err := sess.Config.Credentials.Get()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if creds.AccessKeyID != tt.wantKey {
+				t.Errorf("got access key %s, want %s", creds.AccessKeyID, tt.wantKey)
+			}
+		})
+	}
+	if got := len(server.RoleRequests()); got != 5 {
+		t.Errorf("got %d AssumeRole calls, want the chain after the MFA role assumed once for discovery and once for the cache", got)
+	}
+}
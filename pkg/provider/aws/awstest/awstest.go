@@ -0,0 +1,624 @@
+//Package awstest provides an in memory EC2, STS, IAM and Organizations API server for testing the AWS provider offline
+package awstest
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/organizations"
+)
+
+const (
+	xmlns    = "http://ec2.amazonaws.com/doc/2016-11-15/"
+	stsXmlns = "https://sts.amazonaws.com/doc/2011-06-15/"
+	iamXmlns = "https://iam.amazonaws.com/doc/2010-05-08/"
+)
+
+//Server is a fake EC2 endpoint serving DescribeInstances from a fixed set of instances.
+//It also answers STS AssumeRole calls with generated credentials, requests signed with them
+//are served from the instances and alias of the account of the assumed role.
+//Like STS, it rejects MFA codes that were already used with the same device.
+type Server struct {
+	*httptest.Server
+
+	mu               sync.Mutex
+	instances        []*ec2.Instance
+	ownerID          string
+	requests         []Request
+	roles            []RoleRequest
+	deniedRoles      map[string]bool
+	usedCodes        map[string]bool
+	accounts         []*organizations.Account
+	accountInstances map[string][]*ec2.Instance
+	aliases          map[string]string
+	//keys maps issued access keys to the account of the assumed role
+	keys map[string]string
+	//delay slows down every request, inFlight and peak count the requests of every action being served
+	delay          time.Duration
+	inFlight, peak map[string]int
+}
+
+//Request records the parameters of a DescribeInstances call
+type Request struct {
+	Filters     map[string][]string
+	MaxResults  int
+	NextToken   string
+	AccessKeyID string
+	//SigningRegion is the region of the request signature
+	SigningRegion string
+}
+
+//RoleRequest records the parameters of an AssumeRole call
+type RoleRequest struct {
+	RoleARN      string
+	ExternalID   string
+	SerialNumber string
+	TokenCode    string
+	SessionName  string
+	AccessKeyID  string
+}
+
+//NewServer starts a fake EC2 endpoint, it must be closed by the caller
+func NewServer(instances []*ec2.Instance) *Server {
+	s := newServer(instances)
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+//NewTLSServer starts a fake EC2 endpoint serving HTTPS with a self signed certificate
+func NewTLSServer(instances []*ec2.Instance) *Server {
+	s := newServer(instances)
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(s.handle))
+	//clients rejecting the certificate are expected, do not log their handshakes
+	s.Server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	s.StartTLS()
+	return s
+}
+
+func newServer(instances []*ec2.Instance) *Server {
+	return &Server{
+		instances:        instances,
+		ownerID:          "123456789012",
+		deniedRoles:      make(map[string]bool),
+		usedCodes:        make(map[string]bool),
+		accountInstances: make(map[string][]*ec2.Instance),
+		aliases:          make(map[string]string),
+		keys:             make(map[string]string),
+		inFlight:         make(map[string]int),
+		peak:             make(map[string]int),
+	}
+}
+
+//SetInstances replaces the instances served
+func (s *Server) SetInstances(instances []*ec2.Instance) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.instances = instances
+}
+
+//Requests returns the DescribeInstances calls received
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request{}, s.requests...)
+}
+
+//RoleRequests returns the AssumeRole calls received
+func (s *Server) RoleRequests() []RoleRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]RoleRequest{}, s.roles...)
+}
+
+//DenyRole makes AssumeRole calls of arn fail with AccessDenied
+func (s *Server) DenyRole(arn string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deniedRoles[arn] = true
+}
+
+//SetAccounts sets the accounts listed by the organization
+func (s *Server) SetAccounts(accounts []*organizations.Account) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accounts = accounts
+}
+
+//SetAccountInstances sets the instances served to roles assumed in account id
+func (s *Server) SetAccountInstances(id string, instances []*ec2.Instance) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accountInstances[id] = instances
+}
+
+//SetAccountAlias sets the IAM alias of account id
+func (s *Server) SetAccountAlias(id, alias string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.aliases[id] = alias
+}
+
+//SetDelay slows down every request by delay
+func (s *Server) SetDelay(delay time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.delay = delay
+}
+
+//PeakRequests returns the most requests of action served at once
+func (s *Server) PeakRequests(action string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peak[action]
+}
+
+//serve counts a request of action being served and waits for the delay, done is called once it was served
+func (s *Server) serve(action string) (done func()) {
+	s.mu.Lock()
+	s.inFlight[action]++
+	if s.inFlight[action] > s.peak[action] {
+		s.peak[action] = s.inFlight[action]
+	}
+	delay := s.delay
+	s.mu.Unlock()
+	time.Sleep(delay)
+	return func() {
+		s.mu.Lock()
+		s.inFlight[action]--
+		s.mu.Unlock()
+	}
+}
+
+//Session returns a session with static credentials using the server as EC2 endpoint
+func (s *Server) Session(region string) *session.Session {
+	return session.Must(session.NewSession(s.Config(region)))
+}
+
+//Config returns an AWS config with static credentials using the server as EC2 endpoint
+func (s *Server) Config(region string) *aws.Config {
+	//sessions created at once must not load AWS_CA_BUNDLE into the shared default client
+	return aws.NewConfig().
+		WithHTTPClient(&http.Client{}).
+		WithRegion(region).
+		WithEndpoint(s.URL).
+		WithCredentials(credentials.NewStaticCredentials("AKIDTEST", "SECRETTEST", ""))
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	if target := r.Header.Get("X-Amz-Target"); target != "" {
+		defer s.serve(target)()
+		s.handleJSON(w, r, target)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeError(w, "InvalidRequest", err.Error())
+		return
+	}
+	action := r.Form.Get("Action")
+	defer s.serve(action)()
+	switch action {
+	case "DescribeInstances":
+		s.describeInstances(w, r)
+	case "AssumeRole":
+		s.assumeRole(w, r)
+	case "ListAccountAliases":
+		s.listAccountAliases(w, r)
+	default:
+		writeError(w, "InvalidAction", fmt.Sprintf("action %s is not supported", action))
+	}
+}
+
+func (s *Server) describeInstances(w http.ResponseWriter, r *http.Request) {
+	req := Request{
+		Filters:       parseFilters(r),
+		NextToken:     r.Form.Get("NextToken"),
+		AccessKeyID:   accessKeyID(r),
+		SigningRegion: signingRegion(r),
+	}
+	req.MaxResults, _ = strconv.Atoi(r.Form.Get("MaxResults"))
+
+	s.mu.Lock()
+	s.requests = append(s.requests, req)
+	instances := s.instances
+	if account, ok := s.keys[req.AccessKeyID]; ok {
+		instances = s.accountInstances[account]
+	}
+	s.mu.Unlock()
+
+	var matched []*ec2.Instance
+	for _, inst := range instances {
+		ok, err := matchFilters(inst, req.Filters)
+		if err != nil {
+			writeError(w, "InvalidParameterValue", err.Error())
+			return
+		}
+		if ok {
+			matched = append(matched, inst)
+		}
+	}
+
+	start, _ := strconv.Atoi(req.NextToken)
+	end := len(matched)
+	if req.MaxResults > 0 && start+req.MaxResults < end {
+		end = start + req.MaxResults
+	}
+	if start > end {
+		start = end
+	}
+
+	resp := describeInstancesResponse{Xmlns: xmlns, RequestID: "req-1"}
+	if end < len(matched) {
+		resp.NextToken = strconv.Itoa(end)
+	}
+	for idx, inst := range matched[start:end] {
+		resp.Reservations = append(resp.Reservations, reservation{
+			ReservationID: fmt.Sprintf("r-%d", start+idx),
+			OwnerID:       s.ownerID,
+			Instances:     []instance{toXML(inst)},
+		})
+	}
+
+	w.Header().Set("Content-Type", "text/xml")
+	_ = xml.NewEncoder(w).Encode(resp)
+}
+
+func (s *Server) assumeRole(w http.ResponseWriter, r *http.Request) {
+	req := RoleRequest{
+		RoleARN:      r.Form.Get("RoleArn"),
+		ExternalID:   r.Form.Get("ExternalId"),
+		SerialNumber: r.Form.Get("SerialNumber"),
+		TokenCode:    r.Form.Get("TokenCode"),
+		SessionName:  r.Form.Get("RoleSessionName"),
+		AccessKeyID:  accessKeyID(r),
+	}
+
+	s.mu.Lock()
+	s.roles = append(s.roles, req)
+	idx := len(s.roles)
+	denied := s.deniedRoles[req.RoleARN]
+	code := req.SerialNumber + "/" + req.TokenCode
+	reused := req.SerialNumber != "" && s.usedCodes[code]
+	key := fmt.Sprintf("ASIATEST%d", idx)
+	if !denied && !reused {
+		s.keys[key] = roleAccount(req.RoleARN)
+		if req.SerialNumber != "" {
+			s.usedCodes[code] = true
+		}
+	}
+	s.mu.Unlock()
+
+	if denied {
+		writeSTSError(w, "AccessDenied", fmt.Sprintf("not authorized to perform sts:AssumeRole on %s", req.RoleARN))
+		return
+	}
+	if reused {
+		writeSTSError(w, "AccessDenied", "MultiFactorAuthentication failed with invalid MFA one time pass code")
+		return
+	}
+
+	resp := assumeRoleResponse{Xmlns: stsXmlns, RequestID: "req-1"}
+	resp.Result.Credentials = stsCredentials{
+		AccessKeyID:     key,
+		SecretAccessKey: "SECRETTEST",
+		SessionToken:    "TOKENTEST",
+		Expiration:      time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+	}
+	resp.Result.User = assumedRoleUser{
+		ARN:           req.RoleARN + "/" + req.SessionName,
+		AssumedRoleID: fmt.Sprintf("AROATEST%d:%s", idx, req.SessionName),
+	}
+
+	w.Header().Set("Content-Type", "text/xml")
+	_ = xml.NewEncoder(w).Encode(resp)
+}
+
+func (s *Server) listAccountAliases(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	alias := s.aliases[s.keys[accessKeyID(r)]]
+	s.mu.Unlock()
+
+	resp := listAccountAliasesResponse{Xmlns: iamXmlns, RequestID: "req-1"}
+	if alias != "" {
+		resp.Aliases = []string{alias}
+	}
+	w.Header().Set("Content-Type", "text/xml")
+	_ = xml.NewEncoder(w).Encode(resp)
+}
+
+//handleJSON serves the JSON protocol APIs
+func (s *Server) handleJSON(w http.ResponseWriter, r *http.Request, target string) {
+	if target != "AWSOrganizationsV20161128.ListAccounts" {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"__type":  "InvalidAction",
+			"message": fmt.Sprintf("target %s is not supported", target),
+		})
+		return
+	}
+
+	s.mu.Lock()
+	accounts := s.accounts
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	_ = json.NewEncoder(w).Encode(&organizations.ListAccountsOutput{Accounts: accounts})
+}
+
+//roleAccount returns the account ID of a role ARN
+func roleAccount(arn string) string {
+	parts := strings.Split(arn, ":")
+	if len(parts) < 5 {
+		return ""
+	}
+	return parts[4]
+}
+
+//accessKeyID returns the access key a request was signed with
+func accessKeyID(r *http.Request) string {
+	return credentialScope(r)[0]
+}
+
+//signingRegion returns the region a request was signed for
+func signingRegion(r *http.Request) string {
+	return credentialScope(r)[2]
+}
+
+//credentialScope returns the access key, date, region and service of the signature of a request
+func credentialScope(r *http.Request) []string {
+	scope := make([]string, 4)
+	auth := r.Header.Get("Authorization")
+	idx := strings.Index(auth, "Credential=")
+	if idx < 0 {
+		return scope
+	}
+	credential := strings.SplitN(auth[idx+len("Credential="):], ",", 2)[0]
+	copy(scope, strings.Split(credential, "/"))
+	return scope
+}
+
+//parseFilters reads Filter.N.Name and Filter.N.Value.M query parameters
+func parseFilters(r *http.Request) map[string][]string {
+	filters := make(map[string][]string)
+	for n := 1; ; n++ {
+		name := r.Form.Get(fmt.Sprintf("Filter.%d.Name", n))
+		if name == "" {
+			return filters
+		}
+		for m := 1; ; m++ {
+			value, ok := r.Form[fmt.Sprintf("Filter.%d.Value.%d", n, m)]
+			if !ok {
+				break
+			}
+			filters[name] = append(filters[name], value...)
+		}
+	}
+}
+
+func matchFilters(inst *ec2.Instance, filters map[string][]string) (bool, error) {
+	names := make([]string, 0, len(filters))
+	for name := range filters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		value, ok, err := field(inst, name)
+		if err != nil {
+			return false, err
+		}
+		if !ok || !matchAny(filters[name], value) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func field(inst *ec2.Instance, name string) (string, bool, error) {
+	if strings.HasPrefix(name, "tag:") {
+		key := strings.TrimPrefix(name, "tag:")
+		for _, t := range inst.Tags {
+			if aws.StringValue(t.Key) == key {
+				return aws.StringValue(t.Value), true, nil
+			}
+		}
+		return "", false, nil
+	}
+
+	switch name {
+	case "vpc-id":
+		return aws.StringValue(inst.VpcId), true, nil
+	case "instance-id":
+		return aws.StringValue(inst.InstanceId), true, nil
+	case "instance-type":
+		return aws.StringValue(inst.InstanceType), true, nil
+	case "subnet-id":
+		return aws.StringValue(inst.SubnetId), true, nil
+	case "private-ip-address":
+		return aws.StringValue(inst.PrivateIpAddress), true, nil
+	case "ip-address":
+		return aws.StringValue(inst.PublicIpAddress), true, nil
+	case "instance-lifecycle":
+		return aws.StringValue(inst.InstanceLifecycle), true, nil
+	case "availability-zone":
+		if inst.Placement == nil {
+			return "", false, nil
+		}
+		return aws.StringValue(inst.Placement.AvailabilityZone), true, nil
+	case "instance-state-name":
+		if inst.State == nil {
+			return "", false, nil
+		}
+		return aws.StringValue(inst.State.Name), true, nil
+	default:
+		return "", false, fmt.Errorf("the filter '%s' is invalid", name)
+	}
+}
+
+func matchAny(patterns []string, value string) bool {
+	for _, p := range patterns {
+		if ok, err := path.Match(p, value); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+func writeError(w http.ResponseWriter, code, message string) {
+	w.Header().Set("Content-Type", "text/xml")
+	w.WriteHeader(http.StatusBadRequest)
+	_ = xml.NewEncoder(w).Encode(errorResponse{
+		Errors:    []apiError{{Code: code, Message: message}},
+		RequestID: "req-1",
+	})
+}
+
+//writeSTSError writes an error in the query protocol format used by STS
+func writeSTSError(w http.ResponseWriter, code, message string) {
+	w.Header().Set("Content-Type", "text/xml")
+	w.WriteHeader(http.StatusForbidden)
+	_ = xml.NewEncoder(w).Encode(stsErrorResponse{
+		Error:     stsError{Type: "Sender", Code: code, Message: message},
+		RequestID: "req-1",
+	})
+}
+
+type stsErrorResponse struct {
+	XMLName   xml.Name `xml:"ErrorResponse"`
+	Error     stsError `xml:"Error"`
+	RequestID string   `xml:"RequestId"`
+}
+
+type stsError struct {
+	Type    string `xml:"Type"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+type errorResponse struct {
+	XMLName   xml.Name   `xml:"Response"`
+	Errors    []apiError `xml:"Errors>Error"`
+	RequestID string     `xml:"RequestID"`
+}
+
+type apiError struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+type assumeRoleResponse struct {
+	XMLName xml.Name `xml:"AssumeRoleResponse"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Result  struct {
+		Credentials stsCredentials  `xml:"Credentials"`
+		User        assumedRoleUser `xml:"AssumedRoleUser"`
+	} `xml:"AssumeRoleResult"`
+	RequestID string `xml:"ResponseMetadata>RequestId"`
+}
+
+type listAccountAliasesResponse struct {
+	XMLName   xml.Name `xml:"ListAccountAliasesResponse"`
+	Xmlns     string   `xml:"xmlns,attr"`
+	Aliases   []string `xml:"ListAccountAliasesResult>AccountAliases>member"`
+	RequestID string   `xml:"ResponseMetadata>RequestId"`
+}
+
+type stsCredentials struct {
+	AccessKeyID     string `xml:"AccessKeyId"`
+	SecretAccessKey string `xml:"SecretAccessKey"`
+	SessionToken    string `xml:"SessionToken"`
+	Expiration      string `xml:"Expiration"`
+}
+
+type assumedRoleUser struct {
+	ARN           string `xml:"Arn"`
+	AssumedRoleID string `xml:"AssumedRoleId"`
+}
+
+type describeInstancesResponse struct {
+	XMLName      xml.Name      `xml:"DescribeInstancesResponse"`
+	Xmlns        string        `xml:"xmlns,attr"`
+	RequestID    string        `xml:"requestId"`
+	Reservations []reservation `xml:"reservationSet>item"`
+	NextToken    string        `xml:"nextToken,omitempty"`
+}
+
+type reservation struct {
+	ReservationID string     `xml:"reservationId"`
+	OwnerID       string     `xml:"ownerId"`
+	Instances     []instance `xml:"instancesSet>item"`
+}
+
+type instance struct {
+	InstanceID        string         `xml:"instanceId,omitempty"`
+	ImageID           string         `xml:"imageId,omitempty"`
+	State             *instanceState `xml:"instanceState,omitempty"`
+	PrivateDNSName    string         `xml:"privateDnsName,omitempty"`
+	PublicDNSName     string         `xml:"dnsName,omitempty"`
+	InstanceType      string         `xml:"instanceType,omitempty"`
+	LaunchTime        string         `xml:"launchTime,omitempty"`
+	Placement         *placement     `xml:"placement,omitempty"`
+	SubnetID          string         `xml:"subnetId,omitempty"`
+	VpcID             string         `xml:"vpcId,omitempty"`
+	PrivateIPAddress  string         `xml:"privateIpAddress,omitempty"`
+	PublicIPAddress   string         `xml:"ipAddress,omitempty"`
+	InstanceLifecycle string         `xml:"instanceLifecycle,omitempty"`
+	Tags              []tag          `xml:"tagSet>item"`
+}
+
+type instanceState struct {
+	Code int64  `xml:"code"`
+	Name string `xml:"name"`
+}
+
+type placement struct {
+	AvailabilityZone string `xml:"availabilityZone"`
+}
+
+type tag struct {
+	Key   string `xml:"key"`
+	Value string `xml:"value"`
+}
+
+func toXML(inst *ec2.Instance) instance {
+	out := instance{
+		InstanceID:        aws.StringValue(inst.InstanceId),
+		ImageID:           aws.StringValue(inst.ImageId),
+		PrivateDNSName:    aws.StringValue(inst.PrivateDnsName),
+		PublicDNSName:     aws.StringValue(inst.PublicDnsName),
+		InstanceType:      aws.StringValue(inst.InstanceType),
+		SubnetID:          aws.StringValue(inst.SubnetId),
+		VpcID:             aws.StringValue(inst.VpcId),
+		PrivateIPAddress:  aws.StringValue(inst.PrivateIpAddress),
+		PublicIPAddress:   aws.StringValue(inst.PublicIpAddress),
+		InstanceLifecycle: aws.StringValue(inst.InstanceLifecycle),
+	}
+	if inst.State != nil {
+		out.State = &instanceState{Code: aws.Int64Value(inst.State.Code), Name: aws.StringValue(inst.State.Name)}
+	}
+	if inst.LaunchTime != nil {
+		out.LaunchTime = inst.LaunchTime.UTC().Format(time.RFC3339)
+	}
+	if inst.Placement != nil {
+		out.Placement = &placement{AvailabilityZone: aws.StringValue(inst.Placement.AvailabilityZone)}
+	}
+	for _, t := range inst.Tags {
+		out.Tags = append(out.Tags, tag{Key: aws.StringValue(t.Key), Value: aws.StringValue(t.Value)})
+	}
+	return out
+}
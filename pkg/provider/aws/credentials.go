@@ -0,0 +1,201 @@
+package aws
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/ssocreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sso"
+)
+
+//CredentialsReason classifies why credentials could not be loaded
+type CredentialsReason int
+
+const (
+	//ReasonUnknown is any error not classified below
+	ReasonUnknown CredentialsReason = iota
+	//ReasonSSOExpired means the sso session expired or was never started, a login refreshes it
+	ReasonSSOExpired
+	//ReasonMissing means no credentials are configured for the profile
+	ReasonMissing
+	//ReasonExpired means static or temporary credentials expired and must be replaced
+	ReasonExpired
+)
+
+func (r CredentialsReason) String() string {
+	switch r {
+	case ReasonSSOExpired:
+		return "sso session expired"
+	case ReasonMissing:
+		return "no credentials found"
+	case ReasonExpired:
+		return "credentials expired"
+	default:
+		return "credentials could not be loaded"
+	}
+}
+
+//CredentialsError is returned when the credentials a provider starts from cannot be loaded
+type CredentialsError struct {
+	Source string
+	Reason CredentialsReason
+	Hint   string
+	Err    error
+}
+
+func (e *CredentialsError) Error() string {
+	msg := fmt.Sprintf("loading %s: %s", e.Source, e.Reason)
+	if e.Hint != "" {
+		msg += ", " + e.Hint
+	}
+	return fmt.Sprintf("%s: %s", msg, e.Err)
+}
+
+func (e *CredentialsError) Unwrap() error {
+	return e.Err
+}
+
+//classify returns the reason of a credentials error by walking the aws error chain
+func classify(err error) CredentialsReason {
+	for err != nil {
+		var aerr awserr.Error
+		if !errors.As(err, &aerr) {
+			return ReasonUnknown
+		}
+		switch aerr.Code() {
+		case ssocreds.ErrCodeSSOProviderInvalidToken, sso.ErrCodeUnauthorizedException:
+			return ReasonSSOExpired
+		case "NoCredentialProviders", "EnvAccessKeyNotFound", "SharedCredsLoad", "SharedCredsAccessKey":
+			return ReasonMissing
+		case "ExpiredToken", "ExpiredTokenException", "RequestExpired":
+			return ReasonExpired
+		}
+		err = aerr.OrigErr()
+	}
+	return ReasonUnknown
+}
+
+//baseCredentials checks the credentials the role chain starts from.
+//Expired sso sessions are refreshed by logging in, unless disabled, and the credentials are loaded again.
+func baseCredentials(sess *session.Session, opts *Options, backend *Backend) error {
+	_, err := sess.Config.Credentials.Get()
+	if err == nil {
+		return nil
+	}
+
+	credsErr := &CredentialsError{
+		Source: fmt.Sprintf("credentials of profile %s", opts.CredsProfile),
+		Reason: classify(err),
+		Err:    err,
+	}
+	if opts.AccessKeyID != "" {
+		credsErr.Source = "static credentials"
+		return credsErr
+	}
+	if credsErr.Reason != ReasonSSOExpired {
+		return credsErr
+	}
+	if opts.NoLogin {
+		credsErr.Hint = fmt.Sprintf("run aws sso login --profile %s (login disabled)", opts.CredsProfile)
+		return credsErr
+	}
+
+	if err := backend.login(opts); err != nil {
+		credsErr.Hint = "sso login failed"
+		credsErr.Err = err
+		return credsErr
+	}
+
+	sess.Config.Credentials.Expire()
+	if _, err := sess.Config.Credentials.Get(); err != nil {
+		credsErr.Reason = classify(err)
+		credsErr.Hint = "still invalid after sso login"
+		credsErr.Err = err
+		return credsErr
+	}
+	return nil
+}
+
+//login runs Login once per creds profile, providers sharing a profile wait for and reuse the first result
+func (b *Backend) login(opts *Options) error {
+	b.loginMu.Lock()
+	defer b.loginMu.Unlock()
+
+	if err, ok := b.logins[opts.CredsProfile]; ok {
+		return err
+	}
+	if b.logins == nil {
+		b.logins = make(map[string]error)
+	}
+	err := b.Login(opts)
+	b.logins[opts.CredsProfile] = err
+	return err
+}
+
+//mfaToken reads an MFA code, roles of different chains are assumed concurrently and only one prompt may read stdin
+func (b *Backend) mfaToken() (string, error) {
+	b.tokenMu.Lock()
+	defer b.tokenMu.Unlock()
+	return b.MFAToken()
+}
+
+//mfaRole holds the credentials of a role requiring MFA, shared by the providers assuming it through the same chain
+type mfaRole struct {
+	mu    sync.Mutex
+	creds *credentials.Credentials
+}
+
+//assumeMFARole returns a session using the credentials of r, a role requiring MFA assumed after chain.
+//STS rejects MFA codes that were already used, so providers assuming r through the same chain assume it once
+//and share its credentials, which prompt again for a new code when they expire.
+func (b *Backend) assumeMFARole(sess *session.Session, r Role, chain string) (*session.Session, error) {
+	b.mfaMu.Lock()
+	if b.mfaRoles == nil {
+		b.mfaRoles = make(map[string]*mfaRole)
+	}
+	role, ok := b.mfaRoles[chain]
+	if !ok {
+		role = &mfaRole{}
+		b.mfaRoles[chain] = role
+	}
+	b.mfaMu.Unlock()
+
+	role.mu.Lock()
+	defer role.mu.Unlock()
+	if role.creds == nil {
+		assumed, err := assumeRole(sess, r, b)
+		if err != nil {
+			return nil, err
+		}
+		role.creds = assumed.Config.Credentials
+	}
+	return sess.Copy(&aws.Config{Credentials: role.creds}), nil
+}
+
+//ssoLogin runs aws sso login, streaming its prompts and device code to the login output
+func ssoLogin(opts *Options) error {
+	binary := "aws"
+	if _, err := exec.LookPath(binary); err != nil {
+		return err
+	}
+
+	out := opts.LoginOutput
+	if out == nil {
+		out = os.Stderr
+	}
+	fmt.Fprintf(out, "Logging in to AWS SSO profile %s\n", opts.CredsProfile)
+
+	args := []string{"sso", "login", "--profile", opts.CredsProfile}
+	cmd := exec.Command(binary, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = out
+	cmd.Stderr = out
+	return cmd.Run()
+}
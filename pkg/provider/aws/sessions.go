@@ -0,0 +1,103 @@
+package aws
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/adamkobi/xt/internal/instance"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+//sessions creates the sessions of a provider at most once, they are shared with the instances the provider
+//finds so commands reach an instance with the credentials, roles and account it was found with
+type sessions struct {
+	opts    *Options
+	backend *Backend
+
+	mu       sync.Mutex
+	base     *session.Session
+	accounts map[string]*accountSession
+}
+
+//accountSession is the session of the role assumed in an account
+type accountSession struct {
+	mu   sync.Mutex
+	sess *session.Session
+}
+
+func newSessions(opts *Options, backend *Backend) *sessions {
+	return &sessions{opts: opts, backend: backend, accounts: make(map[string]*accountSession)}
+}
+
+//get returns the session of the provider credentials after assuming its roles
+func (s *sessions) get() (*session.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.base != nil {
+		return s.base, nil
+	}
+	sess, err := newSession(s.opts, s.backend)
+	if err != nil {
+		return nil, err
+	}
+	s.base = sess
+	return sess, nil
+}
+
+//account returns the session of the role assumed in account id. Roles of different accounts are assumed
+//concurrently, callers of the same account wait for the role to be assumed once.
+func (s *sessions) account(id string) (*session.Session, error) {
+	base, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	a, ok := s.accounts[id]
+	if !ok {
+		a = &accountSession{}
+		s.accounts[id] = a
+	}
+	s.mu.Unlock()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.sess != nil {
+		return a.sess, nil
+	}
+	opts := s.opts.Accounts
+	sess, err := assumeRole(base, Role{
+		ARN:         opts.roleARN(id),
+		ExternalID:  opts.ExternalID,
+		SessionName: opts.SessionName,
+	}, s.backend)
+	if err != nil {
+		return nil, fmt.Errorf("assuming role %s in account %s: %w", opts.RoleName, id, err)
+	}
+	a.sess = sess
+	return sess, nil
+}
+
+//set sets the session of instances to the session of the account they were found in
+func (s *sessions) set(instances instance.XTInstances) {
+	for idx := range instances {
+		account := instances[idx].AccountID
+		instances[idx].Session = func() (*session.Session, error) {
+			if account == "" || s.opts.Accounts == nil {
+				return s.get()
+			}
+			return s.account(account)
+		}
+	}
+}
+
+//SetSessions sets the session of instances found with opts whose results were read from the cache,
+//credentials are only read and roles only assumed once a command needs the session
+func SetSessions(opts *Options, instances instance.XTInstances) {
+	SetSessionsWithBackend(opts, DefaultBackend, instances)
+}
+
+//SetSessionsWithBackend sets the session of instances read from the cache using backend to create it
+func SetSessionsWithBackend(opts *Options, backend *Backend, instances instance.XTInstances) {
+	newSessions(opts, backend).set(instances)
+}
@@ -2,14 +2,18 @@ package provider
 
 import (
 	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
 
 	"github.com/adamkobi/xt/internal/instance"
 	awsProvider "github.com/adamkobi/xt/pkg/provider/aws"
+	staticProvider "github.com/adamkobi/xt/pkg/provider/static"
+	"github.com/adamkobi/xt/pkg/query"
 )
 
-var supportedProviders = [1]string{"aws"}
-
-//Options is all the options AWSProvider can receive
+//Options is all the options a provider can receive
 type Options struct {
 	Name            string
 	VPC             string
@@ -17,36 +21,195 @@ type Options struct {
 	CredsProfile    string
 	AccessKeyID     string
 	SecretAccessKey string
+	SessionToken    string
+	Roles           []Role
 	Tag             string
 	SearchPattern   string
-	Filters         map[string]string
+	//Query is evaluated on the instances returned, providers may use it to narrow their search
+	Query         query.Expr
+	Filters       map[string]string
+	States        []string
+	PageSize      int64
+	MaxInstances  int
+	Endpoint      string
+	Insecure      bool
+	DisableSSL    bool
+	SigningRegion string
+	NoLogin       bool
+	LoginOutput   io.Writer
+	//Warn receives warnings about the search, such as results capped by MaxInstances
+	Warn     func(message string)
+	Accounts *Accounts
+	Settings map[string]string
+}
+
+//Role describes a role assumed to reach the provider
+type Role struct {
+	ARN         string
+	ExternalID  string
+	MFASerial   string
+	SessionName string
+}
+
+//Accounts selects the accounts a provider searches, assuming RoleName in each of them
+type Accounts struct {
+	Organization bool
+	IDs          []string
+	Exclude      []string
+	RoleName     string
+	ExternalID   string
+	SessionName  string
 }
 
 //Provider is an interface describing actions in cloud provider
 type Provider interface {
+	//Get returns the instances found. When only part of the search failed, such as some accounts,
+	//the instances found are returned with the error, a nil slice is returned when nothing was searched.
 	Get() (instance.XTInstances, error)
 }
 
+//Factory creates a provider from the options of a single profile provider entry
+type Factory func(options *Options) (Provider, error)
+
+//SessionSetter sets the fields of instances read from the cache that are not cached, such as the session
+//used to reach them. Providers whose instances are complete when read from the cache do not register one.
+type SessionSetter func(options *Options, instances instance.XTInstances)
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Factory)
+	setters    = make(map[string]SessionSetter)
+)
+
+func init() {
+	Register("aws", newAWS)
+	RegisterSessionSetter("aws", setAWSSessions)
+	Register("static", newStatic)
+}
+
+//Register makes a provider available by name, it panics if the name is already registered
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if factory == nil {
+		panic("provider: Register factory is nil")
+	}
+	if _, dup := registry[name]; dup {
+		panic("provider: Register called twice for provider " + name)
+	}
+	registry[name] = factory
+}
+
+//RegisterSessionSetter sets the session setter of the provider name,
+//it panics if the provider is not registered or already has a session setter
+func RegisterSessionSetter(name string, setter SessionSetter) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if setter == nil {
+		panic("provider: RegisterSessionSetter setter is nil")
+	}
+	if _, ok := registry[name]; !ok {
+		panic("provider: RegisterSessionSetter called for unregistered provider " + name)
+	}
+	if _, dup := setters[name]; dup {
+		panic("provider: RegisterSessionSetter called twice for provider " + name)
+	}
+	setters[name] = setter
+}
+
+//Providers returns a sorted list of the registered provider names
+func Providers() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	var names []string
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 //New creates a new provider according to the provider type
 func New(options *Options) (Provider, error) {
-	switch options.Name {
-	case "aws":
-		opts := &awsProvider.Options{
-			VPC:             options.VPC,
-			Region:          options.Region,
-			CredsProfile:    options.CredsProfile,
-			AccessKeyID:     options.AccessKeyID,
-			SecretAccessKey: options.SecretAccessKey,
-			Tag:             options.Tag,
-			SearchPattern:   options.SearchPattern,
-			Filters:         options.Filters,
-		}
-		p, err := awsProvider.New(opts)
-		if err != nil {
-			return nil, err
-		}
-		return p, nil
-	default:
-		return nil, fmt.Errorf("provider %s not supported", options.Name)
+	registryMu.RLock()
+	factory, ok := registry[options.Name]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("provider %s not supported, available providers: %s",
+			options.Name, strings.Join(Providers(), ", "))
+	}
+	return factory(options)
+}
+
+//SetSessions sets the fields of instances read from the cache that are not cached
+//using the session setter of the provider, when it registered one
+func SetSessions(options *Options, instances instance.XTInstances) {
+	registryMu.RLock()
+	setter, ok := setters[options.Name]
+	registryMu.RUnlock()
+	if ok {
+		setter(options, instances)
+	}
+}
+
+func setAWSSessions(options *Options, instances instance.XTInstances) {
+	awsProvider.SetSessions(awsOptions(options), instances)
+}
+
+func newAWS(options *Options) (Provider, error) {
+	p, err := awsProvider.New(awsOptions(options))
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+//awsOptions returns the aws provider options of options
+func awsOptions(options *Options) *awsProvider.Options {
+	opts := &awsProvider.Options{
+		VPC:             options.VPC,
+		Region:          options.Region,
+		CredsProfile:    options.CredsProfile,
+		AccessKeyID:     options.AccessKeyID,
+		SecretAccessKey: options.SecretAccessKey,
+		SessionToken:    options.SessionToken,
+		Tag:             options.Tag,
+		SearchPattern:   options.SearchPattern,
+		Query:           options.Query,
+		Filters:         options.Filters,
+		States:          options.States,
+		PageSize:        options.PageSize,
+		MaxInstances:    options.MaxInstances,
+		Endpoint:        options.Endpoint,
+		Insecure:        options.Insecure,
+		DisableSSL:      options.DisableSSL,
+		SigningRegion:   options.SigningRegion,
+		NoLogin:         options.NoLogin,
+		LoginOutput:     options.LoginOutput,
+		Warn:            options.Warn,
+	}
+	if options.Accounts != nil {
+		accounts := awsProvider.Accounts(*options.Accounts)
+		opts.Accounts = &accounts
+	}
+	for _, r := range options.Roles {
+		opts.Roles = append(opts.Roles, awsProvider.Role(r))
+	}
+	return opts
+}
+
+func newStatic(options *Options) (Provider, error) {
+	opts := &staticProvider.Options{
+		Path:          options.Settings["path"],
+		Format:        options.Settings["format"],
+		Tag:           options.Tag,
+		SearchPattern: options.SearchPattern,
+		Filters:       options.Filters,
+		States:        options.States,
+	}
+	p, err := staticProvider.New(opts)
+	if err != nil {
+		return nil, err
 	}
+	return p, nil
 }
@@ -0,0 +1,120 @@
+package provider
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/adamkobi/xt/internal/instance"
+)
+
+type testProvider struct {
+	opts *Options
+}
+
+func (p *testProvider) Get() (instance.XTInstances, error) {
+	return instance.XTInstances{{InstanceName: p.opts.SearchPattern}}, nil
+}
+
+func init() {
+	Register("test", func(opts *Options) (Provider, error) {
+		return &testProvider{opts: opts}, nil
+	})
+	RegisterSessionSetter("test", func(opts *Options, instances instance.XTInstances) {
+		for idx := range instances {
+			instances[idx].InstanceID = opts.Region + "/" + instances[idx].InstanceName
+		}
+	})
+}
+
+func TestNew(t *testing.T) {
+	p, err := New(&Options{Name: "test", SearchPattern: "web-1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	instances, err := p.Get()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := instances.Names(); !reflect.DeepEqual(got, []string{"web-1"}) {
+		t.Errorf("got %v, want the instances of the registered provider", got)
+	}
+}
+
+func TestNewUnknown(t *testing.T) {
+	_, err := New(&Options{Name: "gcp"})
+	want := "provider gcp not supported, available providers: aws, static, test"
+	if err == nil || err.Error() != want {
+		t.Errorf("got error %v, want %q", err, want)
+	}
+}
+
+func TestSetSessions(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider string
+		want     string
+	}{
+		{"registered setter", "test", "eu-west-1/web-1"},
+		{"no setter", "static", ""},
+		{"unknown provider", "gcp", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instances := instance.XTInstances{{InstanceName: "web-1"}}
+			SetSessions(&Options{Name: tt.provider, Region: "eu-west-1"}, instances)
+			if got := instances[0].InstanceID; got != tt.want {
+				t.Errorf("got instance ID %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegisterPanics(t *testing.T) {
+	factory := func(opts *Options) (Provider, error) { return nil, nil }
+	tests := []struct {
+		name      string
+		provider  string
+		factory   Factory
+		wantPanic string
+	}{
+		{"duplicate name", "test", factory, "provider: Register called twice for provider test"},
+		{"nil factory", "other", nil, "provider: Register factory is nil"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if got := fmt.Sprint(recover()); got != tt.wantPanic {
+					t.Errorf("got panic %q, want %q", got, tt.wantPanic)
+				}
+			}()
+			Register(tt.provider, tt.factory)
+		})
+	}
+
+	setter := func(opts *Options, instances instance.XTInstances) {}
+	setterTests := []struct {
+		name      string
+		provider  string
+		setter    SessionSetter
+		wantPanic string
+	}{
+		{"duplicate setter", "aws", setter, "provider: RegisterSessionSetter called twice for provider aws"},
+		{"unregistered provider", "other", setter, "provider: RegisterSessionSetter called for unregistered provider other"},
+		{"nil setter", "static", nil, "provider: RegisterSessionSetter setter is nil"},
+	}
+	for _, tt := range setterTests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if got := fmt.Sprint(recover()); got != tt.wantPanic {
+					t.Errorf("got panic %q, want %q", got, tt.wantPanic)
+				}
+			}()
+			RegisterSessionSetter(tt.provider, tt.setter)
+		})
+	}
+	if got := strings.Join(Providers(), ","); got != "aws,static,test" {
+		t.Errorf("got providers %s, want the failed registrations ignored", got)
+	}
+}
@@ -0,0 +1,123 @@
+package static
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+//parseINI parses an ansible style ini inventory
+//
+//	web-1 ansible_host=10.0.0.1 role=web
+//	[db]
+//	db-1 address=10.0.1.1
+//	[db:vars]
+//	role=db
+//	[prod:children]
+//	db
+func parseINI(data []byte) ([]host, error) {
+	inv := newInventory()
+	group, kind := "", ""
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: invalid section %s", lineNum, line)
+			}
+			group, kind = parseSection(strings.Trim(line, "[]"))
+			continue
+		}
+
+		fields, err := splitFields(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+
+		switch kind {
+		case "vars":
+			key, value, err := parseVar(line)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+			inv.addGroupVars(group, map[string]string{key: value})
+		case "children":
+			inv.children[group] = append(inv.children[group], fields[0])
+		case "":
+			vars := make(map[string]string)
+			for _, f := range fields[1:] {
+				key, value, err := parseVar(f)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %w", lineNum, err)
+				}
+				vars[key] = value
+			}
+			inv.addHost(fields[0], group, vars)
+		default:
+			return nil, fmt.Errorf("line %d: section type %s not supported", lineNum, kind)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return inv.resolve(), nil
+}
+
+func parseSection(section string) (string, string) {
+	parts := strings.SplitN(section, ":", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+func parseVar(s string) (string, string, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("expected key=value, got %s", s)
+	}
+	return strings.TrimSpace(parts[0]), strings.Trim(strings.TrimSpace(parts[1]), `"'`), nil
+}
+
+//splitFields splits a host line on whitespace while keeping quoted values together
+func splitFields(line string) ([]string, error) {
+	var (
+		fields []string
+		field  strings.Builder
+		quote  rune
+	)
+	for _, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+			field.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote = r
+			field.WriteRune(r)
+		case r == ' ' || r == '\t':
+			if field.Len() > 0 {
+				fields = append(fields, field.String())
+				field.Reset()
+			}
+		default:
+			field.WriteRune(r)
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in %s", line)
+	}
+	if field.Len() > 0 {
+		fields = append(fields, field.String())
+	}
+	return fields, nil
+}
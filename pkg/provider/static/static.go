@@ -0,0 +1,336 @@
+package static
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/adamkobi/xt/internal/config"
+	"github.com/adamkobi/xt/internal/instance"
+	"github.com/mitchellh/go-homedir"
+)
+
+//YAML is the ansible style yaml inventory format
+const YAML = "yaml"
+
+//INI is the ansible style ini inventory format
+const INI = "ini"
+
+//GroupTag matches hosts by the inventory groups they belong to
+const GroupTag = "group"
+
+const notSetError = "%s must be set"
+
+//Provider describes a static inventory file
+type Provider struct {
+	Options Options
+	hosts   []host
+}
+
+//Options is all the options StaticProvider can receive
+type Options struct {
+	Path          string
+	Format        string
+	Tag           string
+	SearchPattern string
+	Filters       map[string]string
+	States        []string
+}
+
+type host struct {
+	name   string
+	groups []string
+	vars   map[string]string
+}
+
+//New reads the inventory file and returns static provider configs
+func New(opts *Options) (*Provider, error) {
+	if opts.Path == "" {
+		return nil, fmt.Errorf(notSetError, "profile.provider.settings.path")
+	}
+
+	filename, err := inventoryPath(opts.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	format := opts.Format
+	if format == "" {
+		format = formatFromPath(filename)
+	}
+
+	var hosts []host
+	switch format {
+	case YAML:
+		hosts, err = parseYAML(data)
+	case INI:
+		hosts, err = parseINI(data)
+	default:
+		return nil, fmt.Errorf("inventory format %s not supported", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", filename, err)
+	}
+
+	return &Provider{
+		Options: *opts,
+		hosts:   hosts,
+	}, nil
+}
+
+func inventoryPath(p string) (string, error) {
+	p, err := homedir.Expand(p)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(config.DefaultDir(), p)
+	}
+	return p, nil
+}
+
+func formatFromPath(p string) string {
+	switch strings.ToLower(path.Ext(p)) {
+	case ".yml", ".yaml":
+		return YAML
+	default:
+		return INI
+	}
+}
+
+//Get will filter all hosts in inventory according to tag
+func (p *Provider) Get() (instance.XTInstances, error) {
+	var instances instance.XTInstances
+	for _, h := range p.hosts {
+		tags := h.tags()
+		value, ok := tags[p.Options.Tag]
+		if !ok || !match(p.Options.SearchPattern+"*", value) {
+			continue
+		}
+		if !h.matchFilters(tags, p.Options.Filters) || !h.matchStates(p.Options.States) {
+			continue
+		}
+		instances = append(instances, h.instance(value, tags))
+	}
+	return instances, nil
+}
+
+//tags returns host vars with the host name as Name tag unless vars override it
+func (h *host) tags() map[string]string {
+	tags := map[string]string{"Name": h.name}
+	for k, v := range h.vars {
+		tags[k] = v
+	}
+	return tags
+}
+
+func (h *host) matchFilters(tags map[string]string, filters map[string]string) bool {
+	for key, pattern := range filters {
+		key = strings.TrimPrefix(key, "tag:")
+		if key == GroupTag {
+			if !h.inGroup(pattern) {
+				return false
+			}
+			continue
+		}
+		value, ok := tags[key]
+		if !ok || !match(pattern, value) {
+			return false
+		}
+	}
+	return true
+}
+
+//matchStates filters hosts by their state var, hosts without a state are always matched
+func (h *host) matchStates(states []string) bool {
+	state, ok := h.vars["state"]
+	if !ok || len(states) == 0 {
+		return true
+	}
+	for _, s := range states {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *host) inGroup(pattern string) bool {
+	for _, g := range h.groups {
+		if match(pattern, g) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *host) instance(name string, tags map[string]string) instance.XTInstance {
+	return instance.XTInstance{
+		InstanceName:     name,
+		InstanceID:       h.name,
+		PrivateIPAddress: firstVar(h.vars, "address", "ansible_host"),
+		PublicIPAddress:  firstVar(h.vars, "public_address"),
+		PrivateDNSName:   firstVar(h.vars, "private_dns_name"),
+		PublicDNSName:    firstVar(h.vars, "public_dns_name"),
+		InstanceType:     firstVar(h.vars, "instance_type"),
+		State:            firstVar(h.vars, "state"),
+		AvailabilityZone: firstVar(h.vars, "availability_zone"),
+		Tags:             tags,
+	}
+}
+
+func firstVar(vars map[string]string, keys ...string) string {
+	for _, k := range keys {
+		if v, ok := vars[k]; ok {
+			return v
+		}
+	}
+	return ""
+}
+
+//match reports whether value matches a glob pattern using EC2 filter semantics
+func match(pattern, value string) bool {
+	ok, err := path.Match(pattern, value)
+	if err != nil {
+		return pattern == value
+	}
+	return ok
+}
+
+//inventory collects hosts and groups while parsing, preserving file order
+type inventory struct {
+	order    []string
+	hosts    map[string]*host
+	groups   map[string]map[string]string
+	children map[string][]string
+	members  map[string][]string
+}
+
+func newInventory() *inventory {
+	return &inventory{
+		hosts:    make(map[string]*host),
+		groups:   make(map[string]map[string]string),
+		children: make(map[string][]string),
+		members:  make(map[string][]string),
+	}
+}
+
+func (inv *inventory) addHost(name, group string, vars map[string]string) {
+	h, ok := inv.hosts[name]
+	if !ok {
+		h = &host{name: name, vars: make(map[string]string)}
+		inv.hosts[name] = h
+		inv.order = append(inv.order, name)
+	}
+	for k, v := range vars {
+		h.vars[k] = v
+	}
+	if group != "" {
+		inv.members[group] = append(inv.members[group], name)
+	}
+}
+
+func (inv *inventory) addGroupVars(group string, vars map[string]string) {
+	if _, ok := inv.groups[group]; !ok {
+		inv.groups[group] = make(map[string]string)
+	}
+	for k, v := range vars {
+		inv.groups[group][k] = v
+	}
+}
+
+//byDepth orders groups so parent group vars are applied before child group vars
+func (inv *inventory) byDepth(groups []string) []string {
+	parents := make(map[string][]string)
+	for parent, children := range inv.children {
+		for _, child := range children {
+			parents[child] = append(parents[child], parent)
+		}
+	}
+	var depth func(group string, seen map[string]bool) int
+	depth = func(group string, seen map[string]bool) int {
+		if seen[group] {
+			return 0
+		}
+		seen[group] = true
+		d := 0
+		for _, p := range parents[group] {
+			if pd := depth(p, seen) + 1; pd > d {
+				d = pd
+			}
+		}
+		return d
+	}
+
+	ordered := append([]string{}, groups...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return depth(ordered[i], make(map[string]bool)) < depth(ordered[j], make(map[string]bool))
+	})
+	return ordered
+}
+
+//resolve expands child groups and applies group vars to hosts that do not set them
+func (inv *inventory) resolve() []host {
+	hostGroups := make(map[string]map[string]bool)
+	var visit func(group string, seen map[string]bool) []string
+	visit = func(group string, seen map[string]bool) []string {
+		if seen[group] {
+			return nil
+		}
+		seen[group] = true
+		members := append([]string{}, inv.members[group]...)
+		for _, child := range inv.children[group] {
+			members = append(members, visit(child, seen)...)
+		}
+		return members
+	}
+
+	var groups []string
+	for g := range inv.members {
+		groups = append(groups, g)
+	}
+	for g := range inv.children {
+		if _, ok := inv.members[g]; !ok {
+			groups = append(groups, g)
+		}
+	}
+	sort.Strings(groups)
+
+	for _, g := range groups {
+		for _, name := range visit(g, make(map[string]bool)) {
+			if hostGroups[name] == nil {
+				hostGroups[name] = make(map[string]bool)
+			}
+			hostGroups[name][g] = true
+		}
+	}
+
+	var hosts []host
+	for _, name := range inv.order {
+		h := *inv.hosts[name]
+		vars := make(map[string]string)
+		for g := range hostGroups[name] {
+			h.groups = append(h.groups, g)
+		}
+		sort.Strings(h.groups)
+		for _, g := range inv.byDepth(h.groups) {
+			for k, v := range inv.groups[g] {
+				vars[k] = v
+			}
+		}
+		for k, v := range h.vars {
+			vars[k] = v
+		}
+		h.vars = vars
+		hosts = append(hosts, h)
+	}
+	return hosts
+}
@@ -0,0 +1,177 @@
+package static
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const iniInventory = `
+# ungrouped host
+bastion-1 ansible_host=10.0.0.1
+
+[web]
+web-1 ansible_host=10.0.1.1 role=frontend
+web-2 address="10.0.1.2" public_address=1.2.3.4
+
+[web:vars]
+role=web
+env=prod
+
+[db]
+db-1 address=10.0.2.1
+
+[prod:children]
+web
+db
+
+[prod:vars]
+env=production
+`
+
+const yamlInventory = `
+all:
+  hosts:
+    bastion-1:
+      ansible_host: 10.0.0.1
+  children:
+    prod:
+      vars:
+        env: production
+      children:
+        web:
+          vars:
+            role: web
+            env: prod
+          hosts:
+            web-1:
+              ansible_host: 10.0.1.1
+              role: frontend
+            web-2:
+              address: 10.0.1.2
+              public_address: 1.2.3.4
+        db:
+          hosts:
+            db-1:
+              address: 10.0.2.1
+`
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		parse func([]byte) ([]host, error)
+		data  string
+	}{
+		{name: "ini", parse: parseINI, data: iniInventory},
+		{name: "yaml", parse: parseYAML, data: yamlInventory},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts, err := tt.parse([]byte(tt.data))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			byName := make(map[string]host)
+			for _, h := range hosts {
+				byName[h.name] = h
+			}
+			if len(byName) != 4 {
+				t.Fatalf("expected 4 hosts, got %d", len(byName))
+			}
+
+			web1 := byName["web-1"]
+			if web1.vars["role"] != "frontend" {
+				t.Errorf("host vars should override group vars, got role=%s", web1.vars["role"])
+			}
+			if web1.vars["env"] != "prod" {
+				t.Errorf("child group vars should override parent group vars, got env=%s", web1.vars["env"])
+			}
+			if !web1.inGroup("prod") || !web1.inGroup("web") {
+				t.Errorf("expected web-1 in groups prod and web, got %v", web1.groups)
+			}
+
+			db1 := byName["db-1"]
+			if db1.vars["env"] != "production" {
+				t.Errorf("expected parent group vars on db-1, got env=%s", db1.vars["env"])
+			}
+
+			web2 := byName["web-2"]
+			inst := web2.instance("web-2", web2.tags())
+			if inst.PrivateIPAddress != "10.0.1.2" || inst.PublicIPAddress != "1.2.3.4" {
+				t.Errorf("unexpected addresses %s %s", inst.PrivateIPAddress, inst.PublicIPAddress)
+			}
+		})
+	}
+}
+
+func TestGet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xt-static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	inventory := filepath.Join(dir, "hosts.ini")
+	if err := ioutil.WriteFile(inventory, []byte(iniInventory), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		opts    Options
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "search by name prefix",
+			opts: Options{Path: inventory, Tag: "Name", SearchPattern: "web"},
+			want: []string{"web-1", "web-2"},
+		},
+		{
+			name: "search by custom tag",
+			opts: Options{Path: inventory, Tag: "role", SearchPattern: "front"},
+			want: []string{"frontend"},
+		},
+		{
+			name: "filter by group",
+			opts: Options{Path: inventory, Tag: "Name", Filters: map[string]string{"group": "db"}},
+			want: []string{"db-1"},
+		},
+		{
+			name: "filter by var glob",
+			opts: Options{Path: inventory, Tag: "Name", Filters: map[string]string{"ansible_host": "10.0.*"}},
+			want: []string{"bastion-1", "web-1"},
+		},
+		{
+			name:    "missing path",
+			opts:    Options{Tag: "Name"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := New(&tt.opts)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			instances, err := p.Get()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := instances.Names(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package static
+
+import (
+	"fmt"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+type yamlGroup struct {
+	Hosts    map[string]map[string]interface{} `yaml:"hosts"`
+	Vars     map[string]interface{}            `yaml:"vars"`
+	Children map[string]yamlGroup              `yaml:"children"`
+}
+
+//parseYAML parses an ansible style yaml inventory
+//
+//	all:
+//	  hosts:
+//	    web-1:
+//	      ansible_host: 10.0.0.1
+//	  children:
+//	    db:
+//	      hosts:
+//	        db-1:
+//	      vars:
+//	        role: db
+func parseYAML(data []byte) ([]host, error) {
+	var groups map[string]yamlGroup
+	if err := yaml.Unmarshal(data, &groups); err != nil {
+		return nil, err
+	}
+
+	inv := newInventory()
+	for _, name := range sortedKeys(groups) {
+		addYAMLGroup(inv, name, groups[name])
+	}
+	return inv.resolve(), nil
+}
+
+func addYAMLGroup(inv *inventory, name string, g yamlGroup) {
+	var hostnames []string
+	for hostname := range g.Hosts {
+		hostnames = append(hostnames, hostname)
+	}
+	sort.Strings(hostnames)
+	for _, hostname := range hostnames {
+		inv.addHost(hostname, name, stringVars(g.Hosts[hostname]))
+	}
+	inv.addGroupVars(name, stringVars(g.Vars))
+	for _, child := range sortedKeys(g.Children) {
+		inv.children[name] = append(inv.children[name], child)
+		addYAMLGroup(inv, child, g.Children[child])
+	}
+}
+
+func sortedKeys(groups map[string]yamlGroup) []string {
+	var keys []string
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func stringVars(vars map[string]interface{}) map[string]string {
+	s := make(map[string]string)
+	for k, v := range vars {
+		if v == nil {
+			continue
+		}
+		s[k] = fmt.Sprint(v)
+	}
+	return s
+}
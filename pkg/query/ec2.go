@@ -0,0 +1,49 @@
+package query
+
+import "strings"
+
+//EC2Filters returns the EC2 filters implied by the terms every match must satisfy.
+//Only equality terms of the top level AND chain EC2 evaluates the same way are returned,
+//the query must still be evaluated on the instances returned.
+func EC2Filters(e Expr) map[string]string {
+	filters := make(map[string]string)
+	for _, t := range conjuncts(e) {
+		name, ok := t.ec2Filter()
+		if !ok {
+			continue
+		}
+		//EC2 filters with the same name are OR-ed, only the first term can be pushed down
+		if _, exists := filters[name]; !exists {
+			filters[name] = t.value
+		}
+	}
+	if len(filters) == 0 {
+		return nil
+	}
+	return filters
+}
+
+//conjuncts returns the terms of the top level AND chain of e
+func conjuncts(e Expr) []*term {
+	switch e := e.(type) {
+	case *and:
+		return append(conjuncts(e.left), conjuncts(e.right)...)
+	case *term:
+		return []*term{e}
+	default:
+		return nil
+	}
+}
+
+//ec2Filter returns the EC2 filter matching the same instances as t
+func (t *term) ec2Filter() (string, bool) {
+	//EC2 filters support * and ? wildcards but no character classes or CIDR blocks
+	if t.op != OpEqual || t.cidr != nil || strings.Contains(t.value, "[") || t.value == "" {
+		return "", false
+	}
+	if strings.HasPrefix(t.field, tagPrefix) {
+		return t.field, true
+	}
+	f := fields[t.field]
+	return f.filter, f.filter != ""
+}
@@ -0,0 +1,89 @@
+package query
+
+import (
+	"sort"
+
+	"github.com/adamkobi/xt/internal/instance"
+)
+
+const (
+	tagPrefix = "tag:"
+	//notFound is the value providers set for missing instance fields
+	notFound = "not found"
+)
+
+//field describes an instance field that can be queried
+type field struct {
+	//filter is the EC2 filter the field can be pushed down to, if any
+	filter string
+	values func(inst *instance.XTInstance) []string
+}
+
+var fields = map[string]field{
+	"name": {
+		values: func(i *instance.XTInstance) []string { return []string{i.InstanceName} },
+	},
+	"id": {
+		filter: "instance-id",
+		values: func(i *instance.XTInstance) []string { return []string{i.InstanceID} },
+	},
+	"type": {
+		filter: "instance-type",
+		values: func(i *instance.XTInstance) []string { return []string{i.InstanceType} },
+	},
+	"az": {
+		filter: "availability-zone",
+		values: func(i *instance.XTInstance) []string { return []string{i.AvailabilityZone} },
+	},
+	"state": {
+		filter: "instance-state-name",
+		values: func(i *instance.XTInstance) []string { return []string{i.State} },
+	},
+	"image": {
+		filter: "image-id",
+		values: func(i *instance.XTInstance) []string { return []string{i.ImageID} },
+	},
+	"subnet": {
+		filter: "subnet-id",
+		values: func(i *instance.XTInstance) []string { return []string{i.SubnetID} },
+	},
+	"lifecycle": {
+		values: func(i *instance.XTInstance) []string { return []string{lifecycle(i)} },
+	},
+	"account": {
+		values: func(i *instance.XTInstance) []string { return []string{i.AccountID, i.AccountAlias} },
+	},
+	"ip": {
+		values: func(i *instance.XTInstance) []string { return []string{i.PrivateIPAddress, i.PublicIPAddress} },
+	},
+	"private-ip": {
+		filter: "private-ip-address",
+		values: func(i *instance.XTInstance) []string { return []string{i.PrivateIPAddress} },
+	},
+	"public-ip": {
+		filter: "ip-address",
+		values: func(i *instance.XTInstance) []string { return []string{i.PublicIPAddress} },
+	},
+}
+
+//lifecycle returns the instance lifecycle, EC2 only sets it for spot and scheduled instances
+func lifecycle(i *instance.XTInstance) string {
+	if i.InstanceLifecycle == "" || i.InstanceLifecycle == notFound {
+		return "on-demand"
+	}
+	return i.InstanceLifecycle
+}
+
+func isIPField(name string) bool {
+	return name == "ip" || name == "private-ip" || name == "public-ip"
+}
+
+//Fields returns the names of the instance fields that can be queried, any other name refers to a tag
+func Fields() []string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
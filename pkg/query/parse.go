@@ -0,0 +1,207 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenWord
+	tokenString
+	tokenOp
+	tokenOpen
+	tokenClose
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+	pos   int
+}
+
+//lex splits a query to words, quoted strings, operators and parentheses
+func lex(input string) ([]token, error) {
+	var tokens []token
+	runes := []rune(input)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, token{kind: tokenOpen, value: "(", pos: i})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{kind: tokenClose, value: ")", pos: i})
+			i++
+		case r == '=' || r == '~':
+			tokens = append(tokens, token{kind: tokenOp, value: string(r), pos: i})
+			i++
+		case r == '!':
+			if i+1 >= len(runes) || runes[i+1] != '=' {
+				return nil, fmt.Errorf("unexpected ! at position %d, expected !=", i)
+			}
+			tokens = append(tokens, token{kind: tokenOp, value: OpNotEqual, pos: i})
+			i += 2
+		case r == '"' || r == '\'':
+			start := i
+			var b strings.Builder
+			for i++; i < len(runes) && runes[i] != r; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				b.WriteRune(runes[i])
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("unterminated string at position %d", start)
+			}
+			tokens = append(tokens, token{kind: tokenString, value: b.String(), pos: start})
+			i++
+		default:
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && !strings.ContainsRune("()=~!\"'", runes[i]) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenWord, value: string(runes[start:i]), pos: start})
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(runes)}), nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+//Parse parses a query, terms are combined with AND, OR and NOT and grouped with parentheses.
+//A term compares a field to a value with = (glob or CIDR), != or ~ (regular expression).
+//Fields are name, id, type, az, state, image, subnet, lifecycle, account, ip, private-ip and public-ip,
+//any other field, optionally prefixed with tag:, refers to an instance tag.
+func Parse(input string) (Expr, error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	expr, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %q at position %d", t.value, t.pos)
+	}
+	return expr, nil
+}
+
+//IsQuery reports whether a search argument is a query rather than a name prefix
+func IsQuery(input string) bool {
+	if strings.ContainsAny(input, "=~()") {
+		return true
+	}
+	for _, word := range strings.Fields(input) {
+		if isKeyword(word, "AND") || isKeyword(word, "OR") || isKeyword(word, "NOT") {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) keyword(k string) bool {
+	t := p.peek()
+	if t.kind == tokenWord && isKeyword(t.value, k) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) or() (Expr, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("OR") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = &or{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) and() (Expr, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("AND") {
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = &and{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) unary() (Expr, error) {
+	if p.keyword("NOT") {
+		expr, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &not{expr: expr}, nil
+	}
+
+	t := p.next()
+	switch t.kind {
+	case tokenOpen:
+		expr, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if c := p.next(); c.kind != tokenClose {
+			return nil, fmt.Errorf("missing ) at position %d", c.pos)
+		}
+		return expr, nil
+	case tokenWord, tokenString:
+		return p.term(t)
+	case tokenEOF:
+		return nil, fmt.Errorf("unexpected end of query")
+	default:
+		return nil, fmt.Errorf("unexpected %q at position %d", t.value, t.pos)
+	}
+}
+
+func (p *parser) term(field token) (Expr, error) {
+	op := p.next()
+	if op.kind != tokenOp {
+		return nil, fmt.Errorf("expected =, != or ~ after %q at position %d", field.value, op.pos)
+	}
+	value := p.next()
+	if value.kind != tokenWord && value.kind != tokenString {
+		return nil, fmt.Errorf("expected value after %s%s at position %d", field.value, op.value, value.pos)
+	}
+	return newTerm(field.value, op.value, value.value)
+}
+
+func isKeyword(word, keyword string) bool {
+	return strings.EqualFold(word, keyword)
+}
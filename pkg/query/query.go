@@ -0,0 +1,188 @@
+//Package query implements the expressions used to search instances, e.g. role=web AND az=us-east-1a AND NOT lifecycle=spot
+package query
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/adamkobi/xt/internal/instance"
+)
+
+//Expr is a parsed query evaluated against instances
+type Expr interface {
+	Match(inst *instance.XTInstance) bool
+	String() string
+}
+
+//Operators comparing a field to a value
+const (
+	//OpEqual matches values equal to a glob pattern, or IP addresses inside a CIDR block
+	OpEqual = "="
+	//OpNotEqual negates OpEqual
+	OpNotEqual = "!="
+	//OpRegex matches values against a regular expression
+	OpRegex = "~"
+)
+
+type and struct {
+	left, right Expr
+}
+
+func (e *and) Match(inst *instance.XTInstance) bool {
+	return e.left.Match(inst) && e.right.Match(inst)
+}
+
+func (e *and) String() string {
+	return fmt.Sprintf("(%s AND %s)", e.left, e.right)
+}
+
+type or struct {
+	left, right Expr
+}
+
+func (e *or) Match(inst *instance.XTInstance) bool {
+	return e.left.Match(inst) || e.right.Match(inst)
+}
+
+func (e *or) String() string {
+	return fmt.Sprintf("(%s OR %s)", e.left, e.right)
+}
+
+type not struct {
+	expr Expr
+}
+
+func (e *not) Match(inst *instance.XTInstance) bool {
+	return !e.expr.Match(inst)
+}
+
+func (e *not) String() string {
+	return fmt.Sprintf("NOT %s", e.expr)
+}
+
+//term compares a single instance field to a value
+type term struct {
+	field string
+	op    string
+	value string
+
+	pattern *regexp.Regexp
+	cidr    *net.IPNet
+}
+
+func newTerm(field, op, value string) (*term, error) {
+	t := &term{field: field, op: op, value: value}
+	if _, ok := fields[field]; !ok && !strings.HasPrefix(field, tagPrefix) {
+		t.field = tagPrefix + field
+	}
+
+	var err error
+	switch {
+	case op == OpRegex:
+		t.pattern, err = regexp.Compile(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %q: %w", value, err)
+		}
+	case isIPField(t.field) && strings.Contains(value, "/"):
+		_, t.cidr, err = net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", value, err)
+		}
+	default:
+		t.pattern, err = globPattern(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", value, err)
+		}
+	}
+	return t, nil
+}
+
+func (t *term) Match(inst *instance.XTInstance) bool {
+	matched := false
+	for _, v := range t.values(inst) {
+		if t.matchValue(v) {
+			matched = true
+			break
+		}
+	}
+	if t.op == OpNotEqual {
+		return !matched
+	}
+	return matched
+}
+
+func (t *term) matchValue(v string) bool {
+	if t.cidr != nil {
+		ip := net.ParseIP(v)
+		return ip != nil && t.cidr.Contains(ip)
+	}
+	return t.pattern.MatchString(v)
+}
+
+//values returns the instance values the term field refers to, missing values are omitted
+func (t *term) values(inst *instance.XTInstance) []string {
+	var values []string
+	if strings.HasPrefix(t.field, tagPrefix) {
+		if v, ok := inst.Tags[strings.TrimPrefix(t.field, tagPrefix)]; ok {
+			values = append(values, v)
+		}
+		return values
+	}
+	for _, v := range fields[t.field].values(inst) {
+		if v != "" && v != notFound {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+func (t *term) String() string {
+	return fmt.Sprintf("%s%s%s", t.field, t.op, quote(t.value))
+}
+
+//Filter returns the instances matching e
+func Filter(e Expr, instances instance.XTInstances) instance.XTInstances {
+	var matched instance.XTInstances
+	for idx := range instances {
+		if e.Match(&instances[idx]) {
+			matched = append(matched, instances[idx])
+		}
+	}
+	return matched
+}
+
+//globPattern converts a glob with *, ? and [] to an anchored regular expression
+func globPattern(glob string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	inClass := false
+	for _, r := range glob {
+		switch {
+		case inClass:
+			b.WriteRune(r)
+			if r == ']' {
+				inClass = false
+			}
+		case r == '*':
+			b.WriteString(".*")
+		case r == '?':
+			b.WriteString(".")
+		case r == '[':
+			inClass = true
+			b.WriteRune(r)
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+func quote(value string) string {
+	if value == "" || strings.ContainsAny(value, " \t()\"'=!~") {
+		return fmt.Sprintf("%q", value)
+	}
+	return value
+}
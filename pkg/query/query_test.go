@@ -0,0 +1,156 @@
+package query
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/adamkobi/xt/internal/instance"
+)
+
+var testInstances = instance.XTInstances{
+	{
+		InstanceName:      "web-1",
+		InstanceID:        "i-0001",
+		InstanceType:      "t3.micro",
+		AvailabilityZone:  "us-east-1a",
+		PrivateIPAddress:  "10.0.1.10",
+		PublicIPAddress:   "54.1.2.3",
+		InstanceLifecycle: "spot",
+		Tags:              map[string]string{"Name": "web-1", "role": "web", "env": "prod"},
+	},
+	{
+		InstanceName:      "web-2",
+		InstanceID:        "i-0002",
+		InstanceType:      "t3.large",
+		AvailabilityZone:  "us-east-1a",
+		PrivateIPAddress:  "10.0.2.10",
+		PublicIPAddress:   "not found",
+		InstanceLifecycle: "not found",
+		Tags:              map[string]string{"Name": "web-2", "role": "web", "env": "staging"},
+	},
+	{
+		InstanceName:      "db-1",
+		InstanceID:        "i-0003",
+		InstanceType:      "r5.xlarge",
+		AvailabilityZone:  "us-east-1b",
+		PrivateIPAddress:  "10.1.0.5",
+		InstanceLifecycle: "not found",
+		Tags:              map[string]string{"Name": "db-1", "role": "db", "env": "prod"},
+	},
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"role=web", []string{"web-1", "web-2"}},
+		{"role=web AND az=us-east-1a AND NOT lifecycle=spot", []string{"web-2"}},
+		{"lifecycle=on-demand", []string{"db-1", "web-2"}},
+		{"tag:env=prod", []string{"db-1", "web-1"}},
+		{"name=web-*", []string{"web-1", "web-2"}},
+		{"name=web-[2-9]", []string{"web-2"}},
+		{`name~"^(web|db)-1$"`, []string{"db-1", "web-1"}},
+		{`name~"^db"`, []string{"db-1"}},
+		{"type=t3.* and env!=prod", []string{"web-2"}},
+		{"ip=10.0.0.0/16", []string{"web-1", "web-2"}},
+		{"ip=54.1.2.3", []string{"web-1"}},
+		{"private-ip=10.1.*", []string{"db-1"}},
+		{"id=i-0003 OR id=i-0001", []string{"db-1", "web-1"}},
+		{"role=db OR (role=web AND env=staging)", []string{"db-1", "web-2"}},
+		{"NOT (role=web OR role=db)", nil},
+		{"owner=*", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			expr, err := Parse(tt.query)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			matched := Filter(expr, testInstances)
+			var got []string
+			if len(matched) > 0 {
+				got = matched.Names()
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"role",
+		"role=",
+		"role=web AND",
+		"(role=web",
+		"role=web)",
+		`role="web`,
+		"name~(",
+		"ip=10.0.0.0/99",
+		"role!web",
+	}
+	for _, query := range tests {
+		t.Run(query, func(t *testing.T) {
+			if _, err := Parse(query); err == nil {
+				t.Errorf("expected error parsing %q", query)
+			}
+		})
+	}
+}
+
+func TestIsQuery(t *testing.T) {
+	tests := []struct {
+		input string
+		want  bool
+	}{
+		{"web", false},
+		{"web-1", false},
+		{"role=web", true},
+		{"name~web", true},
+		{"not web", true},
+	}
+	for _, tt := range tests {
+		if got := IsQuery(tt.input); got != tt.want {
+			t.Errorf("IsQuery(%q) = %v, want %v", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestEC2Filters(t *testing.T) {
+	tests := []struct {
+		query string
+		want  map[string]string
+	}{
+		{
+			query: "role=web AND az=us-east-1a AND NOT lifecycle=spot",
+			want:  map[string]string{"tag:role": "web", "availability-zone": "us-east-1a"},
+		},
+		{
+			query: "type=t3.* AND private-ip=10.0.0.0/16 AND name~web AND id=i-1 AND id=i-2",
+			want:  map[string]string{"instance-type": "t3.*", "instance-id": "i-1"},
+		},
+		{
+			query: "role=web OR role=db",
+			want:  nil,
+		},
+		{
+			query: "name=web-[12] AND env!=prod",
+			want:  nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			expr, err := Parse(tt.query)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := EC2Filters(expr); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -13,40 +13,66 @@ import (
 
 const keyNotFound = "not found"
 
+//promptStdio renders prompts on stderr, which keeps the output of commands parseable
+var promptStdio = survey.WithStdio(os.Stdin, os.Stderr, os.Stderr)
+
 //Select returns the user selected instance or default instance
 func Select(io *iostreams.IOStreams, options []string, searchPattern string) (string, error) {
+	sort.Strings(options)
+	idx, err := SelectIndex(io, options, searchPattern)
+	if err != nil {
+		return "", err
+	}
+	if idx < 0 {
+		return searchPattern, nil
+	}
+	return options[idx], nil
+}
+
+//SelectIndex returns the index of the user selected option, or -1 when there are no options
+//and the user confirmed using the search pattern instead. Options are shown in the given order.
+func SelectIndex(io *iostreams.IOStreams, options []string, searchPattern string) (int, error) {
 	cs := io.ColorScheme()
 	switch len(options) {
 	case 0:
-		fmt.Fprintf(io.Out, fmt.Sprintf("%s No instances found matching %s\n", cs.WarningIcon(), cs.Bold(searchPattern)))
+		fmt.Fprintf(io.ErrOut, "%s No instances found matching %s\n", cs.WarningIcon(), cs.Bold(searchPattern))
 		var result bool
 		if err := survey.AskOne(&survey.Confirm{
 			Message: fmt.Sprintf("Connect to %s?", searchPattern),
 			Default: true,
-		}, &result); err != nil {
-			return "", err
+		}, &result, promptStdio); err != nil {
+			return 0, err
 		}
 		if !result {
-			return "", fmt.Errorf("command cancelled")
+			return 0, fmt.Errorf("command cancelled")
 		}
-		return searchPattern, nil
+		return -1, nil
 	case 1:
-		fmt.Fprintf(io.Out, fmt.Sprintf("found one host %s\n", cs.Bold(options[0])))
-		return options[0], nil
+		fmt.Fprintf(io.ErrOut, "found one host %s\n", cs.Bold(options[0]))
+		return 0, nil
 	default:
-		var result string
-		sort.Strings(options)
+		var result int
 		if err := survey.AskOne(&survey.Select{
 			Message:  "Available Hosts:",
 			Options:  options,
 			PageSize: 15,
-		}, &result); err != nil {
-			return "", err
+		}, &result, promptStdio); err != nil {
+			return 0, err
 		}
 		return result, nil
 	}
 }
 
+//Confirm asks the user a yes or no question
+func Confirm(message string, def bool) (bool, error) {
+	var result bool
+	err := survey.AskOne(&survey.Confirm{
+		Message: message,
+		Default: def,
+	}, &result, promptStdio)
+	return result, err
+}
+
 //Table generates a table according to data provided
 func Table(header []string, instances [][]string) {
 	tbl := tablewriter.NewWriter(os.Stdout)